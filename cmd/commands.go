@@ -0,0 +1,249 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"aws-examples/internal/app"
+)
+
+type command struct {
+	summary string
+	run     func(cfg config, args []string) error
+}
+
+var commands = map[string]command{
+	"serve":     {"run the HTTP server (default)", runServe},
+	"init":      {"create the bucket and table if missing and wait until they are usable", runInit},
+	"export":    {"write all file metadata as JSON lines", runExport},
+	"import":    {"load file metadata written by export", runImport},
+	"migrate":   {"backfill attributes missing from older metadata rows", runMigrate},
+	"reconcile": {"report (and optionally delete) objects and metadata that don't match up", runReconcile},
+	"teardown":  {"delete all objects, the bucket and the table (local endpoints only unless -force)", runTeardown},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [command] [flags]\n\ncommands:\n", os.Args[0])
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the flags of a command.\n", os.Args[0])
+}
+
+func runServe(cfg config, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	ensure := fs.Bool("ensure-infrastructure", true,
+		"create missing infrastructure in the background, or only check it exists if false; /ready is 503 until done")
+	fs.Parse(args)
+
+	service, closer, err := newService(cfg)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	// A failed infrastructure check shuts the server down gracefully.
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	prepare := service.CheckInfrastructure
+	if *ensure {
+		prepare = service.EnsureInfrastructure
+	}
+	go func() {
+		if err := prepare(ctx); err != nil && ctx.Err() == nil {
+			cancel(err)
+		}
+	}()
+	if err := service.RunContext(ctx, cfg.ListenAddr); err != nil {
+		return err
+	}
+	return context.Cause(ctx)
+}
+
+func runInit(cfg config, args []string) error {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 5*time.Minute, "how long to wait for the table to become ACTIVE")
+	fs.Parse(args)
+
+	service, closer, err := newService(cfg)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	return service.EnsureInfrastructure(ctx)
+}
+
+func runExport(cfg config, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	output := fs.String("o", "-", "output file, - for stdout")
+	compress := fs.Bool("gzip", false, "gzip the output")
+	from := fs.String("from", "", "resume from the token of a \"# checkpoint:\" line of an interrupted export")
+	fs.Parse(args)
+
+	service, closer, err := newService(cfg)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	var out io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	if *compress {
+		gz := gzip.NewWriter(out)
+		defer gz.Close()
+		out = gz
+	}
+	count, err := service.ExportMetadata(context.Background(), out, app.ExportOptions{StartToken: *from, IncludeDeleted: true})
+	if err != nil {
+		return err
+	}
+	log.Printf("exported %d items", count)
+	return nil
+}
+
+func runImport(cfg config, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	input := fs.String("i", "-", "input file, - for stdin")
+	overwrite := fs.Bool("overwrite", false, "replace items that already exist")
+	fs.Parse(args)
+
+	service, closer, err := newService(cfg)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	var in io.Reader = os.Stdin
+	if *input != "-" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	result, err := service.ImportMetadata(context.Background(), in, *overwrite)
+	log.Printf("imported %d items, skipped %d existing", result.Imported, result.Skipped)
+	return err
+}
+
+func runReconcile(cfg config, args []string) error {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	minAge := fs.Duration("min-age", time.Hour, "ignore objects modified more recently than this")
+	deleteOrphans := fs.Bool("delete-orphans", false, "delete objects no metadata refers to")
+	maxDeletes := fs.Int("max-deletes", 0, "delete no orphans if there are more than this (0 means no limit)")
+	flagMissing := fs.Bool("flag-missing", false, "set object_missing_at on files whose object is missing")
+	fs.Parse(args)
+
+	service, closer, err := newService(cfg)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	report, err := service.Reconcile(context.Background(), app.ReconcileOptions{
+		MinAge:        *minAge,
+		DeleteOrphans: *deleteOrphans,
+		MaxDeletes:    *maxDeletes,
+		FlagMissing:   *flagMissing,
+	})
+	if report != nil {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	}
+	return err
+}
+
+func runTeardown(cfg config, args []string) error {
+	fs := flag.NewFlagSet("teardown", flag.ExitOnError)
+	yes := fs.Bool("yes", false, "confirm deleting everything; required")
+	force := fs.Bool("force", false, "allow a non-local endpoint, including real AWS")
+	timeout := fs.Duration("timeout", 5*time.Minute, "how long to wait for the bucket and table to be gone")
+	fs.Parse(args)
+
+	if !*yes {
+		return fmt.Errorf("teardown deletes bucket %s with all its objects and table %s; pass -yes to confirm", cfg.Bucket, cfg.Table)
+	}
+	service, closer, err := newService(cfg)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	report, err := service.Teardown(ctx, app.TeardownOptions{Force: *force})
+	if report != nil {
+		log.Printf("bucket %s: deleted %d objects, bucket deleted: %t; table %s deleted: %t",
+			report.Bucket, report.ObjectsDeleted, report.BucketDeleted, report.Table, report.TableDeleted)
+	}
+	return err
+}
+
+func runMigrate(cfg config, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "log the changes without writing them")
+	dimensions := fs.Bool("dimensions", false, "download images without width/height to measure them")
+	contentTypes := fs.Bool("content-types", false, "set the content type of objects stored as octet-stream from their extension")
+	checkpoint := fs.String("checkpoint", "", "file to save progress to and resume from")
+	fs.Parse(args)
+
+	service, closer, err := newService(cfg)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	opts := app.MigrateOptions{DryRun: *dryRun, Dimensions: *dimensions, ContentTypes: *contentTypes}
+	// A dry run reads the checkpoint but doesn't advance it.
+	if *checkpoint != "" {
+		token, err := os.ReadFile(*checkpoint)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		opts.StartToken = strings.TrimSpace(string(token))
+		if opts.StartToken != "" {
+			log.Printf("resuming from %s", *checkpoint)
+		}
+		if !*dryRun {
+			opts.Checkpoint = func(token string) error {
+				return os.WriteFile(*checkpoint, []byte(token), 0o644)
+			}
+		}
+	}
+
+	report, err := service.Migrate(context.Background(), opts)
+	if report != nil {
+		log.Printf("scanned %d, updated %d, failed %d", report.Scanned, report.Updated, report.Failed)
+	}
+	if err == nil && *checkpoint != "" && !*dryRun {
+		// Finished: the next run starts from the beginning.
+		err = os.Remove(*checkpoint)
+	}
+	return err
+}
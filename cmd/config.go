@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config is read from the environment. The defaults match the LocalStack setup
+// from docker-compose.yml.
+type config struct {
+	Region          string
+	Endpoint        string
+	Bucket          string
+	Table           string
+	ListenAddr      string
+	S3PathStyle     bool
+	S3UseAccelerate bool
+	// SecondaryBucket and SecondaryRegion configure a read-only replica used
+	// when the primary bucket can't serve an object.
+	SecondaryBucket string
+	SecondaryRegion string
+	AccessLogFile   string
+	AccessLogFormat string
+	// UploadConcurrency and UploadPartSize tune multipart S3 uploads; zero
+	// keeps the service defaults.
+	UploadConcurrency int
+	UploadPartSize    int64
+	// MultipartMaxMemory is how much of a multipart upload form is held in
+	// memory before file parts spill to disk; zero keeps the default.
+	MultipartMaxMemory int64
+	HTTPSOnlyURLs      bool
+	MaskErrors         bool
+	// ServiceName and ServiceVersion identify the service in the User-Agent
+	// of its AWS requests.
+	ServiceName    string
+	ServiceVersion string
+	// HTTPMaxIdleConns, HTTPMaxIdleConnsPerHost, HTTPIdleConnTimeout and
+	// HTTPResponseHeaderTimeout tune the transport shared by the S3 and
+	// DynamoDB clients.
+	HTTPMaxIdleConns          int
+	HTTPMaxIdleConnsPerHost   int
+	HTTPIdleConnTimeout       time.Duration
+	HTTPResponseHeaderTimeout time.Duration
+	// RecordUploader stores the client IP and User-Agent of uploads;
+	// TrustedProxies are the CIDRs whose X-Forwarded-For is believed.
+	RecordUploader bool
+	TrustedProxies []netip.Prefix
+}
+
+func loadConfig() (config, error) {
+	cfg := config{
+		Region:          getEnv("AWS_REGION", "us-east-1"),
+		Endpoint:        getEnv("AWS_ENDPOINT", "http://localstack:4566"),
+		Bucket:          getEnv("S3_BUCKET", "file-storage-bucket"),
+		Table:           getEnv("DYNAMODB_TABLE", "file-storage-table"),
+		ListenAddr:      getEnv("LISTEN_ADDR", ":8080"),
+		SecondaryBucket: os.Getenv("S3_SECONDARY_BUCKET"),
+		SecondaryRegion: os.Getenv("S3_SECONDARY_REGION"),
+		AccessLogFile:   os.Getenv("ACCESS_LOG_FILE"),
+		AccessLogFormat: os.Getenv("ACCESS_LOG_FORMAT"),
+		ServiceName:     getEnv("SERVICE_NAME", "aws-examples"),
+		ServiceVersion:  getEnv("SERVICE_VERSION", "dev"),
+	}
+
+	var err error
+	// Path-style addressing is required for LocalStack and most custom endpoints.
+	if cfg.S3PathStyle, err = getEnvBool("S3_FORCE_PATH_STYLE", cfg.Endpoint != ""); err != nil {
+		return config{}, err
+	}
+	if cfg.S3UseAccelerate, err = getEnvBool("S3_USE_ACCELERATE", false); err != nil {
+		return config{}, err
+	}
+	if cfg.HTTPSOnlyURLs, err = getEnvBool("HTTPS_ONLY_URLS", false); err != nil {
+		return config{}, err
+	}
+	// Error details are shown by default only against a custom endpoint such
+	// as LocalStack, i.e. in development.
+	if cfg.MaskErrors, err = getEnvBool("MASK_ERRORS", cfg.Endpoint == ""); err != nil {
+		return config{}, err
+	}
+	if cfg.UploadConcurrency, err = getEnvInt("S3_UPLOAD_CONCURRENCY", 0); err != nil {
+		return config{}, err
+	}
+	partSize, err := getEnvInt("S3_UPLOAD_PART_SIZE", 0)
+	if err != nil {
+		return config{}, err
+	}
+	cfg.UploadPartSize = int64(partSize)
+	multipartMaxMemory, err := getEnvInt("MULTIPART_MAX_MEMORY", 0)
+	if err != nil {
+		return config{}, err
+	}
+	cfg.MultipartMaxMemory = int64(multipartMaxMemory)
+	if cfg.HTTPMaxIdleConns, err = getEnvInt("HTTP_MAX_IDLE_CONNS", 100); err != nil {
+		return config{}, err
+	}
+	if cfg.HTTPMaxIdleConnsPerHost, err = getEnvInt("HTTP_MAX_IDLE_CONNS_PER_HOST", 100); err != nil {
+		return config{}, err
+	}
+	if cfg.HTTPIdleConnTimeout, err = getEnvDuration("HTTP_IDLE_CONN_TIMEOUT", 90*time.Second); err != nil {
+		return config{}, err
+	}
+	if cfg.HTTPResponseHeaderTimeout, err = getEnvDuration("HTTP_RESPONSE_HEADER_TIMEOUT", 0); err != nil {
+		return config{}, err
+	}
+	if cfg.RecordUploader, err = getEnvBool("RECORD_UPLOADER", false); err != nil {
+		return config{}, err
+	}
+	for _, cidr := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return config{}, errors.New("TRUSTED_PROXIES: " + err.Error())
+		}
+		cfg.TrustedProxies = append(cfg.TrustedProxies, prefix)
+	}
+	return cfg, cfg.validate()
+}
+
+func (c config) validate() error {
+	if (c.SecondaryBucket == "") != (c.SecondaryRegion == "") {
+		return errors.New("S3_SECONDARY_BUCKET and S3_SECONDARY_REGION must be set together")
+	}
+	if c.S3UseAccelerate {
+		// Transfer Acceleration only exists on real S3 with virtual-hosted
+		// addressing; LocalStack and other custom endpoints don't support it.
+		if c.Endpoint != "" {
+			return errors.New("S3_USE_ACCELERATE cannot be combined with a custom AWS_ENDPOINT")
+		}
+		if c.S3PathStyle {
+			return errors.New("S3_USE_ACCELERATE cannot be combined with S3_FORCE_PATH_STYLE")
+		}
+	}
+	if c.HTTPMaxIdleConns < 0 || c.HTTPMaxIdleConnsPerHost < 0 || c.HTTPIdleConnTimeout < 0 || c.HTTPResponseHeaderTimeout < 0 {
+		return errors.New("HTTP transport settings must not be negative")
+	}
+	return nil
+}
+
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
+
+func getEnvBool(key string, fallback bool) (bool, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New(key + ": " + err.Error())
+	}
+	return b, nil
+}
+
+func getEnvInt(key string, fallback int) (int, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.New(key + ": " + err.Error())
+	}
+	return n, nil
+}
+
+func getEnvDuration(key string, fallback time.Duration) (time.Duration, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, errors.New(key + ": " + err.Error())
+	}
+	return d, nil
+}
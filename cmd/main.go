@@ -2,38 +2,141 @@ package main
 
 import (
 	"aws-examples/internal/app"
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"io"
 	"log"
+	"net/http"
+	"os"
+	"strings"
 )
 
 func main() {
+	// Without a subcommand the binary serves, as it always has.
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		usage()
+		return
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := cmd.run(cfg, args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newHTTPClient returns the client shared by the AWS clients. Go's default of
+// 2 idle connections per host makes concurrent uploads to S3 reconnect
+// constantly, so the pool is sized for many parallel requests.
+func newHTTPClient(cfg config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = cfg.HTTPMaxIdleConns
+	transport.MaxIdleConnsPerHost = cfg.HTTPMaxIdleConnsPerHost
+	transport.IdleConnTimeout = cfg.HTTPIdleConnTimeout
+	transport.ResponseHeaderTimeout = cfg.HTTPResponseHeaderTimeout
+	return &http.Client{Transport: transport}
+}
+
+// newService builds the Service from cfg. The returned closer releases
+// resources such as the access log file.
+func newService(cfg config) (*app.Service, io.Closer, error) {
+	httpClient := newHTTPClient(cfg)
+	s3Config := &aws.Config{
+		Region:           aws.String(cfg.Region),
+		S3ForcePathStyle: aws.Bool(cfg.S3PathStyle), // Required for LocalStack
+		S3UseAccelerate:  aws.Bool(cfg.S3UseAccelerate),
+		HTTPClient:       httpClient,
+	}
+	dbConfig := &aws.Config{
+		Region:     aws.String(cfg.Region),
+		HTTPClient: httpClient,
+	}
+	if cfg.Endpoint != "" {
+		s3Config.Endpoint = aws.String(cfg.Endpoint) // LocalStack endpoint
+		dbConfig.Endpoint = aws.String(cfg.Endpoint)
+	}
 
-	sess := session.Must(session.NewSession(&aws.Config{
-		Region:           aws.String("us-east-1"),              // Matches your LocalStack AWS_REGION
-		Endpoint:         aws.String("http://localstack:4566"), // LocalStack endpoint
-		S3ForcePathStyle: aws.Bool(true),                       // Required for LocalStack
-	}))
+	sess := session.Must(session.NewSession(s3Config))
 	fileStorage := s3.New(sess)
 
-	sess2 := session.Must(session.NewSession(&aws.Config{
-		Region:   aws.String("us-east-1"),              // Matches your LocalStack AWS_REGION
-		Endpoint: aws.String("http://localstack:4566"), // LocalStack endpoint
-	}))
+	sess2 := session.Must(session.NewSession(dbConfig))
 	db := dynamodb.New(sess2)
 
-	// CreateFile the service
-	service := app.NewService(
+	opts := []app.Option{
+		app.WithServiceIdentity(cfg.ServiceName, cfg.ServiceVersion),
+		app.WithErrorMasking(cfg.MaskErrors),
+	}
+	var closer io.Closer = nopCloser{}
+
+	if cfg.SecondaryBucket != "" {
+		secondaryConfig := s3Config.Copy(&aws.Config{Region: aws.String(cfg.SecondaryRegion)})
+		secondary := s3.New(session.Must(session.NewSession(secondaryConfig)))
+		opts = append(opts, app.WithSecondaryStorage(secondary, cfg.SecondaryBucket))
+	}
+
+	if cfg.HTTPSOnlyURLs {
+		opts = append(opts, app.WithHTTPSOnlyURLs(true))
+	}
+	if cfg.UploadConcurrency != 0 {
+		opts = append(opts, app.WithUploadConcurrency(cfg.UploadConcurrency))
+	}
+	if cfg.UploadPartSize != 0 {
+		opts = append(opts, app.WithUploadPartSize(cfg.UploadPartSize))
+	}
+	if cfg.MultipartMaxMemory != 0 {
+		opts = append(opts, app.WithMultipartMaxMemory(cfg.MultipartMaxMemory))
+	}
+	if cfg.RecordUploader {
+		opts = append(opts, app.WithUploaderInfo(cfg.TrustedProxies...))
+	}
+
+	// ACCESS_LOG_FILE enables access logging: "-" for stdout or a file path.
+	if path := cfg.AccessLogFile; path != "" {
+		out := os.Stdout
+		if path != "-" {
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+			if err != nil {
+				return nil, nil, err
+			}
+			closer = f
+			out = f
+		}
+		format := app.AccessLogCommon
+		if cfg.AccessLogFormat == "json" {
+			format = app.AccessLogJSON
+		}
+		opts = append(opts, app.WithAccessLog(out, format))
+	}
+
+	service, err := app.NewService(
 		fileStorage,
-		"file-storage-bucket",
+		cfg.Bucket,
 		db,
-		"file-storage-table",
+		cfg.Table,
+		opts...,
 	)
-
-	// Run the service
-	if err := service.Run(":8080"); err != nil {
-		log.Fatal(err)
+	if err != nil {
+		closer.Close()
+		return nil, nil, err
 	}
+	return service, closer, nil
 }
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,30 @@
+package app
+
+import "net/http"
+
+// isAdmin reports whether the caller of r may use the admin routes: its
+// principal is on the admin allow-list, or the admin function accepts the
+// request. Anonymous callers are never admins.
+func (s *Service) isAdmin(r *http.Request) bool {
+	if s.adminFunc != nil && s.adminFunc(r) {
+		return true
+	}
+	principal := s.principal(r)
+	if principal == "" {
+		return false
+	}
+	_, ok := s.admins[principal]
+	return ok
+}
+
+// requireAdmin rejects callers that aren't admins with 403. With no admins
+// configured nobody is one, so admin routes are closed by default.
+func (s *Service) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.isAdmin(r) {
+			s.writeJSONError(w, r, http.StatusForbidden, "forbidden", "this operation requires an administrator")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,100 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+const anonymousPrincipal = "anonymous"
+
+// AuditRecord describes one destructive operation: who did what, and when.
+type AuditRecord struct {
+	ID        string `json:"id" dynamodbav:"ID"`
+	Action    string `json:"action" dynamodbav:"Action"`
+	Principal string `json:"principal" dynamodbav:"Principal"`
+	FileID    string `json:"file_id" dynamodbav:"FileID"`
+	Hash      string `json:"hash" dynamodbav:"Hash"`
+	Key       string `json:"key" dynamodbav:"Key"`
+	RequestID string `json:"request_id" dynamodbav:"RequestID"`
+	Time      string `json:"time" dynamodbav:"Time"`
+}
+
+// AuditSink persists audit records in addition to the structured log.
+type AuditSink interface {
+	RecordAudit(ctx context.Context, record AuditRecord) error
+}
+
+// DynamoDBAuditSink stores audit records in a table keyed by ID.
+type DynamoDBAuditSink struct {
+	db        *dynamodb.DynamoDB
+	tableName string
+}
+
+func NewDynamoDBAuditSink(db *dynamodb.DynamoDB, tableName string) *DynamoDBAuditSink {
+	return &DynamoDBAuditSink{db: db, tableName: tableName}
+}
+
+func (a *DynamoDBAuditSink) RecordAudit(ctx context.Context, record AuditRecord) error {
+	item, err := dynamodbattribute.MarshalMap(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit record: %w", err)
+	}
+	_, err = a.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(a.tableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save audit record: %w", err)
+	}
+	return nil
+}
+
+// principal returns the caller identity reported by the configured
+// PrincipalFunc, or an empty string when there is none.
+func (s *Service) principal(r *http.Request) string {
+	if s.principalFunc == nil {
+		return ""
+	}
+	return s.principalFunc(r)
+}
+
+// audit logs a successful destructive action and forwards it to the audit
+// sink, if any. Sink failures are logged but never fail the request, since the
+// action itself has already happened.
+func (s *Service) audit(r *http.Request, action string, metadata *FileMetadata) {
+	principal := s.principal(r)
+	if principal == "" {
+		principal = anonymousPrincipal
+	}
+	record := AuditRecord{
+		ID:        s.idGenerator.NewID(),
+		Action:    action,
+		Principal: principal,
+		FileID:    metadata.ID,
+		Hash:      metadata.Hash,
+		Key:       objectKey(metadata),
+		RequestID: RequestIDFromContext(r.Context()),
+		Time:      s.now().UTC().Format(time.RFC3339),
+	}
+
+	s.logger.Info("audit",
+		"action", record.Action,
+		"principal", record.Principal,
+		"file_id", record.FileID,
+		"hash", record.Hash,
+		"key", record.Key,
+		"request_id", record.RequestID,
+	)
+	if s.auditSink == nil {
+		return
+	}
+	if err := s.auditSink.RecordAudit(r.Context(), record); err != nil {
+		s.logger.Error("failed to record audit", "action", action, "file_id", metadata.ID, "error", err)
+	}
+}
@@ -0,0 +1,70 @@
+package app
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recordingAuditSink struct {
+	records []AuditRecord
+}
+
+func (a *recordingAuditSink) RecordAudit(_ context.Context, record AuditRecord) error {
+	a.records = append(a.records, record)
+	return nil
+}
+
+func TestRestoreFileIsAudited(t *testing.T) {
+	fake := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if target := r.Header.Get("X-Amz-Target"); !strings.HasSuffix(target, ".UpdateItem") {
+			t.Errorf("unexpected call %s %s", target, r.URL)
+		}
+		body, _ := io.ReadAll(r.Body)
+		if !strings.Contains(string(body), "REMOVE #deleted") {
+			t.Errorf("update %s doesn't clear the deletion", body)
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		io.WriteString(w, `{"Attributes":{"ID":{"S":"file-1"},"Hash":{"S":"h"},"Extension":{"S":".jpg"},`+
+			`"CreatedAt":{"S":"2024-11-27T12:00:00Z"},"UpdatedAt":{"S":"2024-11-27T12:00:00Z"}}}`)
+	})
+	sink := &recordingAuditSink{}
+	s := newTestService(t, fake, WithSoftDelete(true), WithAdminFunc(func(*http.Request) bool { return true }),
+		WithAuditSink(sink),
+		WithIDGenerator(IDGeneratorFunc(func() string { return "audit-1" })),
+		WithClock(ClockFunc(func() time.Time { return time.Date(2024, 11, 28, 9, 0, 0, 0, time.UTC) })))
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/file/file-1/restore", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	if len(sink.records) != 1 {
+		t.Fatalf("%d audit records, want 1", len(sink.records))
+	}
+	want := AuditRecord{ID: "audit-1", Action: "restore", Principal: anonymousPrincipal, FileID: "file-1", Hash: "h",
+		Key: "file-1.jpg", Time: "2024-11-28T09:00:00Z"}
+	got := sink.records[0]
+	got.RequestID = ""
+	if got != want {
+		t.Errorf("audit record = %+v, want %+v", got, want)
+	}
+}
+
+func TestRestoreFileNotDeleted(t *testing.T) {
+	fake := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"__type":"com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException","message":"failed"}`)
+	})
+	s := newTestService(t, fake, WithSoftDelete(true), WithAdminFunc(func(*http.Request) bool { return true }))
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/file/file-1/restore", nil))
+	if w.Code != http.StatusNotFound || errorCode(t, w) != "not_found" {
+		t.Errorf("got %d %s, want 404 not_found", w.Code, w.Body)
+	}
+}
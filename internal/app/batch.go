@@ -0,0 +1,339 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultMultipartMaxMemory is how much of a multipart form is held in
+	// memory before file parts are spooled to temporary files, as with
+	// http.Request.FormFile.
+	defaultMultipartMaxMemory = 32 << 20
+	defaultBatchConcurrency   = 4
+)
+
+// Batch kinds, as reported by the debug stats.
+const (
+	batchUpload = "upload"
+	batchDelete = "delete"
+)
+
+// batchStats accumulates the sizes and durations of the batches of one kind.
+type batchStats struct {
+	requests atomic.Int64
+	items    atomic.Int64
+	maxItems atomic.Int64
+	totalUS  atomic.Int64
+	maxUS    atomic.Int64
+}
+
+// BatchStats summarizes the batches of one kind since the service started.
+type BatchStats struct {
+	Requests      int64   `json:"requests"`
+	Items         int64   `json:"items"`
+	MaxItems      int64   `json:"max_items"`
+	AvgDurationMS float64 `json:"avg_duration_ms"`
+	MaxDurationMS float64 `json:"max_duration_ms"`
+}
+
+func newBatchStats() map[string]*batchStats {
+	return map[string]*batchStats{batchUpload: new(batchStats), batchDelete: new(batchStats)}
+}
+
+func (b *batchStats) record(items int, duration time.Duration) {
+	b.requests.Add(1)
+	b.items.Add(int64(items))
+	storeMax(&b.maxItems, int64(items))
+	b.totalUS.Add(duration.Microseconds())
+	storeMax(&b.maxUS, duration.Microseconds())
+}
+
+func (b *batchStats) snapshot() BatchStats {
+	stats := BatchStats{
+		Requests:      b.requests.Load(),
+		Items:         b.items.Load(),
+		MaxItems:      b.maxItems.Load(),
+		MaxDurationMS: float64(b.maxUS.Load()) / 1000,
+	}
+	if stats.Requests > 0 {
+		stats.AvgDurationMS = float64(b.totalUS.Load()) / 1000 / float64(stats.Requests)
+	}
+	return stats
+}
+
+func storeMax(v *atomic.Int64, n int64) {
+	for {
+		current := v.Load()
+		if n <= current || v.CompareAndSwap(current, n) {
+			return
+		}
+	}
+}
+
+// forEachBatchItem calls process for every item index, running up to the
+// configured batch concurrency at once, and returns when all calls have.
+// Once ctx is done, because the request deadline passed or the client went
+// away, no more items are started and skipped is called for each of the
+// rest with the context error.
+func (s *Service) forEachBatchItem(ctx context.Context, n int, process func(i int), skipped func(i int, err error)) {
+	slots := make(chan struct{}, s.batchConcurrency)
+	var wg sync.WaitGroup
+	for i := range n {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if err := ctx.Err(); err != nil {
+			skipped(i, err)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			process(i)
+		}()
+	}
+	wg.Wait()
+}
+
+// recordBatch records the size and duration of a batch that started at start.
+func (s *Service) recordBatch(ctx context.Context, kind string, items int, start time.Time) {
+	duration := time.Since(start)
+	s.batchStats[kind].record(items, duration)
+	s.logger.Debug("batch processed", "kind", kind, "items", items, "concurrency", s.batchConcurrency,
+		"duration_ms", float64(duration.Microseconds())/1000, "request_id", RequestIDFromContext(ctx))
+}
+
+// batchClaim is the first file of a batch with a given content, which later
+// files with the same content wait for instead of storing it again.
+type batchClaim struct {
+	index int
+	done  chan struct{}
+	// stored is set before done is closed if the file was stored.
+	stored bool
+	// repeats are the files that reused the claim's result.
+	repeats []int
+}
+
+// BatchFileResult describes the outcome for one file of a batch upload, in the
+// same order as the files were sent. Deduplicated is true when the file was
+// not stored again, either because an identical file already existed or
+// because it repeats an earlier file of the same batch; in both cases the
+// metadata (and ID) of the stored file is returned.
+type BatchFileResult struct {
+	Filename     string            `json:"filename"`
+	Metadata     *FileMetadata     `json:"metadata,omitempty"`
+	PresignedURL string            `json:"presigned_url,omitempty"`
+	URLs         map[string]string `json:"urls,omitempty"`
+	Deduplicated bool              `json:"deduplicated"`
+	Error        string            `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+	Results []BatchFileResult `json:"results"`
+}
+
+func (s *Service) CreateFiles(w http.ResponseWriter, r *http.Request) {
+	if err := s.checkStorageCeiling(r.Context()); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if err := parseMultipartForm(r, s.multipartMaxMemory); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	fileHeaders := r.MultipartForm.File["file"]
+	if r.MultipartForm.Value["file"] != nil {
+		// Parts without a filename are taken for plain fields, which would
+		// silently drop them from the batch.
+		s.writeJSONError(w, r, http.StatusBadRequest, "missing_filename", "every file part must have a filename")
+		return
+	}
+	if len(fileHeaders) == 0 {
+		s.writeJSONError(w, r, http.StatusBadRequest, "missing_file", "no files in request")
+		return
+	}
+
+	defer s.recordBatch(r.Context(), batchUpload, len(fileHeaders), time.Now())
+	results := make([]BatchFileResult, len(fileHeaders))
+	var mu sync.Mutex
+	claims := make(map[string]*batchClaim)
+	s.forEachBatchItem(r.Context(), len(fileHeaders), func(i int) {
+		results[i].Filename = fileHeaders[i].Filename
+		file, err := s.readBatchFile(r, fileHeaders[i])
+		if err != nil {
+			results[i].Error = s.itemError(r, err)
+			return
+		}
+
+		if s.batchDedup && s.dedup {
+			mu.Lock()
+			claim, ok := claims[file.hash]
+			if !ok {
+				claim = &batchClaim{index: i, done: make(chan struct{})}
+				claims[file.hash] = claim
+			}
+			mu.Unlock()
+			if ok {
+				// A file with this content is already being stored; reuse
+				// its result, or store this one if that failed.
+				<-claim.done
+				if claim.stored {
+					first := results[claim.index]
+					results[i].Metadata = first.Metadata
+					results[i].PresignedURL = first.PresignedURL
+					results[i].URLs = first.URLs
+					results[i].Deduplicated = true
+					mu.Lock()
+					claim.repeats = append(claim.repeats, i)
+					mu.Unlock()
+					return
+				}
+			} else {
+				defer close(claim.done)
+				defer func() { claim.stored = results[i].Error == "" }()
+			}
+		}
+
+		metadata, deduplicated, err := s.storeFile(r.Context(), file)
+		if err != nil {
+			results[i].Error = s.itemError(r, err)
+			return
+		}
+		metadata = s.visibleMetadata(r, metadata)
+		response, err := s.fileResponse(r.Context(), metadata, s.presignExpiry)
+		if err != nil {
+			results[i].Error = s.itemError(r, err)
+			return
+		}
+
+		results[i].Metadata = metadata
+		results[i].PresignedURL = response.PresignedURL
+		results[i].URLs = response.URLs
+		results[i].Deduplicated = deduplicated
+	}, func(i int, err error) {
+		results[i].Filename = fileHeaders[i].Filename
+		results[i].Error = s.itemError(r, err)
+	})
+
+	// Files are stored in whatever order the workers get to them, but a
+	// repeat is reported for the later file in input order.
+	for _, claim := range claims {
+		if len(claim.repeats) == 0 {
+			continue
+		}
+		first := min(claim.index, slices.Min(claim.repeats))
+		if first != claim.index {
+			results[first].Deduplicated, results[claim.index].Deduplicated = results[claim.index].Deduplicated, true
+		}
+	}
+
+	s.writeResponse(w, r, http.StatusOK, BatchResponse{Results: results})
+}
+
+func (s *Service) readBatchFile(r *http.Request, fileHeader *multipart.FileHeader) (*upload, error) {
+	file, err := fileHeader.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	filename, err := s.cleanFilename(fileHeader.Filename)
+	if err != nil {
+		return nil, err
+	}
+	ext, contentType, err := s.validateFile(file, filename)
+	if err != nil {
+		return nil, err
+	}
+	// Like "tags", the "content_type" field applies to every file.
+	if contentType, err = s.overrideContentType(contentType, r.FormValue("content_type")); err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkDimensions(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	// The "tags" field applies to every file of the batch.
+	tags, err := s.parseTags(r.FormValue("tags"))
+	if err != nil {
+		return nil, err
+	}
+	u := newUpload(s.owner(r), filename, ext, contentType, data)
+	u.tags = tags
+	s.recordUploader(r, u)
+	return u, nil
+}
+
+type BatchDeleteRequest struct {
+	IDs []string `json:"ids"`
+}
+
+type BatchDeleteResult struct {
+	ID      string `json:"id"`
+	Deleted bool   `json:"deleted"`
+	Error   string `json:"error,omitempty"`
+}
+
+type BatchDeleteResponse struct {
+	Results []BatchDeleteResult `json:"results"`
+}
+
+func (s *Service) DeleteFiles(w http.ResponseWriter, r *http.Request) {
+	var request BatchDeleteRequest
+	if err := s.decodeJSONBody(w, r, &request); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if len(request.IDs) == 0 {
+		s.writeJSONError(w, r, http.StatusBadRequest, "missing_ids", "ids must not be empty")
+		return
+	}
+
+	defer s.recordBatch(r.Context(), batchDelete, len(request.IDs), time.Now())
+	results := make([]BatchDeleteResult, len(request.IDs))
+	// An ID listed more than once is deleted once; its repeats get the
+	// not-found error a second sequential delete would have.
+	first := make(map[string]int, len(request.IDs))
+	for i, id := range request.IDs {
+		results[i].ID = id
+		if _, ok := first[id]; ok {
+			results[i].Error = "file not found"
+			continue
+		}
+		first[id] = i
+	}
+	s.forEachBatchItem(r.Context(), len(request.IDs), func(i int) {
+		if first[request.IDs[i]] != i {
+			return
+		}
+		if err := s.deleteFile(r, request.IDs[i]); err != nil {
+			results[i].Error = s.itemError(r, err)
+			return
+		}
+		results[i].Deleted = true
+	}, func(i int, err error) {
+		if first[request.IDs[i]] == i {
+			results[i].Error = s.itemError(r, err)
+		}
+	})
+
+	s.writeResponse(w, r, http.StatusOK, BatchDeleteResponse{Results: results})
+}
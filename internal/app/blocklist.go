@@ -0,0 +1,139 @@
+package app
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// HashBlocklist holds the SHA-256 content hashes that must never be stored.
+type HashBlocklist interface {
+	IsBlocked(ctx context.Context, hash string) (bool, error)
+	Block(ctx context.Context, hash, reason string) error
+}
+
+// MemoryBlocklist is a HashBlocklist kept in memory, e.g. loaded from a file
+// at startup. Hashes added at runtime are lost on restart.
+type MemoryBlocklist struct {
+	mu     sync.RWMutex
+	hashes map[string]bool
+}
+
+func NewMemoryBlocklist(hashes ...string) *MemoryBlocklist {
+	b := &MemoryBlocklist{hashes: make(map[string]bool, len(hashes))}
+	for _, hash := range hashes {
+		b.hashes[strings.ToLower(hash)] = true
+	}
+	return b
+}
+
+func (b *MemoryBlocklist) IsBlocked(_ context.Context, hash string) (bool, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.hashes[hash], nil
+}
+
+func (b *MemoryBlocklist) Block(_ context.Context, hash, _ string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.hashes[hash] = true
+	return nil
+}
+
+// blockedHash is an item of the DynamoDB blocklist table.
+type blockedHash struct {
+	Hash      string `dynamodbav:"Hash"`
+	Reason    string `dynamodbav:"Reason,omitempty"`
+	BlockedAt string `dynamodbav:"BlockedAt"`
+}
+
+// DynamoDBBlocklist stores blocked hashes in a table keyed by Hash, shared by
+// all instances.
+type DynamoDBBlocklist struct {
+	db        *dynamodb.DynamoDB
+	tableName string
+}
+
+func NewDynamoDBBlocklist(db *dynamodb.DynamoDB, tableName string) *DynamoDBBlocklist {
+	return &DynamoDBBlocklist{db: db, tableName: tableName}
+}
+
+func (b *DynamoDBBlocklist) IsBlocked(ctx context.Context, hash string) (bool, error) {
+	result, err := b.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(b.tableName),
+		Key:       map[string]*dynamodb.AttributeValue{"Hash": {S: aws.String(hash)}},
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to check blocklist: %w", err)
+	}
+	return result.Item != nil, nil
+}
+
+func (b *DynamoDBBlocklist) Block(ctx context.Context, hash, reason string) error {
+	item, err := dynamodbattribute.MarshalMap(blockedHash{
+		Hash:      hash,
+		Reason:    reason,
+		BlockedAt: time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal blocked hash: %w", err)
+	}
+	_, err = b.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(b.tableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save blocked hash: %w", err)
+	}
+	return nil
+}
+
+// checkBlocked fails with 451 if hash is on the blocklist.
+func (s *Service) checkBlocked(ctx context.Context, hash string) error {
+	if s.blocklist == nil {
+		return nil
+	}
+	blocked, err := s.blocklist.IsBlocked(ctx, hash)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		s.logger.Warn("blocked content rejected", "hash", hash, "request_id", RequestIDFromContext(ctx))
+		return newAPIError(http.StatusUnavailableForLegalReasons, "content_blocked", "this content cannot be stored")
+	}
+	return nil
+}
+
+type BlockHashRequest struct {
+	Hash   string `json:"hash"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// BlockHash adds a content hash to the blocklist. Files already stored with
+// that hash are not removed.
+func (s *Service) BlockHash(w http.ResponseWriter, r *http.Request) {
+	var request BlockHashRequest
+	if err := s.decodeJSONBody(w, r, &request); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	hash := strings.ToLower(request.Hash)
+	if b, err := hex.DecodeString(hash); err != nil || len(b) != 32 {
+		s.writeJSONError(w, r, http.StatusBadRequest, "invalid_hash", "hash must be a hex SHA-256 digest")
+		return
+	}
+	if err := s.blocklist.Block(r.Context(), hash, request.Reason); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	s.audit(r, "block", &FileMetadata{Hash: hash})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,111 @@
+package app
+
+import (
+	"image"
+	"math"
+	"strings"
+)
+
+const (
+	blurHashComponentsX = 4
+	blurHashComponentsY = 3
+	// blurHashSamples bounds the pixels sampled per axis; the result is a
+	// blurred placeholder, so a coarse grid is indistinguishable.
+	blurHashSamples = 32
+	base83Chars     = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+)
+
+// blurHash encodes img as a BlurHash (https://blurha.sh) with 4x3
+// components, computed from a downsampled grid of the image.
+func blurHash(img image.Image) string {
+	pixels, w, h := samplePixels(img, blurHashSamples)
+
+	var factors [blurHashComponentsX * blurHashComponentsY][3]float64
+	for j := 0; j < blurHashComponentsY; j++ {
+		for i := 0; i < blurHashComponentsX; i++ {
+			var r, g, b float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(w)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(h))
+					p := pixels[y*w+x]
+					r += basis * p[0]
+					g += basis * p[1]
+					b += basis * p[2]
+				}
+			}
+			scale := 2.0
+			if i == 0 && j == 0 {
+				scale = 1
+			}
+			scale /= float64(w * h)
+			factors[j*blurHashComponentsX+i] = [3]float64{r * scale, g * scale, b * scale}
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(encodeBase83((blurHashComponentsX-1)+(blurHashComponentsY-1)*9, 1))
+	dc, ac := factors[0], factors[1:]
+	maxAC := 0.0
+	for _, f := range ac {
+		maxAC = max(maxAC, math.Abs(f[0]), math.Abs(f[1]), math.Abs(f[2]))
+	}
+	quantisedMax := int(math.Max(0, math.Min(82, math.Floor(maxAC*166-0.5))))
+	maxValue := float64(quantisedMax+1) / 166
+	sb.WriteString(encodeBase83(quantisedMax, 1))
+	sb.WriteString(encodeBase83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+	for _, f := range ac {
+		q := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		sb.WriteString(encodeBase83(q(f[0])*19*19+q(f[1])*19+q(f[2]), 2))
+	}
+	return sb.String()
+}
+
+// samplePixels returns up to n x n evenly spaced pixels of img as linear RGB.
+func samplePixels(img image.Image, n int) ([][3]float64, int, int) {
+	b := img.Bounds()
+	w, h := min(b.Dx(), n), min(b.Dy(), n)
+	pixels := make([][3]float64, 0, w*h)
+	for y := 0; y < h; y++ {
+		py := b.Min.Y + y*b.Dy()/h
+		for x := 0; x < w; x++ {
+			px := b.Min.X + x*b.Dx()/w
+			r, g, bl, _ := img.At(px, py).RGBA()
+			pixels = append(pixels, [3]float64{
+				sRGBToLinear(r >> 8), sRGBToLinear(g >> 8), sRGBToLinear(bl >> 8),
+			})
+		}
+	}
+	return pixels, w, h
+}
+
+func sRGBToLinear(value uint32) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+func encodeBase83(value, length int) string {
+	buf := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		buf[i] = base83Chars[value%83]
+		value /= 83
+	}
+	return string(buf)
+}
@@ -0,0 +1,102 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	defaultCreatedAtIndex = "CreatedAtIndex"
+	// fileKind is the constant partition key of the CreatedAt index, putting
+	// every file in one partition sorted by CreatedAt.
+	fileKind = "file"
+)
+
+// ListFilesByDate returns the caller's files created in [from, to], queried
+// from the CreatedAt index rather than scanned. Both bounds are optional
+// RFC 3339 timestamps; ?order=desc returns the newest first.
+func (s *Service) ListFilesByDate(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	from, err := parseTimeParam(query.Get("from"), "0001-01-01T00:00:00Z")
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	to, err := parseTimeParam(query.Get("to"), "9999-12-31T23:59:59Z")
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if from > to {
+		s.writeJSONError(w, r, http.StatusBadRequest, "invalid_range", "from must not be after to")
+		return
+	}
+	ascending := true
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		ascending = false
+	default:
+		s.writeJSONError(w, r, http.StatusBadRequest, "invalid_order", "order must be asc or desc")
+		return
+	}
+	limit, err := pageSize(r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	startKey, err := decodePageToken(query.Get("next_token"))
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(s.dbFileTableName),
+		IndexName:              aws.String(s.createdAtIndex),
+		KeyConditionExpression: aws.String("#kind = :kind AND #created BETWEEN :from AND :to"),
+		ExpressionAttributeNames: map[string]*string{
+			"#kind":    aws.String("Kind"),
+			"#created": aws.String("CreatedAt"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":kind": {S: aws.String(fileKind)},
+			":from": {S: aws.String(from)},
+			":to":   {S: aws.String(to)},
+		},
+		ScanIndexForward:  aws.Bool(ascending),
+		Limit:             aws.Int64(limit),
+		ExclusiveStartKey: startKey,
+	}
+	input.FilterExpression = s.listFilter(r, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	result, err := s.db.QueryWithContext(r.Context(), input)
+	if err != nil {
+		s.writeError(w, r, fmt.Errorf("failed to query DynamoDB: %w", err))
+		return
+	}
+
+	response, err := s.listResponse(r, result.Items, result.LastEvaluatedKey, query.Get("with_urls") == "true")
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	s.setPageLinks(w, r, response.NextToken)
+	s.writeResponse(w, r, http.StatusOK, response)
+}
+
+// parseTimeParam normalizes an RFC 3339 query parameter to the UTC form
+// CreatedAt is stored in, so that string comparison matches time order.
+func parseTimeParam(value, fallback string) (string, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", newAPIError(http.StatusBadRequest, "invalid_time", fmt.Sprintf("%q is not an RFC 3339 timestamp", value))
+	}
+	return t.UTC().Format(time.RFC3339), nil
+}
@@ -0,0 +1,74 @@
+package app
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// metadataCache is a size-bounded LRU of file metadata with a maximum age.
+type metadataCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type metadataCacheEntry struct {
+	metadata FileMetadata
+	storedAt time.Time
+}
+
+func newMetadataCache(size int, ttl time.Duration) *metadataCache {
+	return &metadataCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *metadataCache) put(metadata FileMetadata) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := metadataCacheEntry{metadata: metadata, storedAt: time.Now()}
+	if elem, ok := c.entries[metadata.ID]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[metadata.ID] = c.order.PushFront(entry)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(metadataCacheEntry).metadata.ID)
+	}
+}
+
+func (c *metadataCache) get(id string) (*FileMetadata, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(metadataCacheEntry)
+	if time.Since(entry.storedAt) > c.ttl {
+		c.order.Remove(elem)
+		delete(c.entries, id)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	metadata := entry.metadata
+	return &metadata, true
+}
+
+func (c *metadataCache) remove(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[id]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, id)
+	}
+}
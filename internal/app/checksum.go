@@ -0,0 +1,47 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/gorilla/mux"
+)
+
+// ChecksumResponse lets clients verify downloaded bytes. Hash is the hex
+// SHA-256 of the content computed at upload and always matches the bytes. ETag
+// is the MD5 of the content only for single-part uploads; for multipart
+// uploads it is derived from the part MD5s and has a "-<parts>" suffix, so it
+// cannot be compared with a digest of the whole file. ChecksumSHA256 is the
+// base64 checksum S3 stored, present when the object was uploaded with a
+// checksum algorithm.
+type ChecksumResponse struct {
+	ID             string `json:"id"`
+	Hash           string `json:"hash"`
+	ETag           string `json:"etag,omitempty"`
+	ChecksumSHA256 string `json:"checksum_sha256,omitempty"`
+}
+
+func (s *Service) GetFileChecksum(w http.ResponseWriter, r *http.Request) {
+	metadata, err := s.loadFile(r, mux.Vars(r)["id"])
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	head, _, err := s.headObject(r.Context(), objectKey(metadata))
+	if err != nil {
+		if isNotFoundError(err) {
+			s.writeJSONError(w, r, http.StatusNotFound, "object_missing", "file object not found in storage")
+			return
+		}
+		s.writeError(w, r, err)
+		return
+	}
+
+	s.writeResponse(w, r, http.StatusOK, ChecksumResponse{
+		ID:             metadata.ID,
+		Hash:           metadata.Hash,
+		ETag:           aws.StringValue(head.ETag),
+		ChecksumSHA256: aws.StringValue(head.ChecksumSHA256),
+	})
+}
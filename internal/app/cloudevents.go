@@ -0,0 +1,67 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// EventFormat is how EncodeFileEvent encodes file events.
+type EventFormat string
+
+const (
+	// EventFormatRaw encodes the file metadata as it is.
+	EventFormatRaw EventFormat = "raw"
+	// EventFormatCloudEvents wraps the metadata in a CloudEvents 1.0 event
+	// in the structured JSON format.
+	EventFormatCloudEvents EventFormat = "cloudevents"
+)
+
+const cloudEventsContentType = "application/cloudevents+json"
+
+func (f EventFormat) validate() error {
+	switch f {
+	case EventFormatRaw, EventFormatCloudEvents:
+		return nil
+	}
+	return fmt.Errorf("unknown event format %q", f)
+}
+
+// CloudEvent is a CloudEvents 1.0 event in the structured JSON format.
+type CloudEvent struct {
+	SpecVersion     string       `json:"specversion"`
+	Type            string       `json:"type"`
+	Source          string       `json:"source"`
+	ID              string       `json:"id"`
+	Time            string       `json:"time"`
+	Subject         string       `json:"subject,omitempty"`
+	DataContentType string       `json:"datacontenttype"`
+	Data            FileMetadata `json:"data"`
+}
+
+// EncodeFileEvent encodes an event of eventType about a file, such as
+// FileEventStored, in the format set with WithEventFormat, and returns it with
+// its content type. It is what the publishers set with WithEventPublishers
+// are sent. The uploader's IP and User-Agent are left out: events are not
+// owner or admin reads.
+//
+// A CloudEvent gets its ID from the service's IDGenerator and its time from
+// its Clock, the file ID as subject and the metadata as data.
+func (s *Service) EncodeFileEvent(eventType string, metadata FileMetadata) ([]byte, string, error) {
+	metadata.UploaderIP, metadata.UploaderUserAgent = "", ""
+	if s.eventFormat == EventFormatRaw {
+		body, err := json.Marshal(metadata)
+		return body, "application/json", err
+	}
+	body, err := json.Marshal(CloudEvent{
+		SpecVersion:     "1.0",
+		Type:            eventType,
+		Source:          s.eventSource,
+		ID:              s.idGenerator.NewID(),
+		Time:            s.now().Format(time.RFC3339Nano),
+		Subject:         metadata.ID,
+		DataContentType: "application/json",
+		Data:            metadata,
+	})
+	return body, cloudEventsContentType, err
+}
@@ -0,0 +1,66 @@
+package app
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestEncodeFileEvent(t *testing.T) {
+	metadata := FileMetadata{ID: "file-1", Hash: "a3e8", Extension: ".jpg", UploaderIP: "192.0.2.1", UploaderUserAgent: "curl"}
+	clock := ClockFunc(func() time.Time { return time.Date(2024, 11, 27, 12, 0, 0, 0, time.FixedZone("", 3600)) })
+
+	s := &Service{eventFormat: EventFormatRaw, idGenerator: IDGeneratorFunc(func() string { return "event-1" }), clock: clock}
+	body, contentType, err := s.EncodeFileEvent("com.example.file.stored", metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw FileMetadata
+	if err := json.Unmarshal(body, &raw); err != nil || raw.ID != "file-1" || contentType != "application/json" {
+		t.Errorf("raw event = %s (%s), %v", body, contentType, err)
+	}
+	if raw.UploaderIP != "" || raw.UploaderUserAgent != "" {
+		t.Errorf("raw event carries the uploader: %s", body)
+	}
+
+	s.eventFormat, s.eventSource = EventFormatCloudEvents, "/files/eu-1"
+	body, contentType, err = s.EncodeFileEvent("com.example.file.stored", metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "application/cloudevents+json" {
+		t.Errorf("content type = %q", contentType)
+	}
+	var event map[string]any
+	if err := json.Unmarshal(body, &event); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"specversion":     "1.0",
+		"type":            "com.example.file.stored",
+		"source":          "/files/eu-1",
+		"id":              "event-1",
+		"time":            "2024-11-27T11:00:00Z",
+		"subject":         "file-1",
+		"datacontenttype": "application/json",
+	}
+	for field, value := range want {
+		if event[field] != value {
+			t.Errorf("%s = %v, want %q", field, event[field], value)
+		}
+	}
+	if data, _ := event["data"].(map[string]any); data["id"] != "file-1" {
+		t.Errorf("data = %v", event["data"])
+	}
+}
+
+func TestEventFormatValidate(t *testing.T) {
+	for _, format := range []EventFormat{EventFormatRaw, EventFormatCloudEvents} {
+		if err := format.validate(); err != nil {
+			t.Errorf("%q: %v", format, err)
+		}
+	}
+	if err := EventFormat("xml").validate(); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
@@ -0,0 +1,31 @@
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+)
+
+// precompressedTypes are never gzipped: their formats are already compressed
+// and would only grow.
+var precompressedTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+func (s *Service) shouldCompress(contentType string) bool {
+	return s.compressTypes[contentType] && !precompressedTypes[contentType]
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
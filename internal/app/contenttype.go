@@ -0,0 +1,76 @@
+package app
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+)
+
+// ContentTypeOverrides maps a sniffed content type to the types clients may
+// store instead, e.g. {"image/jpeg": {"image/pjpeg"}}. An override must be
+// listed under the type the content was sniffed as, so a client can refine
+// the type but never relabel one format as another.
+type ContentTypeOverrides map[string][]string
+
+func (o ContentTypeOverrides) validate() error {
+	for sniffed, overrides := range o {
+		if _, err := normalizeContentType(sniffed); err != nil {
+			return fmt.Errorf("invalid sniffed content type %q: %w", sniffed, err)
+		}
+		for _, override := range overrides {
+			if _, err := normalizeContentType(override); err != nil {
+				return fmt.Errorf("invalid content type override %q: %w", override, err)
+			}
+		}
+	}
+	return nil
+}
+
+// allowed reports whether contentType may be stored for content sniffed as
+// sniffed, or for any sniffed type if sniffed is empty. Types are compared
+// in canonical form (lowercase, normalized parameters).
+func (o ContentTypeOverrides) allowed(sniffed, contentType string) bool {
+	for key, overrides := range o {
+		if key, _ := normalizeContentType(key); sniffed != "" && key != sniffed {
+			continue
+		}
+		for _, override := range overrides {
+			if override, _ := normalizeContentType(override); override == contentType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func normalizeContentType(contentType string) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", err
+	}
+	return mime.FormatMediaType(mediaType, params), nil
+}
+
+// overrideContentType returns the content type to store for content sniffed
+// as sniffed: requested, if the client asked for an allowed override, or
+// sniffed otherwise. Without overrides configured the request is ignored.
+// Overrides that aren't listed at all are rejected with 400, and overrides
+// listed only for other sniffed types with 415.
+func (s *Service) overrideContentType(sniffed, requested string) (string, error) {
+	if requested == "" || s.contentTypeOverrides == nil {
+		return sniffed, nil
+	}
+	contentType, err := normalizeContentType(requested)
+	if err != nil {
+		return "", newAPIError(http.StatusBadRequest, "invalid_content_type", fmt.Sprintf("invalid content type: %v", err))
+	}
+	if contentType == sniffed || s.contentTypeOverrides.allowed(sniffed, contentType) {
+		return contentType, nil
+	}
+	if s.contentTypeOverrides.allowed("", contentType) {
+		return "", newAPIError(http.StatusUnsupportedMediaType, "content_type_mismatch",
+			fmt.Sprintf("content type %s does not match the uploaded %s content", contentType, sniffed))
+	}
+	return "", newAPIError(http.StatusBadRequest, "invalid_content_type",
+		fmt.Sprintf("content type %s is not an allowed override", contentType))
+}
@@ -0,0 +1,118 @@
+package app
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultRedactedHeaders are the headers WithDebugCapture redacts when no
+// others are given.
+var DefaultRedactedHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"X-Api-Key",
+	"X-Amz-Security-Token",
+	"X-Forwarded-For",
+}
+
+// debugCapture records failed upload requests, with a bounded prefix of their
+// body, to help diagnose malformed client uploads.
+type debugCapture struct {
+	mu           sync.Mutex
+	out          io.Writer
+	maxBodyBytes int
+	// redacted holds canonical header names whose values are never captured.
+	redacted map[string]bool
+}
+
+func newDebugCapture(out io.Writer, maxBodyBytes int, redactHeaders []string) *debugCapture {
+	if len(redactHeaders) == 0 {
+		redactHeaders = DefaultRedactedHeaders
+	}
+	redacted := make(map[string]bool, len(redactHeaders))
+	for _, name := range redactHeaders {
+		redacted[http.CanonicalHeaderKey(name)] = true
+	}
+	return &debugCapture{out: out, maxBodyBytes: maxBodyBytes, redacted: redacted}
+}
+
+type debugRecord struct {
+	Time       string              `json:"time"`
+	RequestID  string              `json:"request_id"`
+	Method     string              `json:"method"`
+	URI        string              `json:"uri"`
+	RemoteAddr string              `json:"remote_addr"`
+	Status     int                 `json:"status"`
+	Headers    map[string][]string `json:"headers"`
+	BodyRead   int64               `json:"body_read"`
+	// BodyPrefix is the first bytes of the body; encoding/json writes it
+	// base64 encoded.
+	BodyPrefix []byte `json:"body_prefix"`
+}
+
+// prefixReader passes reads through while keeping the first max bytes.
+type prefixReader struct {
+	io.ReadCloser
+	prefix []byte
+	max    int
+	read   int64
+}
+
+func (p *prefixReader) Read(b []byte) (int, error) {
+	n, err := p.ReadCloser.Read(b)
+	p.read += int64(n)
+	if room := p.max - len(p.prefix); room > 0 {
+		p.prefix = append(p.prefix, b[:min(n, room)]...)
+	}
+	return n, err
+}
+
+func (d *debugCapture) middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body := &prefixReader{ReadCloser: r.Body, max: d.maxBodyBytes}
+		r.Body = body
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r)
+		if rec.status < http.StatusBadRequest {
+			return
+		}
+
+		headers := make(map[string][]string, len(r.Header))
+		for name, values := range r.Header {
+			if d.redacted[name] {
+				values = []string{"[REDACTED]"}
+			}
+			headers[name] = values
+		}
+		line, err := json.Marshal(debugRecord{
+			Time:       time.Now().UTC().Format(time.RFC3339Nano),
+			RequestID:  RequestIDFromContext(r.Context()),
+			Method:     r.Method,
+			URI:        r.URL.RequestURI(),
+			RemoteAddr: r.RemoteAddr,
+			Status:     rec.status,
+			Headers:    headers,
+			BodyRead:   body.read,
+			BodyPrefix: body.prefix,
+		})
+		if err != nil {
+			return
+		}
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.out.Write(append(line, '\n'))
+	}
+}
+
+// captureFailures wraps an upload handler with the debug capture, if enabled.
+func (s *Service) captureFailures(next http.HandlerFunc) http.HandlerFunc {
+	if s.debugCapture == nil {
+		return next
+	}
+	return s.debugCapture.middleware(next)
+}
@@ -0,0 +1,52 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func captureHeaders(t *testing.T, d *debugCapture, out *bytes.Buffer) map[string][]string {
+	t.Helper()
+	handler := d.middleware(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	r := httptest.NewRequest(http.MethodPost, "/file", strings.NewReader("body"))
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set("X-Forwarded-For", "203.0.113.7")
+	r.Header.Set("X-Custom-Token", "token")
+	handler(httptest.NewRecorder(), r)
+
+	var rec debugRecord
+	if err := json.Unmarshal(out.Bytes(), &rec); err != nil {
+		t.Fatalf("capture %q: %v", out.String(), err)
+	}
+	return rec.Headers
+}
+
+func TestDebugCaptureRedactsDefaultHeaders(t *testing.T) {
+	var out bytes.Buffer
+	headers := captureHeaders(t, newDebugCapture(&out, 16, nil), &out)
+	for _, name := range []string{"Authorization", "X-Forwarded-For"} {
+		if got := headers[name]; len(got) != 1 || got[0] != "[REDACTED]" {
+			t.Errorf("%s = %v, want redacted", name, got)
+		}
+	}
+	if got := headers["X-Custom-Token"]; len(got) != 1 || got[0] != "token" {
+		t.Errorf("X-Custom-Token = %v, want captured", got)
+	}
+}
+
+func TestDebugCaptureRedactsConfiguredHeaders(t *testing.T) {
+	var out bytes.Buffer
+	headers := captureHeaders(t, newDebugCapture(&out, 16, []string{"x-custom-token"}), &out)
+	if got := headers["X-Custom-Token"]; len(got) != 1 || got[0] != "[REDACTED]" {
+		t.Errorf("X-Custom-Token = %v, want redacted", got)
+	}
+	if got := headers["Authorization"]; len(got) != 1 || got[0] != "Bearer secret" {
+		t.Errorf("Authorization = %v, want captured when not configured", got)
+	}
+}
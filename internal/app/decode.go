@@ -0,0 +1,32 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+const maxJSONBodySize = 1 << 20
+
+// decodeJSONBody decodes a JSON request body into v. In strict mode unknown
+// fields are rejected so that client typos surface as 400 instead of being
+// silently ignored.
+func (s *Service) decodeJSONBody(w http.ResponseWriter, r *http.Request, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBodySize))
+	if s.strictJSON {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(v); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return newAPIError(http.StatusRequestEntityTooLarge, "body_too_large", "request body is too large")
+		}
+		// The decoder reports unknown fields as `json: unknown field "name"`.
+		return newAPIError(http.StatusBadRequest, "invalid_json", err.Error())
+	}
+	if err := dec.Decode(&struct{}{}); err != io.EOF {
+		return newAPIError(http.StatusBadRequest, "invalid_json", "request body must contain a single JSON value")
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package app
+
+import (
+	"sync"
+	"time"
+)
+
+// dedupWindow remembers the files stored in the last window per owner and
+// hash. Hash lookups go through an eventually consistent index, so an
+// upload repeated right after the first one finished can miss it; the
+// window catches such double submits on this instance.
+type dedupWindow struct {
+	mu      sync.Mutex
+	window  time.Duration
+	entries map[string]dedupWindowEntry
+	// keys maps file IDs to their entry key, for eviction on delete.
+	keys map[string]string
+}
+
+type dedupWindowEntry struct {
+	metadata FileMetadata
+	expires  time.Time
+}
+
+func newDedupWindow(window time.Duration) *dedupWindow {
+	return &dedupWindow{
+		window:  window,
+		entries: make(map[string]dedupWindowEntry),
+		keys:    make(map[string]string),
+	}
+}
+
+func dedupWindowKey(ownerID, hash string) string {
+	return ownerID + "\x00" + hash
+}
+
+func (d *dedupWindow) get(ownerID, hash string) (FileMetadata, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	entry, ok := d.entries[dedupWindowKey(ownerID, hash)]
+	if !ok || time.Now().After(entry.expires) {
+		return FileMetadata{}, false
+	}
+	return entry.metadata, true
+}
+
+// put records metadata and drops expired entries, which keeps the map at
+// about the number of uploads per window.
+func (d *dedupWindow) put(ownerID string, metadata FileMetadata) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	for key, entry := range d.entries {
+		if now.After(entry.expires) {
+			delete(d.entries, key)
+			delete(d.keys, entry.metadata.ID)
+		}
+	}
+	key := dedupWindowKey(ownerID, metadata.Hash)
+	d.entries[key] = dedupWindowEntry{metadata: metadata, expires: now.Add(d.window)}
+	d.keys[metadata.ID] = key
+}
+
+func (d *dedupWindow) remove(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if key, ok := d.keys[id]; ok {
+		delete(d.entries, key)
+		delete(d.keys, id)
+	}
+}
@@ -0,0 +1,61 @@
+package app
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// DimensionBounds limits the pixel dimensions of uploaded images. Zero
+// leaves a bound unchecked.
+type DimensionBounds struct {
+	MinWidth, MaxWidth   int
+	MinHeight, MaxHeight int
+}
+
+func (b DimensionBounds) enabled() bool {
+	return b != DimensionBounds{}
+}
+
+func (b DimensionBounds) validate() error {
+	if b.MinWidth < 0 || b.MaxWidth < 0 || b.MinHeight < 0 || b.MaxHeight < 0 {
+		return fmt.Errorf("image dimension bounds must not be negative")
+	}
+	if (b.MaxWidth > 0 && b.MinWidth > b.MaxWidth) || (b.MaxHeight > 0 && b.MinHeight > b.MaxHeight) {
+		return fmt.Errorf("minimum image dimensions must not exceed the maximums")
+	}
+	return nil
+}
+
+// checkDimensions reads the image header from r, without decoding the
+// pixels, and rejects the upload with 422 if its size is out of bounds.
+func (s *Service) checkDimensions(r io.Reader) error {
+	if !s.dimensionBounds.enabled() {
+		return nil
+	}
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return newAPIError(http.StatusUnsupportedMediaType, "unsupported_media_type", "failed to read image dimensions")
+	}
+	b := s.dimensionBounds
+	var problems []string
+	if b.MinWidth > 0 && config.Width < b.MinWidth {
+		problems = append(problems, fmt.Sprintf("width must be at least %d", b.MinWidth))
+	}
+	if b.MaxWidth > 0 && config.Width > b.MaxWidth {
+		problems = append(problems, fmt.Sprintf("width must be at most %d", b.MaxWidth))
+	}
+	if b.MinHeight > 0 && config.Height < b.MinHeight {
+		problems = append(problems, fmt.Sprintf("height must be at least %d", b.MinHeight))
+	}
+	if b.MaxHeight > 0 && config.Height > b.MaxHeight {
+		problems = append(problems, fmt.Sprintf("height must be at most %d", b.MaxHeight))
+	}
+	if len(problems) > 0 {
+		return newAPIError(http.StatusUnprocessableEntity, "image_dimensions_out_of_range",
+			fmt.Sprintf("image is %dx%d pixels; %s", config.Width, config.Height, strings.Join(problems, ", ")))
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package app
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const diskCacheSuffix = ".cache"
+
+// diskCache keeps downloaded objects in a local directory, evicting the least
+// recently used ones beyond maxBytes in total. The index lives in memory, so
+// files left by a previous process are removed on start.
+type diskCache struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// diskCacheEntry holds what is needed to serve an object without S3.
+type diskCacheEntry struct {
+	key                string
+	size               int64
+	contentType        string
+	contentEncoding    string
+	contentDisposition string
+	etag               string
+	lastModified       time.Time
+}
+
+func newDiskCache(dir string, maxBytes int64) *diskCache {
+	return &diskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (c *diskCache) init() error {
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	stale, err := filepath.Glob(filepath.Join(c.dir, "*"+diskCacheSuffix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, path := range stale {
+		os.Remove(path)
+	}
+	return nil
+}
+
+func (c *diskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+diskCacheSuffix)
+}
+
+// open returns the cached object for key. The file stays readable after a
+// concurrent eviction removes it, since it is already open.
+func (c *diskCache) open(key string) (*os.File, diskCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, diskCacheEntry{}, false
+	}
+	f, err := os.Open(c.path(key))
+	if err != nil {
+		c.removeLocked(elem)
+		return nil, diskCacheEntry{}, false
+	}
+	c.order.MoveToFront(elem)
+	return f, elem.Value.(diskCacheEntry), true
+}
+
+// writer returns a writer that stages an object for the cache. Calling
+// commit after the whole body was written adds it; abort discards it.
+func (c *diskCache) writer(entry diskCacheEntry) (*diskCacheWriter, error) {
+	if entry.size > c.maxBytes {
+		return nil, fmt.Errorf("object of %d bytes exceeds the cache size", entry.size)
+	}
+	f, err := os.CreateTemp(c.dir, "*"+diskCacheSuffix+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &diskCacheWriter{cache: c, file: f, entry: entry}, nil
+}
+
+// diskCacheWriter stages an object in the cache as it is downloaded. It
+// never fails a write: the cache is optional, so a full or broken cache disk
+// must not cut off the download it is teed from. The first write error
+// abandons the staged file instead, and commit reports it.
+type diskCacheWriter struct {
+	cache   *diskCache
+	file    *os.File
+	entry   diskCacheEntry
+	written int64
+	err     error
+}
+
+func (w *diskCacheWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return len(p), nil
+	}
+	n, err := w.file.Write(p)
+	w.written += int64(n)
+	if err != nil {
+		w.err = err
+		w.abort()
+	}
+	return len(p), nil
+}
+
+func (w *diskCacheWriter) abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+func (w *diskCacheWriter) commit() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.written != w.entry.size {
+		w.abort()
+		return fmt.Errorf("cached %d of %d bytes", w.written, w.entry.size)
+	}
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	c := w.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.Rename(w.file.Name(), c.path(w.entry.key)); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	if elem, ok := c.entries[w.entry.key]; ok {
+		c.size -= elem.Value.(diskCacheEntry).size
+		c.order.Remove(elem)
+	}
+	c.entries[w.entry.key] = c.order.PushFront(w.entry)
+	c.size += w.entry.size
+	for c.size > c.maxBytes {
+		c.removeLocked(c.order.Back())
+	}
+	return nil
+}
+
+func (c *diskCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.removeLocked(elem)
+	}
+}
+
+func (c *diskCache) removeLocked(elem *list.Element) {
+	entry := elem.Value.(diskCacheEntry)
+	c.order.Remove(elem)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+	os.Remove(c.path(entry.key))
+}
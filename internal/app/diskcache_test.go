@@ -0,0 +1,69 @@
+package app
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiskCacheWriterErrorDoesNotFailDownload(t *testing.T) {
+	c := newDiskCache(t.TempDir(), 1<<20)
+	if err := c.init(); err != nil {
+		t.Fatal(err)
+	}
+	body := strings.Repeat("x", 4096)
+	staged, err := c.writer(diskCacheEntry{key: "a.jpg", size: int64(len(body))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A closed file fails every write, like a full or read-only disk.
+	staged.file.Close()
+
+	var client bytes.Buffer
+	if _, err := io.Copy(&client, io.TeeReader(strings.NewReader(body), staged)); err != nil {
+		t.Fatalf("download failed because of the cache: %v", err)
+	}
+	if client.String() != body {
+		t.Errorf("client got %d bytes, want %d", client.Len(), len(body))
+	}
+	if err := staged.commit(); err == nil {
+		t.Error("commit succeeded after a failed write")
+	}
+	if _, _, ok := c.open("a.jpg"); ok {
+		t.Error("object cached after a failed write")
+	}
+	left, _ := filepath.Glob(filepath.Join(c.dir, "*"))
+	if len(left) != 0 {
+		t.Errorf("staged files left behind: %v", left)
+	}
+}
+
+func TestDiskCacheWriterCommit(t *testing.T) {
+	c := newDiskCache(t.TempDir(), 1<<20)
+	if err := c.init(); err != nil {
+		t.Fatal(err)
+	}
+	staged, err := c.writer(diskCacheEntry{key: "a.jpg", size: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	staged.Write([]byte("hello"))
+	if err := staged.commit(); err != nil {
+		t.Fatal(err)
+	}
+	f, _, ok := c.open("a.jpg")
+	if !ok {
+		t.Fatal("object not cached")
+	}
+	defer f.Close()
+	data, _ := io.ReadAll(f)
+	if string(data) != "hello" {
+		t.Errorf("cached %q, want %q", data, "hello")
+	}
+	if _, err := os.Stat(c.path("a.jpg")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,57 @@
+package app
+
+import (
+	"strings"
+	"unicode"
+)
+
+// contentDisposition builds a Content-Disposition header value that is safe
+// for any filename. CR, LF and other control characters are dropped so the
+// name can't inject headers; an ASCII-only filename parameter is provided for
+// old clients and the exact name is carried RFC 5987 encoded in filename*.
+func contentDisposition(dispositionType, filename string) string {
+	filename = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, filename)
+	if filename == "" {
+		return dispositionType
+	}
+
+	var fallback strings.Builder
+	for _, r := range filename {
+		if r > unicode.MaxASCII || r == '"' || r == '\\' {
+			fallback.WriteByte('_')
+			continue
+		}
+		fallback.WriteRune(r)
+	}
+	return dispositionType + `; filename="` + fallback.String() + `"; filename*=UTF-8''` + encodeRFC5987(filename)
+}
+
+// encodeRFC5987 percent-encodes every byte outside the RFC 5987 attr-char set.
+func encodeRFC5987(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isAttrChar(c) {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0x0f])
+	}
+	return b.String()
+}
+
+func isAttrChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+}
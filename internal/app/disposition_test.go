@@ -0,0 +1,57 @@
+package app
+
+import (
+	"mime"
+	"strings"
+	"testing"
+	"unicode"
+)
+
+func TestContentDispositionAdversarialNames(t *testing.T) {
+	tests := []struct {
+		filename string
+		want     string
+	}{
+		{"photo.jpg", "photo.jpg"},
+		{"a\r\nSet-Cookie: x=1.jpg", "aSet-Cookie: x=1.jpg"},
+		{`quote".jpg`, `quote".jpg`},
+		{`back\slash.jpg`, `back\slash.jpg`},
+		{`"; filename="evil.exe`, `"; filename="evil.exe`},
+		{"semi;colon=1.jpg", "semi;colon=1.jpg"},
+		{"100% real%20.jpg", "100% real%20.jpg"},
+		{"naïve café.jpg", "naïve café.jpg"},
+		{"📷 שלום.jpg", "📷 שלום.jpg"},
+		{"tab\there\x00\x7f.jpg", "tabhere.jpg"},
+	}
+	for _, tt := range tests {
+		header := contentDisposition("attachment", tt.filename)
+		if strings.ContainsFunc(header, func(r rune) bool { return unicode.IsControl(r) || r > unicode.MaxASCII }) {
+			t.Errorf("contentDisposition(%q) = %q, contains control or non-ASCII characters", tt.filename, header)
+		}
+		dispositionType, params, err := mime.ParseMediaType(header)
+		if err != nil {
+			t.Errorf("contentDisposition(%q) = %q, unparseable: %v", tt.filename, header, err)
+			continue
+		}
+		if dispositionType != "attachment" || params["filename"] != tt.want {
+			t.Errorf("contentDisposition(%q) = %q, parsed as %s %q; want attachment %q",
+				tt.filename, header, dispositionType, params["filename"], tt.want)
+		}
+	}
+}
+
+func TestContentDispositionFallback(t *testing.T) {
+	tests := []struct {
+		filename, want string
+	}{
+		{"photo.jpg", `inline; filename="photo.jpg"; filename*=UTF-8''photo.jpg`},
+		{`a"b\c.jpg`, `inline; filename="a_b_c.jpg"; filename*=UTF-8''a%22b%5Cc.jpg`},
+		{"café.jpg", `inline; filename="caf_.jpg"; filename*=UTF-8''caf%C3%A9.jpg`},
+		{"\r\n", "inline"},
+	}
+	for _, tt := range tests {
+		if got := contentDisposition("inline", tt.filename); got != tt.want {
+			t.Errorf("contentDisposition(%q) = %q, want %q", tt.filename, got, tt.want)
+		}
+	}
+}
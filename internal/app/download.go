@@ -0,0 +1,199 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gorilla/mux"
+)
+
+// DownloadFile streams the file's object through the service. If-None-Match
+// and If-Modified-Since are passed on to S3, so a client or CDN holding a
+// current copy gets 304 without the body being transferred, and so is
+// If-Match, which fails with 412. The object's ETag is strong, so
+// If-None-Match uses weak and If-Match strong comparison against it. With a
+// disk cache, hot objects are served from local disk instead. Downloads
+// from S3 may be limited per file.
+func (s *Service) DownloadFile(w http.ResponseWriter, r *http.Request) {
+	metadata, err := s.loadFileForDownload(r, mux.Vars(r)["id"])
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	key := objectKey(metadata)
+	if s.diskCache != nil {
+		if f, entry, ok := s.diskCache.open(key); ok {
+			defer f.Close()
+			s.setDownloadCacheControl(w, metadata)
+			serveCachedObject(w, r, f, entry)
+			return
+		}
+	}
+	if s.downloadLimiter != nil {
+		if !s.downloadLimiter.acquire(key) {
+			s.writeJSONError(w, r, http.StatusServiceUnavailable, "download_capacity_exceeded",
+				"too many downloads of this file in progress, retry later")
+			return
+		}
+		defer s.downloadLimiter.release(key)
+	}
+	store := s.readStore(r.Context(), key)
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(key),
+	}
+	if im := r.Header.Get("If-Match"); im != "" {
+		tags := strongOnlyETags(im)
+		if tags == "" {
+			s.writeJSONError(w, r, http.StatusPreconditionFailed, "precondition_failed", "If-Match lists no strong entity tag")
+			return
+		}
+		input.IfMatch = aws.String(tags)
+	}
+	if etag := r.Header.Get("If-None-Match"); etag != "" {
+		input.IfNoneMatch = aws.String(strongETags(etag))
+	} else if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		// If-Modified-Since is ignored when If-None-Match is present (RFC 9110).
+		input.IfModifiedSince = aws.Time(since)
+	}
+
+	object, err := store.client.GetObjectWithContext(r.Context(), input)
+	if err != nil {
+		switch {
+		case isNotModifiedError(err):
+			// The SDK drops the 304's headers; a single matching tag is
+			// necessarily the current one.
+			if etag := r.Header.Get("If-None-Match"); etag != "" && !strings.Contains(etag, ",") && etag != "*" {
+				w.Header().Set("ETag", strongETags(etag))
+			}
+			s.setDownloadCacheControl(w, metadata)
+			w.WriteHeader(http.StatusNotModified)
+		case isPreconditionFailedError(err):
+			s.writeJSONError(w, r, http.StatusPreconditionFailed, "precondition_failed", "the file does not match If-Match")
+		case isNotFoundError(err):
+			s.writeJSONError(w, r, http.StatusNotFound, "object_missing", "file object not found in storage")
+		default:
+			s.writeError(w, r, err)
+		}
+		return
+	}
+	defer object.Body.Close()
+
+	header := w.Header()
+	header.Set("Content-Type", aws.StringValue(object.ContentType))
+	setHeader(header, "Content-Encoding", object.ContentEncoding)
+	setHeader(header, "Content-Disposition", object.ContentDisposition)
+	setHeader(header, "ETag", object.ETag)
+	if object.LastModified != nil {
+		header.Set("Last-Modified", object.LastModified.UTC().Format(http.TimeFormat))
+	}
+	if object.ContentLength != nil {
+		header.Set("Content-Length", strconv.FormatInt(*object.ContentLength, 10))
+	}
+	s.setDownloadCacheControl(w, metadata)
+	w.WriteHeader(http.StatusOK)
+
+	var body io.Reader = object.Body
+	var staged *diskCacheWriter
+	if s.diskCache != nil && object.ContentLength != nil {
+		staged, err = s.diskCache.writer(diskCacheEntry{
+			key:                key,
+			size:               *object.ContentLength,
+			contentType:        aws.StringValue(object.ContentType),
+			contentEncoding:    aws.StringValue(object.ContentEncoding),
+			contentDisposition: aws.StringValue(object.ContentDisposition),
+			etag:               aws.StringValue(object.ETag),
+			lastModified:       aws.TimeValue(object.LastModified),
+		})
+		if err == nil {
+			body = io.TeeReader(object.Body, staged)
+		}
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		// The status is already sent; all that's left is to log it.
+		s.logger.Warn("download interrupted", "id", metadata.ID, "error", err)
+		if staged != nil {
+			staged.abort()
+		}
+		return
+	}
+	if staged != nil {
+		if err := staged.commit(); err != nil {
+			s.logger.Warn("failed to cache object", "key", key, "error", err)
+		}
+	}
+}
+
+// loadFileForDownload is loadFileForRead, except that a request carrying a
+// download token is authorized by the token instead of the caller's identity.
+// Both fall back to cached metadata when DynamoDB is unavailable.
+func (s *Service) loadFileForDownload(r *http.Request, id string) (*FileMetadata, error) {
+	withToken := s.downloadTokenKey != nil && r.URL.Query().Has("token")
+	if withToken {
+		if err := s.verifyDownloadToken(r, id); err != nil {
+			return nil, err
+		}
+	}
+	metadata, _, err := s.readFile(r, id, !withToken)
+	return metadata, err
+}
+
+// serveCachedObject serves an object from the disk cache. http.ServeContent
+// evaluates the conditional headers against the cached ETag and
+// Last-Modified, and supports range requests.
+func serveCachedObject(w http.ResponseWriter, r *http.Request, f io.ReadSeeker, entry diskCacheEntry) {
+	header := w.Header()
+	header.Set("Content-Type", entry.contentType)
+	if entry.contentEncoding != "" {
+		header.Set("Content-Encoding", entry.contentEncoding)
+	}
+	if entry.contentDisposition != "" {
+		header.Set("Content-Disposition", entry.contentDisposition)
+	}
+	if entry.etag != "" {
+		header.Set("ETag", entry.etag)
+	}
+	http.ServeContent(w, r, "", entry.lastModified, f)
+}
+
+// setDownloadCacheControl marks a successful download as immutable, when
+// enabled. A file's object never changes once stored, only the metadata
+// around it, so its bytes can be cached for as long as configured. Files
+// belonging to an owner are only cached privately.
+func (s *Service) setDownloadCacheControl(w http.ResponseWriter, metadata *FileMetadata) {
+	if s.immutableMaxAge <= 0 {
+		return
+	}
+	scope := "public"
+	if metadata.OwnerID != "" {
+		scope = "private"
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("%s, max-age=%d, immutable", scope, int64(s.immutableMaxAge/time.Second)))
+}
+
+func setHeader(header http.Header, name string, value *string) {
+	if v := aws.StringValue(value); v != "" {
+		header.Set(name, v)
+	}
+}
+
+func isPreconditionFailedError(err error) bool {
+	var reqErr awserr.RequestFailure
+	return errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusPreconditionFailed
+}
+
+// isNotModifiedError reports whether a conditional S3 read failed because
+// the client's copy is current. S3 answers with a bare 304.
+func isNotModifiedError(err error) bool {
+	var reqErr awserr.RequestFailure
+	return errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusNotModified
+}
@@ -0,0 +1,110 @@
+package app
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// notModifiedFake serves a file's metadata from DynamoDB and its object from
+// S3, answering 304 to any conditional GET. It records the conditional
+// headers S3 received.
+func notModifiedFake(t *testing.T, received *http.Header) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isDynamoDB(r) {
+			w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+			io.WriteString(w, `{"Item":{"ID":{"S":"abc"},"Hash":{"S":"h"},"Extension":{"S":".jpg"},`+
+				`"CreatedAt":{"S":"2026-01-01T00:00:00Z"},"UpdatedAt":{"S":"2026-01-01T00:00:00Z"}}}`)
+			return
+		}
+		if r.URL.Path != "/"+testBucket+"/abc.jpg" {
+			t.Errorf("S3 request for %s", r.URL.Path)
+		}
+		*received = r.Header.Clone()
+		if r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("ETag", `"etag1"`)
+		io.WriteString(w, "jpeg")
+	})
+}
+
+func TestDownloadFileNotModified(t *testing.T) {
+	since := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC).Format(http.TimeFormat)
+	tests := []struct {
+		name                         string
+		ifNoneMatch, ifModifiedSince string
+		wantStatus                   int
+		wantETag                     string
+		sentNoneMatch, sentSince     string
+	}{
+		{"strong tag", `"etag1"`, "", http.StatusNotModified, `"etag1"`, `"etag1"`, ""},
+		{"weak tag", `W/"etag1"`, "", http.StatusNotModified, `"etag1"`, `"etag1"`, ""},
+		{"several tags", `"old", W/"etag1"`, "", http.StatusNotModified, "", `"old", "etag1"`, ""},
+		{"if-modified-since", "", since, http.StatusNotModified, "", "", since},
+		{"if-none-match wins", `"etag1"`, since, http.StatusNotModified, `"etag1"`, `"etag1"`, ""},
+		{"unconditional", "", "", http.StatusOK, `"etag1"`, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received http.Header
+			s := newTestService(t, notModifiedFake(t, &received))
+			r := httptest.NewRequest(http.MethodGet, "/file/abc/download", nil)
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			if tt.ifModifiedSince != "" {
+				r.Header.Set("If-Modified-Since", tt.ifModifiedSince)
+			}
+			w := httptest.NewRecorder()
+			s.Handler().ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if got := w.Header().Get("ETag"); got != tt.wantETag {
+				t.Errorf("ETag = %q, want %q", got, tt.wantETag)
+			}
+			if tt.wantStatus == http.StatusNotModified && w.Body.Len() != 0 {
+				t.Errorf("304 has a body: %q", w.Body)
+			}
+			if got := received.Get("If-None-Match"); got != tt.sentNoneMatch {
+				t.Errorf("S3 got If-None-Match %q, want %q", got, tt.sentNoneMatch)
+			}
+			if got := received.Get("If-Modified-Since"); got != tt.sentSince {
+				t.Errorf("S3 got If-Modified-Since %q, want %q", got, tt.sentSince)
+			}
+		})
+	}
+}
+
+func TestDownloadWithTokenFallsBackToCachedMetadata(t *testing.T) {
+	fake := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isDynamoDB(r) {
+			w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, `{"__type":"com.amazonaws.dynamodb.v20120810#InternalServerError","message":"down"}`)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		io.WriteString(w, "jpeg")
+	})
+	s := newTestService(t, fake, WithDownloadTokens(make([]byte, 32)), WithDegradedReads(10, time.Hour))
+	s.metadataCache.put(FileMetadata{ID: "abc", Extension: ".jpg", OwnerID: "someone-else"})
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, s.downloadURL("abc", time.Minute), nil))
+	if w.Code != http.StatusOK || w.Body.String() != "jpeg" {
+		t.Fatalf("token download = %d %q, want the cached file", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file/abc/download", nil))
+	if w.Code == http.StatusOK {
+		t.Errorf("download without token of another owner's file = %d", w.Code)
+	}
+}
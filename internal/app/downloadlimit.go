@@ -0,0 +1,37 @@
+package app
+
+import "sync"
+
+// downloadLimiter bounds the concurrent downloads streamed from S3 per
+// object key, so that one hot file can't take all of the egress.
+type downloadLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	active map[string]int
+}
+
+func newDownloadLimiter(limit int) *downloadLimiter {
+	return &downloadLimiter{limit: limit, active: make(map[string]int)}
+}
+
+// acquire reserves a download slot for key, reporting false if all of them
+// are taken. Every successful acquire must be followed by a release.
+func (l *downloadLimiter) acquire(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[key] >= l.limit {
+		return false
+	}
+	l.active[key]++
+	return true
+}
+
+func (l *downloadLimiter) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[key] <= 1 {
+		delete(l.active, key)
+		return
+	}
+	l.active[key]--
+}
@@ -0,0 +1,48 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// minDownloadTokenKeyLength is the shortest accepted HMAC key; shorter keys
+// make the tokens guessable offline.
+const minDownloadTokenKeyLength = 32
+
+// downloadTokenSignature signs the file ID and expiry of a download link.
+func (s *Service) downloadTokenSignature(id string, expires int64) string {
+	mac := hmac.New(sha256.New, s.downloadTokenKey)
+	mac.Write([]byte(id + "\n" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// downloadURL returns a link to the download endpoint that works without
+// authentication until expiry, like a presigned URL but independent of the
+// storage backend.
+func (s *Service) downloadURL(id string, expiry time.Duration) string {
+	expires := time.Now().Add(expiry).Unix()
+	query := url.Values{
+		"exp":   {strconv.FormatInt(expires, 10)},
+		"token": {s.downloadTokenSignature(id, expires)},
+	}
+	return "/file/" + url.PathEscape(id) + "/download?" + query.Encode()
+}
+
+// verifyDownloadToken checks the token and exp query parameters of r for
+// file id.
+func (s *Service) verifyDownloadToken(r *http.Request, id string) error {
+	query := r.URL.Query()
+	expires, err := strconv.ParseInt(query.Get("exp"), 10, 64)
+	if err != nil || !hmac.Equal([]byte(query.Get("token")), []byte(s.downloadTokenSignature(id, expires))) {
+		return newAPIError(http.StatusForbidden, "invalid_token", "the download token is invalid")
+	}
+	if time.Now().Unix() > expires {
+		return newAPIError(http.StatusForbidden, "token_expired", "the download token has expired")
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultUploadDrainTimeout = 30 * time.Second
+	// shutdownTimeout bounds how long Run waits for requests other than
+	// uploads, such as streaming downloads, once uploads are drained.
+	shutdownTimeout = 10 * time.Second
+)
+
+// uploadTracker keeps the cancel functions of in-flight uploads so shutdown
+// can wait for them and cancel those that don't finish in time.
+type uploadTracker struct {
+	mu       sync.Mutex
+	draining bool
+	next     uint64
+	active   map[uint64]context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// start registers an upload, or returns false once draining has begun.
+func (t *uploadTracker) start(cancel context.CancelFunc) (uint64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return 0, false
+	}
+	if t.active == nil {
+		t.active = make(map[uint64]context.CancelFunc)
+	}
+	t.next++
+	t.active[t.next] = cancel
+	t.wg.Add(1)
+	return t.next, true
+}
+
+func (t *uploadTracker) done(id uint64) {
+	t.mu.Lock()
+	delete(t.active, id)
+	t.mu.Unlock()
+	t.wg.Done()
+}
+
+func (t *uploadTracker) isDraining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+// trackUploads rejects uploads with 503 once the service is shutting down
+// and lets drainUploads cancel the ones in flight.
+func (s *Service) trackUploads(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		id, ok := s.uploads.start(cancel)
+		if !ok {
+			s.writeJSONError(w, r, http.StatusServiceUnavailable, "shutting_down", "the service is shutting down, retry later")
+			return
+		}
+		defer s.uploads.done(id)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// drainUploads stops accepting uploads and waits up to timeout for those in
+// flight, then cancels the rest. Cancelling aborts their S3 multipart
+// uploads, so no parts are left behind.
+func (s *Service) drainUploads(timeout time.Duration) {
+	s.uploads.mu.Lock()
+	s.uploads.draining = true
+	inFlight := len(s.uploads.active)
+	s.uploads.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.uploads.wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		s.logger.Info("uploads drained", "drained", inFlight, "cancelled", 0)
+		return
+	case <-timer.C:
+	}
+
+	s.uploads.mu.Lock()
+	cancelled := len(s.uploads.active)
+	for _, cancel := range s.uploads.active {
+		cancel()
+	}
+	s.uploads.mu.Unlock()
+	<-done
+	s.logger.Warn("uploads cancelled after drain timeout", "drained", inFlight-cancelled, "cancelled", cancelled, "timeout", timeout)
+}
@@ -0,0 +1,180 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const defaultRetryAfter = 5 * time.Second
+
+// apiError is an error carrying the HTTP status and machine-readable code it
+// should be reported with.
+type apiError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func newAPIError(status int, code, message string) *apiError {
+	return &apiError{Status: status, Code: code, Message: message}
+}
+
+type errorResponse struct {
+	Error errorDetail `json:"error"`
+}
+
+type errorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+const problemContentType = "application/problem+json"
+
+// problemDetails is an RFC 7807 error response. Type is a URN built from the
+// error code, so clients can match on it without a documentation site.
+type problemDetails struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail"`
+	Instance string `json:"instance"`
+}
+
+// writeJSONError is the single place error responses are written. Statuses
+// that ask the client to come back later always carry a Retry-After header.
+// With error masking, the message of a 5xx response, which may name buckets,
+// tables or AWS internals, is only logged; the client gets a generic message
+// with the request ID to quote instead.
+func (s *Service) writeJSONError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	message = s.publicMessage(r, status, code, message)
+	switch status {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		seconds := int(math.Ceil(s.retryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	}
+	w.Header().Add("Vary", "Accept")
+	if s.problemJSON || acceptsProblemJSON(r) {
+		w.Header().Set("Content-Type", problemContentType)
+		w.WriteHeader(status)
+		jsonSerializer{}.Encode(w, problemDetails{
+			Type:     "urn:problem-type:" + code,
+			Title:    http.StatusText(status),
+			Status:   status,
+			Detail:   message,
+			Instance: problemInstance(r),
+		})
+		return
+	}
+	w.Header().Set("Content-Type", jsonSerializer{}.ContentType())
+	w.WriteHeader(status)
+	jsonSerializer{}.Encode(w, errorResponse{Error: errorDetail{Code: code, Message: message}})
+}
+
+// publicMessage returns the message of an error reported with status, masked
+// if error masking is on and status is a 5xx.
+func (s *Service) publicMessage(r *http.Request, status int, code, message string) string {
+	if !s.maskErrors || status < 500 {
+		return message
+	}
+	id := RequestIDFromContext(r.Context())
+	s.logger.Error("request failed", "status", status, "code", code, "error", message, "request_id", id)
+	message = strings.ToLower(http.StatusText(status))
+	if id != "" {
+		message += " (request ID " + id + ")"
+	}
+	return message
+}
+
+func acceptsProblemJSON(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			mediaType, _, _ := strings.Cut(part, ";")
+			if strings.TrimSpace(mediaType) == problemContentType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// problemInstance identifies the failed request by its URI and request ID,
+// e.g. "/file/abc#req-0c1d...", which matches it to the server logs.
+func problemInstance(r *http.Request) string {
+	instance := r.URL.RequestURI()
+	if id := RequestIDFromContext(r.Context()); id != "" {
+		instance += "#req-" + id
+	}
+	return instance
+}
+
+// writeError reports err with the status of an *apiError, 503 for throttled
+// AWS calls (including S3 SlowDown that outlasted the retries) and uploads
+// cancelled at shutdown, 504 for calls cut off by a route timeout and 500 for
+// anything else.
+func (s *Service) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status, code, message := s.classifyError(err)
+	s.writeJSONError(w, r, status, code, message)
+}
+
+// classifyError returns the status, code and message writeError reports err
+// with.
+func (s *Service) classifyError(err error) (int, string, string) {
+	var apiErr *apiError
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr.Status, apiErr.Code, apiErr.Message
+	case isSlowDownError(err):
+		return http.StatusServiceUnavailable, "slow_down", "storage is limiting the request rate, retry later"
+	case isThrottleError(err):
+		return http.StatusServiceUnavailable, "throughput_exceeded", err.Error()
+	case isTimeoutError(err):
+		return http.StatusGatewayTimeout, "timeout", "the request took too long"
+	case errors.Is(err, context.Canceled) && s.uploads.isDraining():
+		return http.StatusServiceUnavailable, "shutting_down", "the upload was cancelled because the service is shutting down"
+	}
+	return http.StatusInternalServerError, "internal_error", err.Error()
+}
+
+// itemError is the message reported for err in one entry of a batch
+// response, which is itself a 200: the message writeError would send,
+// masked the same way.
+func (s *Service) itemError(r *http.Request, err error) string {
+	status, code, message := s.classifyError(err)
+	return s.publicMessage(r, status, code, message)
+}
+
+func isThrottleError(err error) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && request.IsErrorThrottle(awsErr)
+}
+
+// isNotFoundError reports whether an S3 call failed because the object does
+// not exist. HeadObject reports this as "NotFound" since it has no body.
+func isNotFoundError(err error) bool {
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return false
+	}
+	return awsErr.Code() == "NotFound" || awsErr.Code() == s3.ErrCodeNoSuchKey
+}
+
+// isConditionFailed reports whether a conditional DynamoDB write was
+// rejected because its condition didn't hold.
+func isConditionFailed(err error) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
@@ -0,0 +1,43 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestItemErrorMasksInternalErrors(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/files/batch/delete", nil)
+	r = r.WithContext(context.WithValue(r.Context(), requestIDKey, "req-1"))
+	internal := errors.New("AccessDenied: not authorized on table file-storage-table, request id 4KJ2")
+	client := newAPIError(http.StatusNotFound, "not_found", "file not found")
+
+	tests := []struct {
+		name  string
+		mask  bool
+		err   error
+		want  string
+		leaks bool
+	}{
+		{"masked internal", true, internal, "internal server error (request ID req-1)", false},
+		{"masked client error", true, client, "file not found", false},
+		{"unmasked internal", false, internal, internal.Error(), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{maskErrors: tt.mask, logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+			got := s.itemError(r, tt.err)
+			if got != tt.want {
+				t.Errorf("itemError = %q, want %q", got, tt.want)
+			}
+			if leaked := strings.Contains(got, "file-storage-table"); leaked != tt.leaks {
+				t.Errorf("table name leaked = %t, want %t", leaked, tt.leaks)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+)
+
+// metadataETag is the entity tag of a file's metadata responses. It is weak:
+// the responses also carry freshly signed URLs, so two of them are only
+// semantically equivalent, never byte-identical.
+func metadataETag(metadata *FileMetadata) string {
+	b, _ := json.Marshal(metadata)
+	sum := sha256.Sum256(b)
+	return `W/"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// etagMatches reports whether the If-Match or If-None-Match value header
+// lists current. Weak comparison (for If-None-Match on reads) ignores the
+// W/ prefix; strong comparison (for If-Match) never matches a weak tag, as
+// RFC 9110 requires.
+func etagMatches(header, current string, strong bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		switch {
+		case tag == "*":
+			return true
+		case strong:
+			if !isWeakETag(tag) && !isWeakETag(current) && tag == current {
+				return true
+			}
+		case strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(current, "W/"):
+			return true
+		}
+	}
+	return false
+}
+
+func isWeakETag(tag string) bool {
+	return strings.HasPrefix(tag, "W/")
+}
+
+// strongETags rewrites an If-None-Match value for S3, which only knows
+// strong tags: for weak comparison W/"x" is the same as "x".
+func strongETags(header string) string {
+	tags := strings.Split(header, ",")
+	for i, tag := range tags {
+		tags[i] = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+	}
+	return strings.Join(tags, ", ")
+}
+
+// strongOnlyETags drops the weak tags from an If-Match value, since they
+// can't match under strong comparison. An empty result means no tag can.
+func strongOnlyETags(header string) string {
+	var tags []string
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" && !isWeakETag(tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return strings.Join(tags, ", ")
+}
@@ -0,0 +1,62 @@
+package app
+
+import "testing"
+
+func TestETagMatches(t *testing.T) {
+	tests := []struct {
+		header, current string
+		weak, strong    bool
+	}{
+		{`"a"`, `"a"`, true, true},
+		{`W/"a"`, `"a"`, true, false},
+		{`"a"`, `W/"a"`, true, false},
+		{`W/"a"`, `W/"a"`, true, false},
+		{`"b"`, `"a"`, false, false},
+		{`W/"b"`, `W/"a"`, false, false},
+		{`"b", W/"a"`, `"a"`, true, false},
+		{`W/"b",  "a"`, `"a"`, true, true},
+		{`*`, `W/"a"`, true, true},
+		{`a`, `"a"`, false, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.header, tt.current, false); got != tt.weak {
+			t.Errorf("weak etagMatches(%q, %q) = %t, want %t", tt.header, tt.current, got, tt.weak)
+		}
+		if got := etagMatches(tt.header, tt.current, true); got != tt.strong {
+			t.Errorf("strong etagMatches(%q, %q) = %t, want %t", tt.header, tt.current, got, tt.strong)
+		}
+	}
+}
+
+func TestMetadataETagIsWeak(t *testing.T) {
+	a := metadataETag(&FileMetadata{ID: "a", Hash: "h"})
+	b := metadataETag(&FileMetadata{ID: "a", Hash: "h2"})
+	if !isWeakETag(a) {
+		t.Errorf("metadataETag = %s, want a weak tag", a)
+	}
+	if a == b {
+		t.Errorf("metadataETag is %s for different metadata", a)
+	}
+	if etagMatches(a, a, true) {
+		t.Errorf("metadata ETag %s matches itself under strong comparison", a)
+	}
+}
+
+func TestStrongETags(t *testing.T) {
+	tests := []struct {
+		header, noneMatch, match string
+	}{
+		{`"a"`, `"a"`, `"a"`},
+		{`W/"a"`, `"a"`, ``},
+		{`W/"a", "b" ,W/"c"`, `"a", "b", "c"`, `"b"`},
+		{`*`, `*`, `*`},
+	}
+	for _, tt := range tests {
+		if got := strongETags(tt.header); got != tt.noneMatch {
+			t.Errorf("strongETags(%q) = %q, want %q", tt.header, got, tt.noneMatch)
+		}
+		if got := strongOnlyETags(tt.header); got != tt.match {
+			t.Errorf("strongOnlyETags(%q) = %q, want %q", tt.header, got, tt.match)
+		}
+	}
+}
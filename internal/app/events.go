@@ -0,0 +1,89 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Events counted since start and logged at debug level, for judging how much
+// deduplication and the caches save and how often S3 pushes back.
+const (
+	eventUploadStored      = "upload_stored"
+	eventDedupExact        = "dedup_exact"
+	eventDedupNear         = "dedup_near"
+	eventDedupCoalesced    = "dedup_coalesced"
+	eventDedupWindow       = "dedup_window"
+	eventMetadataCacheHit  = "metadata_cache_hit"
+	eventMetadataCacheMiss = "metadata_cache_miss"
+	eventPresignCacheHit   = "presign_cache_hit"
+	eventPresignCacheMiss  = "presign_cache_miss"
+	eventS3SlowDown        = "s3_slow_down"
+	eventReconcileOrphan   = "reconcile_orphan_objects"
+	eventReconcileMissing  = "reconcile_missing_objects"
+)
+
+// hashPrefixLength is how much of a content hash events carry: enough to
+// group repeated content, not enough to be a useful identifier.
+const hashPrefixLength = 12
+
+type eventCounters struct {
+	since  time.Time
+	counts map[string]*atomic.Int64
+}
+
+func newEventCounters() *eventCounters {
+	c := &eventCounters{since: time.Now().UTC(), counts: make(map[string]*atomic.Int64)}
+	for _, name := range []string{
+		eventUploadStored, eventDedupExact, eventDedupNear, eventDedupCoalesced, eventDedupWindow,
+		eventMetadataCacheHit, eventMetadataCacheMiss, eventPresignCacheHit, eventPresignCacheMiss,
+		eventS3SlowDown, eventReconcileOrphan, eventReconcileMissing,
+	} {
+		c.counts[name] = new(atomic.Int64)
+	}
+	return c
+}
+
+// event counts an event and logs it with attrs at debug level.
+func (s *Service) event(ctx context.Context, name string, attrs ...any) {
+	s.events.counts[name].Add(1)
+	s.logger.Debug("event", append([]any{"event", name, "request_id", RequestIDFromContext(ctx)}, attrs...)...)
+}
+
+// uploadEvent is event with the attributes of an upload.
+func (s *Service) uploadEvent(ctx context.Context, name string, u *upload) {
+	s.event(ctx, name, "hash_prefix", u.hash[:min(len(u.hash), hashPrefixLength)], "size", u.size, "owner_id", u.ownerID)
+}
+
+type DebugStatsResponse struct {
+	Since  string           `json:"since"`
+	Events map[string]int64 `json:"events"`
+	// Gauges are current values, such as the depth of the metadata retry
+	// queue or the number of URLs being signed.
+	Gauges map[string]int64 `json:"gauges,omitempty"`
+	// Batches are the sizes and durations of batch uploads and deletes.
+	Batches map[string]BatchStats `json:"batches"`
+}
+
+// GetDebugStats returns the event counters since the service started.
+func (s *Service) GetDebugStats(w http.ResponseWriter, r *http.Request) {
+	response := DebugStatsResponse{Since: s.events.since.Format(time.RFC3339), Events: make(map[string]int64, len(s.events.counts))}
+	for name, count := range s.events.counts {
+		response.Events[name] = count.Load()
+	}
+	response.Batches = make(map[string]BatchStats, len(s.batchStats))
+	for kind, stats := range s.batchStats {
+		response.Batches[kind] = stats.snapshot()
+	}
+	if s.metadataRetries != nil || s.presignLimiter != nil {
+		response.Gauges = make(map[string]int64)
+	}
+	if s.metadataRetries != nil {
+		response.Gauges[gaugePendingMetadataWrites] = s.metadataRetries.pending.Load()
+	}
+	if s.presignLimiter != nil {
+		response.Gauges[gaugePresignsInFlight] = s.presignLimiter.inFlight.Load()
+	}
+	s.writeResponse(w, r, http.StatusOK, response)
+}
@@ -0,0 +1,227 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// maxImportLine bounds a single exported item when importing.
+const maxImportLine = 1 << 20
+
+// checkpointPrefix starts the comment lines an export writes after every
+// scan page. The token after it resumes the export from that point. A
+// complete export ends with exportEndMarker.
+const (
+	checkpointPrefix = "# checkpoint: "
+	exportEndMarker  = "# end\n"
+)
+
+// ExportOptions controls ExportMetadata.
+type ExportOptions struct {
+	// OwnerID limits the export to files of this owner and files without
+	// one, like listings. Empty exports the files of all owners.
+	OwnerID string
+	// IncludeDeleted exports soft-deleted files too, as a backup needs to.
+	IncludeDeleted bool
+	// RedactUploader removes the uploader's IP and User-Agent from files not
+	// owned by OwnerID.
+	RedactUploader bool
+	// StartToken resumes from a checkpoint of an earlier export.
+	StartToken string
+	// Flush, if set, is called after every checkpoint so that the output
+	// reaches the client while the export is still running.
+	Flush func() error
+}
+
+// ExportMetadata writes the items of the metadata table to w as JSON lines,
+// one plain JSON object per item with all of its attributes, followed after
+// every scan page by a "# checkpoint: <token>" line and at the end by
+// "# end". It returns the number of items written.
+func (s *Service) ExportMetadata(ctx context.Context, w io.Writer, opts ExportOptions) (int, error) {
+	startKey, err := decodePageToken(opts.StartToken)
+	if err != nil {
+		return 0, err
+	}
+	input := &dynamodb.ScanInput{
+		TableName:         aws.String(s.dbFileTableName),
+		ExclusiveStartKey: startKey,
+	}
+	var filters []string
+	names := map[string]*string{}
+	if !opts.IncludeDeleted {
+		filters = append(filters, "attribute_not_exists(#deleted)")
+		names["#deleted"] = aws.String("DeletedAt")
+	}
+	if opts.OwnerID != "" {
+		filters = append(filters, "(attribute_not_exists(#owner) OR #owner = :owner)")
+		names["#owner"] = aws.String("OwnerID")
+		input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{":owner": {S: aws.String(opts.OwnerID)}}
+	}
+	if len(filters) > 0 {
+		input.FilterExpression = aws.String(strings.Join(filters, " AND "))
+		input.ExpressionAttributeNames = names
+	}
+
+	enc := json.NewEncoder(w)
+	count := 0
+	var writeErr error
+	err = s.db.ScanPagesWithContext(ctx, input, func(page *dynamodb.ScanOutput, _ bool) bool {
+		for _, item := range page.Items {
+			var record map[string]interface{}
+			if err := dynamodbattribute.UnmarshalMap(item, &record); err != nil {
+				s.logger.Warn("skipping unreadable item", "error", err)
+				continue
+			}
+			if owner, _ := record["OwnerID"].(string); opts.RedactUploader && (owner == "" || owner != opts.OwnerID) {
+				delete(record, "UploaderIP")
+				delete(record, "UploaderUserAgent")
+			}
+			if writeErr = enc.Encode(record); writeErr != nil {
+				return false
+			}
+			count++
+		}
+		if len(page.LastEvaluatedKey) == 0 {
+			return true
+		}
+		var token string
+		if token, writeErr = encodePageToken(page.LastEvaluatedKey); writeErr != nil {
+			return false
+		}
+		if _, writeErr = io.WriteString(w, checkpointPrefix+token+"\n"); writeErr != nil {
+			return false
+		}
+		if opts.Flush != nil {
+			writeErr = opts.Flush()
+		}
+		return writeErr == nil
+	})
+	if err != nil {
+		return count, fmt.Errorf("failed to scan DynamoDB: %w", err)
+	}
+	if writeErr == nil {
+		_, writeErr = io.WriteString(w, exportEndMarker)
+	}
+	if writeErr != nil {
+		return count, fmt.Errorf("failed to write export: %w", writeErr)
+	}
+	return count, nil
+}
+
+// ExportFiles streams the caller's metadata in the ExportMetadata format,
+// gzip-compressed when the client accepts it. ?from=<checkpoint token>
+// resumes an interrupted export.
+func (s *Service) ExportFiles(w http.ResponseWriter, r *http.Request) {
+	startToken := r.URL.Query().Get("from")
+	if _, err := decodePageToken(startToken); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	var out io.Writer = w
+	flushers := []func() error{}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Add("Vary", "Accept-Encoding")
+	if acceptsGzip(r) {
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
+		flushers = append(flushers, gz.Flush)
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	flushers = append(flushers, func() error {
+		return http.NewResponseController(w).Flush()
+	})
+	w.WriteHeader(http.StatusOK)
+
+	count, err := s.ExportMetadata(r.Context(), out, ExportOptions{
+		OwnerID:        s.owner(r),
+		RedactUploader: !s.isAdmin(r),
+		StartToken:     startToken,
+		Flush: func() error {
+			for _, flush := range flushers {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		// The status is already sent. Without the end marker the client knows
+		// the export is incomplete and can resume from the last checkpoint.
+		s.logger.Warn("export interrupted", "items", count, "error", err)
+	}
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.EqualFold(strings.TrimSpace(coding), "gzip") && strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
+
+// ImportResult counts the outcome of ImportMetadata.
+type ImportResult struct {
+	Imported int
+	// Skipped items already existed and were left alone.
+	Skipped int
+}
+
+// ImportMetadata reads items in the ExportMetadata format from r and writes
+// them to the metadata table, skipping checkpoint lines. Existing items are kept unless overwrite is
+// set, so an interrupted import can simply be run again.
+func (s *Service) ImportMetadata(ctx context.Context, r io.Reader, overwrite bool) (ImportResult, error) {
+	var result ImportResult
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxImportLine)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 || bytes.HasPrefix(scanner.Bytes(), []byte("#")) {
+			continue
+		}
+		var record map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return result, fmt.Errorf("line %d: %w", line, err)
+		}
+		id, _ := record["ID"].(string)
+		hash, _ := record["Hash"].(string)
+		if id == "" || hash == "" {
+			return result, fmt.Errorf("line %d: item must have non-empty ID and Hash", line)
+		}
+		item, err := dynamodbattribute.MarshalMap(record)
+		if err != nil {
+			return result, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		input := &dynamodb.PutItemInput{
+			TableName: aws.String(s.dbFileTableName),
+			Item:      item,
+		}
+		if !overwrite {
+			input.ConditionExpression = aws.String("attribute_not_exists(ID)")
+		}
+		if _, err := s.db.PutItemWithContext(ctx, input); err != nil {
+			if isConditionFailed(err) {
+				result.Skipped++
+				continue
+			}
+			return result, fmt.Errorf("line %d: failed to save item %s: %w", line, id, err)
+		}
+		result.Imported++
+	}
+	return result, scanner.Err()
+}
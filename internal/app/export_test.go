@@ -0,0 +1,47 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// scanFake answers DynamoDB scans with no items and records their input.
+func scanFake(scans *[]map[string]interface{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var input map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&input)
+		*scans = append(*scans, input)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		io.WriteString(w, `{"Items":[],"Count":0}`)
+	})
+}
+
+func TestExportFilesExcludesDeleted(t *testing.T) {
+	var scans []map[string]interface{}
+	s := newTestService(t, scanFake(&scans))
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files/export", nil))
+	if w.Code != http.StatusOK || len(scans) != 1 {
+		t.Fatalf("got %d %s after %d scans", w.Code, w.Body, len(scans))
+	}
+	filter, _ := scans[0]["FilterExpression"].(string)
+	if !strings.Contains(filter, "attribute_not_exists(#deleted)") {
+		t.Errorf("anonymous export filter %q doesn't exclude deleted files", filter)
+	}
+}
+
+func TestExportMetadataIncludeDeleted(t *testing.T) {
+	var scans []map[string]interface{}
+	s := newTestService(t, scanFake(&scans))
+	if _, err := s.ExportMetadata(context.Background(), io.Discard, ExportOptions{IncludeDeleted: true}); err != nil {
+		t.Fatal(err)
+	}
+	if filter, ok := scans[0]["FilterExpression"]; ok {
+		t.Errorf("full export has filter %q", filter)
+	}
+}
@@ -0,0 +1,53 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const defaultMaxFilenameLength = 255
+
+// cleanFilename prepares a client-supplied filename for storage and for use
+// in headers: it is NFC-normalized, and control and bidirectional formatting
+// characters (which can disguise the real extension) are removed. Names longer
+// than the configured maximum, in bytes, are truncated keeping the extension,
+// or rejected with 400 filename_too_long.
+func (s *Service) cleanFilename(name string) (string, error) {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || unicode.Is(unicode.Bidi_Control, r) || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, norm.NFC.String(name))
+	name = strings.TrimSpace(name)
+
+	if len(name) <= s.maxFilenameLength {
+		return name, nil
+	}
+	if !s.truncateFilenames {
+		return "", newAPIError(http.StatusBadRequest, "filename_too_long",
+			fmt.Sprintf("filename is %d bytes, the maximum is %d", len(name), s.maxFilenameLength))
+	}
+	ext := filepath.Ext(name)
+	if len(ext) >= s.maxFilenameLength {
+		ext = ""
+	}
+	return truncateUTF8(strings.TrimSuffix(name, ext), s.maxFilenameLength-len(ext)) + ext, nil
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
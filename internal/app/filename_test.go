@@ -0,0 +1,70 @@
+package app
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCleanFilename(t *testing.T) {
+	s := newTestService(t, nil)
+	tests := []struct {
+		name, want string
+	}{
+		{"📷 holiday.jpg", "📷 holiday.jpg"},
+		{"👩\u200d👩\u200d👧 family.jpg", "👩\u200d👩\u200d👧 family.jpg"},
+		{"صورة.jpg", "صورة.jpg"},
+		{"תמונה.jpg", "תמונה.jpg"},
+		// U+202E RIGHT-TO-LEFT OVERRIDE would display this as "photogpj.exe".
+		{"photo\u202eexe.jpg", "photoexe.jpg"},
+		{"\u200fשלום\u200e.jpg", "שלום.jpg"},
+		{"cafe\u0301.jpg", "caf\u00e9.jpg"},
+		{" line\r\nbreak.jpg\x00 ", "linebreak.jpg"},
+		{"bad\xffutf8.jpg", "badutf8.jpg"},
+	}
+	for _, tt := range tests {
+		got, err := s.cleanFilename(tt.name)
+		if err != nil || got != tt.want {
+			t.Errorf("cleanFilename(%q) = %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestCleanFilenameLengthInBytes(t *testing.T) {
+	s := newTestService(t, nil, WithMaxFilenameLength(20, false))
+	// Five 4-byte emoji and ".jpg" are 9 characters but 24 bytes.
+	name := strings.Repeat("📷", 5) + ".jpg"
+	if _, err := s.cleanFilename(name); apiErrorCode(err) != "filename_too_long" {
+		t.Errorf("cleanFilename(%q) error = %v, want filename_too_long", name, err)
+	}
+	if got, err := s.cleanFilename(strings.Repeat("📷", 4) + ".jpg"); err != nil {
+		t.Errorf("cleanFilename at the limit = %q, %v", got, err)
+	}
+	// Decomposed characters count after NFC normalization.
+	if got, err := s.cleanFilename(strings.Repeat("e\u0301", 8) + ".jpg"); err != nil {
+		t.Errorf("cleanFilename of decomposed name = %q, %v", got, err)
+	}
+}
+
+func TestCleanFilenameTruncation(t *testing.T) {
+	tests := []struct {
+		name string
+		max  int
+		want string
+	}{
+		{strings.Repeat("📷", 5) + ".jpg", 20, strings.Repeat("📷", 4) + ".jpg"},
+		{strings.Repeat("📷", 5) + ".jpg", 19, strings.Repeat("📷", 3) + ".jpg"},
+		{"שלום עולם.jpg", 11, "שלו.jpg"},
+		{"مرحبا بالعالم.jpg", 13, "مرحب.jpg"},
+	}
+	for _, tt := range tests {
+		s := newTestService(t, nil, WithMaxFilenameLength(tt.max, true))
+		got, err := s.cleanFilename(tt.name)
+		if err != nil || got != tt.want {
+			t.Errorf("cleanFilename(%q) with max %d = %q, %v; want %q", tt.name, tt.max, got, err, tt.want)
+		}
+		if !utf8.ValidString(got) || len(got) > tt.max {
+			t.Errorf("cleanFilename(%q) = %q, not valid UTF-8 within %d bytes", tt.name, got, tt.max)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package app
+
+import "net/http"
+
+// Healthz reports that the process is up. It doesn't touch AWS, so it stays
+// healthy while the backend is unavailable; use /ready for routing decisions.
+func (s *Service) Healthz(w http.ResponseWriter, r *http.Request) {
+	s.writeResponse(w, r, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Ready returns 503 until EnsureInfrastructure has completed, so load
+// balancers don't route requests to a service whose table is still being
+// created, and again once the service is shutting down.
+func (s *Service) Ready(w http.ResponseWriter, r *http.Request) {
+	if s.uploads.isDraining() {
+		s.writeJSONError(w, r, http.StatusServiceUnavailable, "shutting_down", "the service is shutting down")
+		return
+	}
+	if !s.ready.Load() {
+		s.writeJSONError(w, r, http.StatusServiceUnavailable, "not_ready", "infrastructure is not ready")
+		return
+	}
+	s.writeResponse(w, r, http.StatusOK, map[string]string{"status": "ready"})
+}
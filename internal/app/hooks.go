@@ -0,0 +1,104 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// UploadContext describes an upload before it is stored. Pre-upload hooks
+// may change OriginalName and Tags; the other fields are informational and
+// Data must not be modified. Data is nil for streamed uploads, which are
+// already in S3 when the hooks run.
+type UploadContext struct {
+	OwnerID      string
+	OriginalName string
+	Extension    string
+	ContentType  string
+	Hash         string
+	Size         int64
+	Tags         map[string]string
+	Data         []byte
+}
+
+// PreUploadHook runs before an upload is stored. Returning an error rejects
+// the upload with 422 upload_rejected and the error's message, or with the
+// status of an error created by NewHookError.
+type PreUploadHook interface {
+	PreUpload(ctx context.Context, upload *UploadContext) error
+}
+
+// PostUploadHook runs after a new file has been stored, e.g. to notify
+// other systems. Errors are logged; the upload has already succeeded.
+type PostUploadHook interface {
+	PostUpload(ctx context.Context, metadata FileMetadata) error
+}
+
+// PreUploadHookFunc adapts a function to PreUploadHook.
+type PreUploadHookFunc func(ctx context.Context, upload *UploadContext) error
+
+func (f PreUploadHookFunc) PreUpload(ctx context.Context, upload *UploadContext) error {
+	return f(ctx, upload)
+}
+
+// PostUploadHookFunc adapts a function to PostUploadHook.
+type PostUploadHookFunc func(ctx context.Context, metadata FileMetadata) error
+
+func (f PostUploadHookFunc) PostUpload(ctx context.Context, metadata FileMetadata) error {
+	return f(ctx, metadata)
+}
+
+// NewHookError lets a pre-upload hook reject an upload with a specific
+// status and error code instead of 422 upload_rejected.
+func NewHookError(status int, code, message string) error {
+	return newAPIError(status, code, message)
+}
+
+// runPreUploadHooks runs the hooks in order and applies their changes to u.
+func (s *Service) runPreUploadHooks(ctx context.Context, u *upload) error {
+	if len(s.preUploadHooks) == 0 {
+		return nil
+	}
+	uc := &UploadContext{
+		OwnerID:      u.ownerID,
+		OriginalName: u.originalName,
+		Extension:    u.ext,
+		ContentType:  u.contentType,
+		Hash:         u.hash,
+		Size:         u.size,
+		Tags:         u.tags,
+		Data:         u.data,
+	}
+	for _, hook := range s.preUploadHooks {
+		if err := hook.PreUpload(ctx, uc); err != nil {
+			var apiErr *apiError
+			if errors.As(err, &apiErr) {
+				return err
+			}
+			return newAPIError(http.StatusUnprocessableEntity, "upload_rejected", err.Error())
+		}
+	}
+
+	// Hooks are trusted code, but their changes still have to meet the
+	// limits clients are held to.
+	name, err := s.cleanFilename(uc.OriginalName)
+	if err != nil {
+		return err
+	}
+	if err := s.validateTags(uc.Tags); err != nil {
+		return err
+	}
+	u.originalName, u.tags = name, uc.Tags
+	return nil
+}
+
+// fileStored runs the post-upload hooks for a new file once it is ready and
+// publishes its stored event.
+func (s *Service) fileStored(ctx context.Context, metadata *FileMetadata) {
+	for _, hook := range s.postUploadHooks {
+		if err := hook.PostUpload(ctx, *metadata); err != nil {
+			s.logger.Error("post-upload hook failed", "id", metadata.ID, "error", err)
+		}
+	}
+	s.publishFileEvent(ctx, FileEventStored, metadata)
+}
@@ -0,0 +1,53 @@
+package app
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// IDGenerator makes the IDs of new files. Unless objects are keyed by
+// content hash, the ID also names the object, so a deterministic generator
+// makes stored keys predictable, e.g. in golden-file tests. IDs must be
+// unique and valid key components.
+type IDGenerator interface {
+	NewID() string
+}
+
+// IDGeneratorFunc adapts a function to IDGenerator.
+type IDGeneratorFunc func() string
+
+func (f IDGeneratorFunc) NewID() string {
+	return f()
+}
+
+// Clock tells the time recorded in metadata, such as CreatedAt, UpdatedAt and
+// DeletedAt. Cache expiry, presigned URLs and other timing use the system
+// clock regardless.
+type Clock interface {
+	Now() time.Time
+}
+
+// ClockFunc adapts a function to Clock.
+type ClockFunc func() time.Time
+
+func (f ClockFunc) Now() time.Time {
+	return f()
+}
+
+type uuidGenerator struct{}
+
+func (uuidGenerator) NewID() string {
+	return uuid.New().String()
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// now is the current time of the service's clock, in UTC.
+func (s *Service) now() time.Time {
+	return s.clock.Now().UTC()
+}
@@ -0,0 +1,84 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	// Decoders for accept-any-image mode, besides JPEG.
+	_ "image/gif"
+	_ "image/png"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultImageDecodeTimeout = 10 * time.Second
+	// defaultMaxImagePixels rejects decompression bombs: a small JPEG can
+	// declare dimensions whose decoded bitmap takes gigabytes.
+	defaultMaxImagePixels = 50_000_000
+)
+
+// uploadImage decodes the uploaded image once for all processing steps.
+// Decoding is bounded by the pixel limit and the decode timeout; the result
+// is kept on the upload so later steps reuse it.
+func (s *Service) uploadImage(ctx context.Context, u *upload) (image.Image, error) {
+	if u.img != nil {
+		return u.img, nil
+	}
+	img, err := s.decodeImage(ctx, u.data)
+	if err != nil {
+		return nil, err
+	}
+	u.img = img
+	return img, nil
+}
+
+func (s *Service) decodeImage(ctx context.Context, data []byte) (image.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, newAPIError(http.StatusUnsupportedMediaType, "unsupported_media_type", fmt.Sprintf("failed to decode image: %v", err))
+	}
+	if int64(config.Width)*int64(config.Height) > s.maxImagePixels {
+		return nil, newAPIError(http.StatusUnprocessableEntity, "image_too_large",
+			fmt.Sprintf("image of %dx%d pixels exceeds the limit of %d pixels", config.Width, config.Height, s.maxImagePixels))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.imageDecodeTimeout)
+	defer cancel()
+	type decoded struct {
+		img image.Image
+		err error
+	}
+	// The decoder can't be interrupted. On timeout it is abandoned and its
+	// goroutine finishes in the background; the pixel limit bounds its cost.
+	done := make(chan decoded, 1)
+	go func() {
+		img, _, err := image.Decode(bytes.NewReader(data))
+		done <- decoded{img, err}
+	}()
+	select {
+	case result := <-done:
+		if result.err != nil {
+			return nil, newAPIError(http.StatusUnsupportedMediaType, "unsupported_media_type", fmt.Sprintf("failed to decode image: %v", result.err))
+		}
+		return result.img, nil
+	case <-ctx.Done():
+		return nil, newAPIError(http.StatusUnprocessableEntity, "image_processing_timeout", "image processing took too long")
+	}
+}
+
+// averageColor returns the mean color of img as "#rrggbb". It is averaged in
+// linear light over a downsampled grid, which matches how the image looks
+// blurred better than averaging sRGB values.
+func averageColor(img image.Image) string {
+	pixels, _, _ := samplePixels(img, blurHashSamples)
+	var sum [3]float64
+	for _, p := range pixels {
+		sum[0] += p[0]
+		sum[1] += p[1]
+		sum[2] += p[2]
+	}
+	n := float64(len(pixels))
+	return fmt.Sprintf("#%02x%02x%02x", linearToSRGB(sum[0]/n), linearToSRGB(sum[1]/n), linearToSRGB(sum[2]/n))
+}
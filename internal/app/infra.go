@@ -0,0 +1,258 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	hashIndex = "HashIndex"
+	// infraPollInterval is how often EnsureInfrastructure checks whether a
+	// table that is still being created has become ACTIVE.
+	infraPollInterval = 2 * time.Second
+)
+
+// TableCapacity is the provisioned read and write capacity of a table or
+// index.
+type TableCapacity struct {
+	Read  int64
+	Write int64
+}
+
+// TableBilling is how a table created by EnsureInfrastructure is billed.
+// Mode is dynamodb.BillingModePayPerRequest, which takes no capacities, or
+// dynamodb.BillingModeProvisioned, which needs positive capacities for the
+// table and for each of its indexes, HashIndex included.
+type TableBilling struct {
+	Mode    string
+	Table   TableCapacity
+	Indexes TableCapacity
+}
+
+func (b TableBilling) validate() error {
+	switch b.Mode {
+	case dynamodb.BillingModePayPerRequest:
+		if b.Table != (TableCapacity{}) || b.Indexes != (TableCapacity{}) {
+			return fmt.Errorf("capacities can't be set with billing mode %s", b.Mode)
+		}
+	case dynamodb.BillingModeProvisioned:
+		for _, c := range []TableCapacity{b.Table, b.Indexes} {
+			if c.Read <= 0 || c.Write <= 0 {
+				return fmt.Errorf("billing mode %s needs positive read and write capacities for the table and indexes", b.Mode)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown billing mode %q", b.Mode)
+	}
+	return nil
+}
+
+func (c TableCapacity) throughput() *dynamodb.ProvisionedThroughput {
+	if c == (TableCapacity{}) {
+		return nil
+	}
+	return &dynamodb.ProvisionedThroughput{
+		ReadCapacityUnits:  aws.Int64(c.Read),
+		WriteCapacityUnits: aws.Int64(c.Write),
+	}
+}
+
+// EnsureInfrastructure creates the bucket and the metadata table with its
+// indexes if they don't exist yet, billed as set with WithTableBilling, and
+// waits until the table and its
+// HashIndex are ACTIVE. Once it succeeds, /ready reports the service as ready.
+// It is safe to call against existing infrastructure.
+func (s *Service) EnsureInfrastructure(ctx context.Context) error {
+	if err := s.ensureBucket(ctx); err != nil {
+		return err
+	}
+	if err := s.ensureTable(ctx); err != nil {
+		return err
+	}
+	if err := s.waitForTable(ctx); err != nil {
+		return err
+	}
+	s.ready.Store(true)
+	s.logger.Info("infrastructure ready", "bucket", s.fileStorageBucket, "table", s.dbFileTableName)
+	return nil
+}
+
+// CheckInfrastructure is EnsureInfrastructure for deployments that create
+// the infrastructure themselves: it creates nothing, but fails if the bucket
+// or table doesn't exist, and otherwise waits until the table and its
+// HashIndex are ACTIVE and reports the service as ready.
+func (s *Service) CheckInfrastructure(ctx context.Context) error {
+	_, err := s.fileStorage.HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(s.fileStorageBucket),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to check bucket %s: %w", s.fileStorageBucket, err)
+	}
+	if err := s.waitForTable(ctx); err != nil {
+		return err
+	}
+	s.ready.Store(true)
+	s.logger.Info("infrastructure ready", "bucket", s.fileStorageBucket, "table", s.dbFileTableName)
+	return nil
+}
+
+func (s *Service) ensureBucket(ctx context.Context) error {
+	_, err := s.fileStorage.HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(s.fileStorageBucket),
+	})
+	if err == nil {
+		return nil
+	}
+	if !isNotFoundError(err) {
+		return fmt.Errorf("failed to check bucket %s: %w", s.fileStorageBucket, err)
+	}
+
+	input := &s3.CreateBucketInput{Bucket: aws.String(s.fileStorageBucket)}
+	// us-east-1 is the default location and must not be sent explicitly.
+	if region := aws.StringValue(s.fileStorage.Config.Region); region != "" && region != "us-east-1" {
+		input.CreateBucketConfiguration = &s3.CreateBucketConfiguration{
+			LocationConstraint: aws.String(region),
+		}
+	}
+	if _, err := s.fileStorage.CreateBucketWithContext(ctx, input); err != nil {
+		var aerr awserr.Error
+		if !errors.As(err, &aerr) || aerr.Code() != s3.ErrCodeBucketAlreadyOwnedByYou {
+			return fmt.Errorf("failed to create bucket %s: %w", s.fileStorageBucket, err)
+		}
+	}
+	s.logger.Info("created bucket", "bucket", s.fileStorageBucket)
+	return s.fileStorage.WaitUntilBucketExistsWithContext(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(s.fileStorageBucket),
+	})
+}
+
+func (s *Service) ensureTable(ctx context.Context) error {
+	_, err := s.db.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(s.dbFileTableName),
+	})
+	if err == nil {
+		return nil
+	}
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) || aerr.Code() != dynamodb.ErrCodeResourceNotFoundException {
+		return fmt.Errorf("failed to describe table %s: %w", s.dbFileTableName, err)
+	}
+
+	indexThroughput := s.tableBilling.Indexes.throughput()
+	input := &dynamodb.CreateTableInput{
+		TableName:   aws.String(s.dbFileTableName),
+		BillingMode: aws.String(s.tableBilling.Mode),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("ID"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+			{AttributeName: aws.String("Kind"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+			{AttributeName: aws.String("CreatedAt"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("ID"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+		GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String(s.createdAtIndex),
+				KeySchema: []*dynamodb.KeySchemaElement{
+					{AttributeName: aws.String("Kind"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+					{AttributeName: aws.String("CreatedAt"), KeyType: aws.String(dynamodb.KeyTypeRange)},
+				},
+				Projection:            &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeAll)},
+				ProvisionedThroughput: indexThroughput,
+			},
+		},
+		ProvisionedThroughput: s.tableBilling.Table.throughput(),
+	}
+	if s.dedup {
+		input.AttributeDefinitions = append(input.AttributeDefinitions,
+			&dynamodb.AttributeDefinition{AttributeName: aws.String("Hash"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		)
+		input.GlobalSecondaryIndexes = append(input.GlobalSecondaryIndexes, &dynamodb.GlobalSecondaryIndex{
+			IndexName: aws.String(hashIndex),
+			KeySchema: []*dynamodb.KeySchemaElement{
+				{AttributeName: aws.String("Hash"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+			},
+			Projection:            &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeAll)},
+			ProvisionedThroughput: indexThroughput,
+		})
+	}
+	if s.filenamePolicy != FilenamesAllowDuplicates {
+		input.AttributeDefinitions = append(input.AttributeDefinitions,
+			&dynamodb.AttributeDefinition{AttributeName: aws.String("OwnerID"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+			&dynamodb.AttributeDefinition{AttributeName: aws.String("OriginalName"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		)
+		input.GlobalSecondaryIndexes = append(input.GlobalSecondaryIndexes, &dynamodb.GlobalSecondaryIndex{
+			IndexName: aws.String(ownerNameIndex),
+			KeySchema: []*dynamodb.KeySchemaElement{
+				{AttributeName: aws.String("OwnerID"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+				{AttributeName: aws.String("OriginalName"), KeyType: aws.String(dynamodb.KeyTypeRange)},
+			},
+			Projection:            &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeAll)},
+			ProvisionedThroughput: indexThroughput,
+		})
+	}
+	_, err = s.db.CreateTableWithContext(ctx, input)
+	if err != nil {
+		var aerr awserr.Error
+		if !errors.As(err, &aerr) || aerr.Code() != dynamodb.ErrCodeResourceInUseException {
+			return fmt.Errorf("failed to create table %s: %w", s.dbFileTableName, err)
+		}
+	}
+	s.logger.Info("created table", "table", s.dbFileTableName, "billing_mode", s.tableBilling.Mode)
+	return nil
+}
+
+// waitForTable polls until the table and its HashIndex are ACTIVE. Other
+// indexes only affect their own endpoints and are not waited for, nor is
+// HashIndex with hash scans enabled or dedup disabled.
+func (s *Service) waitForTable(ctx context.Context) error {
+	ticker := time.NewTicker(infraPollInterval)
+	defer ticker.Stop()
+	for {
+		out, err := s.db.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{
+			TableName: aws.String(s.dbFileTableName),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to describe table %s: %w", s.dbFileTableName, err)
+		}
+		active, err := tableActive(out.Table, s.needsHashIndex())
+		if err != nil {
+			return err
+		}
+		if active {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// needsHashIndex reports whether uploads query HashIndex.
+func (s *Service) needsHashIndex() bool {
+	return s.dedup && !s.hashScan
+}
+
+func tableActive(table *dynamodb.TableDescription, needHashIndex bool) (bool, error) {
+	if aws.StringValue(table.TableStatus) != dynamodb.TableStatusActive {
+		return false, nil
+	}
+	if !needHashIndex {
+		return true, nil
+	}
+	for _, index := range table.GlobalSecondaryIndexes {
+		if aws.StringValue(index.IndexName) == hashIndex {
+			return aws.StringValue(index.IndexStatus) == dynamodb.IndexStatusActive, nil
+		}
+	}
+	return false, fmt.Errorf("table %s has no %s", aws.StringValue(table.TableName), hashIndex)
+}
@@ -0,0 +1,48 @@
+package app
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+)
+
+// infraFake answers HeadBucket with bucketStatus and DescribeTable with an
+// ACTIVE table, and fails the test on any attempt to create something.
+func infraFake(t *testing.T, bucketStatus int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isDynamoDB(r) {
+			if r.Method != http.MethodHead {
+				t.Errorf("unexpected S3 %s %s", r.Method, r.URL.Path)
+			}
+			w.WriteHeader(bucketStatus)
+			return
+		}
+		if target := r.Header.Get("X-Amz-Target"); target != "DynamoDB_20120810.DescribeTable" {
+			t.Errorf("unexpected DynamoDB call %s", target)
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		io.WriteString(w, `{"Table":{"TableName":"`+testTable+`","TableStatus":"ACTIVE",`+
+			`"GlobalSecondaryIndexes":[{"IndexName":"HashIndex","IndexStatus":"ACTIVE"}]}}`)
+	})
+}
+
+func TestCheckInfrastructure(t *testing.T) {
+	s := newTestService(t, infraFake(t, http.StatusOK))
+	if err := s.CheckInfrastructure(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !s.ready.Load() {
+		t.Error("service not ready after the infrastructure check")
+	}
+}
+
+func TestCheckInfrastructureMissingBucket(t *testing.T) {
+	s := newTestService(t, infraFake(t, http.StatusNotFound))
+	if err := s.CheckInfrastructure(context.Background()); err == nil {
+		t.Error("CheckInfrastructure succeeded without a bucket")
+	}
+	if s.ready.Load() {
+		t.Error("service ready without a bucket")
+	}
+}
@@ -0,0 +1,137 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gorilla/mux"
+)
+
+// InspectResponse puts a file's metadata next to what S3 reports for its
+// object, for debugging drift between the two. Object is nil when the object
+// is missing.
+type InspectResponse struct {
+	Metadata   *FileMetadata   `json:"metadata"`
+	Object     *ObjectInfo     `json:"object"`
+	Mismatches []FieldMismatch `json:"mismatches"`
+}
+
+// ObjectInfo is the part of a HeadObject result relevant to a file.
+type ObjectInfo struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+	// Region is the region of the store that answered, which differs from
+	// the primary one when the object was only found in the secondary store.
+	Region               string `json:"region"`
+	ContentType          string `json:"content_type,omitempty"`
+	ContentEncoding      string `json:"content_encoding,omitempty"`
+	StorageClass         string `json:"storage_class"`
+	LastModified         string `json:"last_modified,omitempty"`
+	ETag                 string `json:"etag,omitempty"`
+	ServerSideEncryption string `json:"server_side_encryption,omitempty"`
+	KMSKeyID             string `json:"kms_key_id,omitempty"`
+	ChecksumSHA256       string `json:"checksum_sha256,omitempty"`
+}
+
+// FieldMismatch is a field on which the metadata and the object disagree.
+type FieldMismatch struct {
+	Field    string `json:"field"`
+	Metadata string `json:"metadata"`
+	Object   string `json:"object"`
+}
+
+// InspectFile returns a file's metadata and the live state of its object,
+// listing the fields that don't match. Soft-deleted files are included.
+func (s *Service) InspectFile(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if err := s.sanitizeKeyComponent(id); err != nil {
+		s.writeJSONError(w, r, http.StatusBadRequest, "invalid_id", err.Error())
+		return
+	}
+	metadata, err := s.retrieveMetadataFromDB(r.Context(), id)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if metadata == nil {
+		s.writeJSONError(w, r, http.StatusNotFound, "not_found", "file not found")
+		return
+	}
+
+	key := objectKey(metadata)
+	response := InspectResponse{Metadata: metadata, Mismatches: []FieldMismatch{}}
+	head, store, err := s.headObject(r.Context(), key)
+	switch {
+	case isNotFoundError(err):
+		response.Mismatches = append(response.Mismatches, FieldMismatch{Field: "object", Metadata: key, Object: ""})
+	case err != nil:
+		s.writeError(w, r, err)
+		return
+	default:
+		response.Object = objectInfo(key, head, store)
+		response.Mismatches = compareObject(metadata, response.Object)
+	}
+	s.writeResponse(w, r, http.StatusOK, response)
+}
+
+func objectInfo(key string, head *s3.HeadObjectOutput, store objectStore) *ObjectInfo {
+	info := &ObjectInfo{
+		Key:                  key,
+		Size:                 aws.Int64Value(head.ContentLength),
+		Region:               store.region,
+		ContentType:          aws.StringValue(head.ContentType),
+		ContentEncoding:      aws.StringValue(head.ContentEncoding),
+		StorageClass:         aws.StringValue(head.StorageClass),
+		ETag:                 aws.StringValue(head.ETag),
+		ServerSideEncryption: aws.StringValue(head.ServerSideEncryption),
+		KMSKeyID:             aws.StringValue(head.SSEKMSKeyId),
+		ChecksumSHA256:       aws.StringValue(head.ChecksumSHA256),
+	}
+	if info.StorageClass == "" {
+		// HeadObject omits the class for STANDARD objects.
+		info.StorageClass = s3.StorageClassStandard
+	}
+	if head.LastModified != nil {
+		info.LastModified = head.LastModified.UTC().Format(time.RFC3339)
+	}
+	return info
+}
+
+// compareObject lists the fields on which metadata and the object disagree.
+func compareObject(metadata *FileMetadata, object *ObjectInfo) []FieldMismatch {
+	mismatches := []FieldMismatch{}
+	mismatch := func(field, want, got string) {
+		if want != got {
+			mismatches = append(mismatches, FieldMismatch{Field: field, Metadata: want, Object: got})
+		}
+	}
+
+	size := metadata.Size
+	if metadata.StoredSize > 0 {
+		size = metadata.StoredSize
+	}
+	if size > 0 {
+		mismatch("size", strconv.FormatInt(size, 10), strconv.FormatInt(object.Size, 10))
+	}
+	if metadata.ContentType != "" {
+		mismatch("content_type", metadata.ContentType, object.ContentType)
+	}
+	mismatch("content_encoding", metadata.ContentEncoding, object.ContentEncoding)
+	if metadata.Region != "" {
+		mismatch("region", metadata.Region, object.Region)
+	}
+	if metadata.ObjectETag != "" {
+		mismatch("etag", metadata.ObjectETag, strings.Trim(object.ETag, `"`))
+	}
+	if object.ChecksumSHA256 != "" {
+		// Only present for single-part uploads with checksums enabled.
+		if checksum, err := hexToBase64(metadata.Hash); err == nil {
+			mismatch("checksum_sha256", checksum, object.ChecksumSHA256)
+		}
+	}
+	return mismatches
+}
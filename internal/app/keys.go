@@ -0,0 +1,116 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Object keys and table IDs under these prefixes are used internally (e.g. for
+// thumbnails and hash items) and must never be produced from client input.
+var defaultReservedKeyPrefixes = []string{"thumb/", "HASH#"}
+
+var errInvalidKey = errors.New("invalid key")
+
+// KeyStrategy decides how new objects are named.
+type KeyStrategy string
+
+const (
+	// KeyStrategyID names each object after its file ID, so every upload
+	// gets an object of its own.
+	KeyStrategyID KeyStrategy = "id"
+	// KeyStrategyContentHash names objects after the SHA-256 of their
+	// content, so files with identical content share one object.
+	KeyStrategyContentHash KeyStrategy = "content-hash"
+)
+
+// sanitizeKeyComponent rejects client-influenced parts of an object key or
+// item ID that could escape their namespace or land under a reserved prefix.
+func (s *Service) sanitizeKeyComponent(component string) error {
+	if strings.ContainsAny(component, "/\\#") || strings.Contains(component, "..") {
+		return fmt.Errorf("%w: %q contains forbidden characters", errInvalidKey, component)
+	}
+	for _, r := range component {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("%w: %q contains control characters", errInvalidKey, component)
+		}
+	}
+	return s.checkReservedPrefix(component)
+}
+
+func (s *Service) checkReservedPrefix(key string) error {
+	for _, prefix := range s.reservedKeyPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return fmt.Errorf("%w: %q uses reserved prefix %q", errInvalidKey, key, prefix)
+		}
+	}
+	return nil
+}
+
+// buildObjectKey is the single place object keys are constructed.
+func (s *Service) buildObjectKey(id, ext string) (string, error) {
+	for _, component := range []string{id, ext} {
+		if err := s.sanitizeKeyComponent(component); err != nil {
+			return "", err
+		}
+	}
+	key := s.keyPrefixFor(ext) + id + ext
+	if err := s.checkReservedPrefix(key); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// keyPrefixFor returns the key prefix of new objects with extension ext.
+func (s *Service) keyPrefixFor(ext string) string {
+	if prefix, ok := s.extensionKeyPrefixes[strings.ToLower(ext)]; ok {
+		return prefix
+	}
+	return s.keyPrefix
+}
+
+// keyPrefixes returns the prefixes new objects may be written under, without
+// those already covered by a shorter one.
+func (s *Service) keyPrefixes() []string {
+	all := []string{s.keyPrefix}
+	for _, prefix := range s.extensionKeyPrefixes {
+		all = append(all, prefix)
+	}
+	slices.Sort(all)
+	var prefixes []string
+	for _, prefix := range all {
+		if len(prefixes) == 0 || !strings.HasPrefix(prefix, prefixes[len(prefixes)-1]) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// newObjectKey returns the key for a new file's object under the configured
+// strategy.
+func (s *Service) newObjectKey(id string, u *upload) (string, error) {
+	if s.keyStrategy == KeyStrategyContentHash {
+		return s.buildObjectKey(u.hash, u.ext)
+	}
+	return s.buildObjectKey(id, u.ext)
+}
+
+// sharedObjectKey reports whether the file's object may be shared with other
+// files, i.e. is named after its content hash, whatever the strategy is now.
+// Keys are <prefix><name><ext>, so the name is matched exactly at the end of
+// the key: IDs can be anything an IDGenerator makes, and a substring test
+// would take a hash key containing a short ID for the file's own object.
+func sharedObjectKey(metadata *FileMetadata) bool {
+	return metadata.Hash != "" && strings.HasSuffix(objectKey(metadata), metadata.Hash+metadata.Extension)
+}
+
+// objectKey returns the S3 key of a stored file. Rows written before keys were
+// stored explicitly fall back to the ID + extension layout.
+func objectKey(metadata *FileMetadata) string {
+	if metadata.Key != "" {
+		return metadata.Key
+	}
+	return metadata.ID + metadata.Extension
+}
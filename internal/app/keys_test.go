@@ -0,0 +1,29 @@
+package app
+
+import "testing"
+
+func TestSharedObjectKey(t *testing.T) {
+	const hash = "0f3a9c1e5b7d2f4a6c8e0b1d3f5a7c9e1b3d5f7a9c0e2b4d6f8a0c2e4b6d8f0a"
+	tests := []struct {
+		name     string
+		metadata FileMetadata
+		want     bool
+	}{
+		{"id key", FileMetadata{ID: "17f6c3d2", Key: "17f6c3d2.jpg", Hash: hash, Extension: ".jpg"}, false},
+		{"prefixed id key", FileMetadata{ID: "17f6c3d2", Key: "uploads/17f6c3d2.jpg", Hash: hash, Extension: ".jpg"}, false},
+		{"legacy row without key", FileMetadata{ID: "17f6c3d2", Hash: hash, Extension: ".jpg"}, false},
+		{"hash key", FileMetadata{ID: "17f6c3d2", Key: hash + ".jpg", Hash: hash, Extension: ".jpg"}, true},
+		{"prefixed hash key", FileMetadata{ID: "17f6c3d2", Key: "images/jpg/" + hash + ".jpg", Hash: hash, Extension: ".jpg"}, true},
+		// Short injected IDs occur inside hash keys.
+		{"hash key containing id", FileMetadata{ID: "0f", Key: hash + ".jpg", Hash: hash, Extension: ".jpg"}, true},
+		{"hash key containing one-letter id", FileMetadata{ID: "a", Key: hash + ".jpg", Hash: hash, Extension: ".jpg"}, true},
+		{"id key without hash", FileMetadata{ID: "1", Key: "1.jpg", Extension: ".jpg"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sharedObjectKey(&tt.metadata); got != tt.want {
+				t.Errorf("sharedObjectKey(%+v) = %t, want %t", tt.metadata, got, tt.want)
+			}
+		})
+	}
+}
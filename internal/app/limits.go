@@ -0,0 +1,219 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// uploadMemoryBudget bounds the bytes buffered by all in-flight uploads
+// together. Uploads are held in memory while they are validated, hashed and
+// stored, so each one reserves its declared Content-Length for its lifetime.
+type uploadMemoryBudget struct {
+	capacity     int64
+	sem          *semaphore.Weighted
+	queueTimeout time.Duration
+}
+
+// uploadReservation is an upload's share of the memory budget. It is released
+// when the request ends, unless it was handed off to work that keeps the
+// upload's data beyond the request, such as deferred processing.
+type uploadReservation struct {
+	release   func()
+	handedOff atomic.Bool
+}
+
+// handOffUploadReservation takes over the budget reservation of the upload
+// being handled with ctx. The returned function releases it and may be
+// called more than once; it does nothing without a memory budget.
+func handOffUploadReservation(ctx context.Context) func() {
+	res, ok := ctx.Value(uploadReservationKey).(*uploadReservation)
+	if !ok {
+		return func() {}
+	}
+	res.handedOff.Store(true)
+	return sync.OnceFunc(res.release)
+}
+
+// takeBackUploadReservation undoes a hand-off that didn't happen after all,
+// so the reservation is released with the request again.
+func takeBackUploadReservation(ctx context.Context) {
+	if res, ok := ctx.Value(uploadReservationKey).(*uploadReservation); ok {
+		res.handedOff.Store(false)
+	}
+}
+
+func newUploadMemoryBudget(capacity int64, queueTimeout time.Duration) *uploadMemoryBudget {
+	return &uploadMemoryBudget{
+		capacity:     capacity,
+		sem:          semaphore.NewWeighted(capacity),
+		queueTimeout: queueTimeout,
+	}
+}
+
+// uploadWeight is the number of budget bytes an upload reserves. Requests
+// without a Content-Length count as the largest allowed upload. On routes
+// that stream, requests large enough to be streamed to S3 reserve only the
+// streaming threshold: a multipart file part just under it is still read
+// into memory, but anything larger is streamed from the body or the form's
+// temporary file.
+func (s *Service) uploadWeight(r *http.Request, streamable bool) int64 {
+	weight := r.ContentLength
+	if weight < 0 {
+		weight = s.maxUploadSize
+		if weight <= 0 {
+			weight = s.uploadBudget.capacity
+		}
+	}
+	if streamable && s.streamUpload(r.ContentLength) {
+		weight = min(weight, s.streamThreshold)
+	}
+	// A single upload larger than the whole budget may still run, alone.
+	return min(weight, s.uploadBudget.capacity)
+}
+
+// limitUploads enforces the Content-Length requirement, the upload body
+// timeout, the maximum upload size and the shared memory budget. Uploads wait
+// up to the queue timeout for budget to free up and are then rejected with
+// 503. streamable is whether the route streams large uploads to S3.
+func (s *Service) limitUploads(next http.HandlerFunc, streamable bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.requireContentLength && r.ContentLength < 0 {
+			s.writeJSONError(w, r, http.StatusLengthRequired, "length_required",
+				"upload requests must have a Content-Length header")
+			return
+		}
+		// The body timeout cuts off clients that trickle the body,
+		// independently of how long the rest of the request takes. Reading
+		// the body must also end by the request deadline, if earlier.
+		var readDeadline time.Time
+		if s.uploadBodyTimeout > 0 {
+			readDeadline = time.Now().Add(s.uploadBodyTimeout)
+		}
+		if d, ok := r.Context().Deadline(); ok && (readDeadline.IsZero() || d.Before(readDeadline)) {
+			readDeadline = d
+		}
+		if !readDeadline.IsZero() {
+			if err := http.NewResponseController(w).SetReadDeadline(readDeadline); err != nil {
+				s.logger.Warn("upload body timeout not supported", "error", err)
+			}
+		}
+		if s.maxUploadSize > 0 {
+			if r.ContentLength > s.maxUploadSize {
+				s.writeJSONError(w, r, http.StatusRequestEntityTooLarge, "upload_too_large",
+					fmt.Sprintf("upload of %d bytes exceeds the limit of %d bytes", r.ContentLength, s.maxUploadSize))
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, s.maxUploadSize)
+		}
+
+		if s.uploadBudget == nil {
+			next(w, r)
+			return
+		}
+		weight := s.uploadWeight(r, streamable)
+		ctx, cancel := context.WithTimeout(r.Context(), s.uploadBudget.queueTimeout)
+		defer cancel()
+		if err := s.uploadBudget.sem.Acquire(ctx, weight); err != nil {
+			s.writeJSONError(w, r, http.StatusServiceUnavailable, "upload_capacity_exceeded",
+				"too many uploads in progress, retry later")
+			return
+		}
+		res := &uploadReservation{release: func() { s.uploadBudget.sem.Release(weight) }}
+		next(w, r.WithContext(context.WithValue(r.Context(), uploadReservationKey, res)))
+		if !res.handedOff.Load() {
+			res.release()
+		}
+	}
+}
+
+// parseMultipartForm is r.ParseMultipartForm, with its errors reported by
+// formError. A body that ends inside a part's headers is reported as
+// incomplete: the form parser takes it for the end of the form, so it is
+// detected by the closing delimiter never having been read.
+func parseMultipartForm(r *http.Request, maxMemory int64) error {
+	var body *closeDelimiterReader
+	if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil && params["boundary"] != "" {
+		body = &closeDelimiterReader{ReadCloser: r.Body, delimiter: []byte("--" + params["boundary"] + "--")}
+		r.Body = body
+	}
+	if err := r.ParseMultipartForm(maxMemory); err != nil {
+		return formError(err)
+	}
+	if body != nil && !body.seen {
+		return formError(io.ErrUnexpectedEOF)
+	}
+	return nil
+}
+
+// closeDelimiterReader records whether the multipart close delimiter has
+// been read.
+type closeDelimiterReader struct {
+	io.ReadCloser
+	delimiter []byte
+	// tail is the end of what was read, for a delimiter split across reads.
+	tail []byte
+	seen bool
+}
+
+func (d *closeDelimiterReader) Read(p []byte) (int, error) {
+	n, err := d.ReadCloser.Read(p)
+	if d.seen || n == 0 {
+		return n, err
+	}
+	keep := len(d.delimiter) - 1
+	window := append(d.tail, p[:min(n, keep)]...)
+	d.seen = bytes.Contains(window, d.delimiter) || bytes.Contains(p[:n], d.delimiter)
+	if n >= keep {
+		d.tail = append(d.tail[:0], p[n-keep:n]...)
+	} else {
+		d.tail = append([]byte(nil), window[max(0, len(window)-keep):]...)
+	}
+	return n, err
+}
+
+// formError reports a failure to read an upload's form or body,
+// distinguishing bodies cut off by the upload size limit or the body timeout,
+// bodies that ended early (typically a dropped connection) and malformed
+// multipart forms. Failures to spool form files to disk are the server's and
+// are returned as they are.
+func formError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return newAPIError(http.StatusRequestEntityTooLarge, "upload_too_large",
+			fmt.Sprintf("upload exceeds the limit of %d bytes", maxBytesErr.Limit))
+	}
+	if errors.Is(err, multipart.ErrMessageTooLarge) {
+		return newAPIError(http.StatusRequestEntityTooLarge, "upload_too_large", "multipart form is too large")
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return newAPIError(http.StatusRequestTimeout, "request_timeout", "upload body was not received in time")
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return newAPIError(http.StatusBadRequest, "incomplete_upload", "upload body ended before it was complete")
+	}
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return err
+	}
+	var headerErr textproto.ProtocolError
+	if errors.Is(err, http.ErrMissingBoundary) || errors.Is(err, http.ErrNotMultipart) ||
+		errors.As(err, &headerErr) || strings.HasPrefix(err.Error(), "multipart: ") {
+		return newAPIError(http.StatusBadRequest, "malformed_multipart", err.Error())
+	}
+	return newAPIError(http.StatusBadRequest, "invalid_form", err.Error())
+}
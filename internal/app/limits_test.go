@@ -0,0 +1,123 @@
+package app
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestUploadReservationHandOff(t *testing.T) {
+	s := &Service{uploadBudget: newUploadMemoryBudget(100, time.Millisecond)}
+	var release func()
+	handler := s.limitUploads(func(w http.ResponseWriter, r *http.Request) {
+		release = handOffUploadReservation(r.Context())
+	}, false)
+	r := httptest.NewRequest(http.MethodPost, "/file", strings.NewReader(strings.Repeat("x", 60)))
+	handler(httptest.NewRecorder(), r)
+
+	// The handed-off reservation outlives the request.
+	if s.uploadBudget.sem.TryAcquire(41) {
+		t.Fatal("reservation released when the request ended")
+	}
+	release()
+	release()
+	if !s.uploadBudget.sem.TryAcquire(100) {
+		t.Fatal("reservation not released by the job")
+	}
+}
+
+func TestUploadReservationTakenBack(t *testing.T) {
+	s := &Service{uploadBudget: newUploadMemoryBudget(100, time.Millisecond)}
+	handler := s.limitUploads(func(w http.ResponseWriter, r *http.Request) {
+		handOffUploadReservation(r.Context())
+		takeBackUploadReservation(r.Context())
+	}, false)
+	r := httptest.NewRequest(http.MethodPost, "/file", strings.NewReader(strings.Repeat("x", 60)))
+	handler(httptest.NewRecorder(), r)
+	if !s.uploadBudget.sem.TryAcquire(100) {
+		t.Fatal("reservation not released with the request")
+	}
+}
+
+func TestUploadWeightOfStreamedUploads(t *testing.T) {
+	s := &Service{uploadBudget: newUploadMemoryBudget(1000, time.Millisecond), maxUploadSize: 800, streamThreshold: 100}
+	tests := []struct {
+		contentLength int64
+		streamable    bool
+		want          int64
+	}{
+		{50, true, 50},
+		{500, true, 100},
+		{-1, true, 100},
+		{500, false, 500},
+		{-1, false, 800},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/file", nil)
+		r.ContentLength = tt.contentLength
+		if got := s.uploadWeight(r, tt.streamable); got != tt.want {
+			t.Errorf("uploadWeight of %d bytes, streamable %t = %d, want %d", tt.contentLength, tt.streamable, got, tt.want)
+		}
+	}
+}
+
+func TestTruncatedUploads(t *testing.T) {
+	full := multipartUpload(t, "photo.jpg", testJPEG(t))
+	contentType := full.Header.Get("Content-Type")
+	body, err := io.ReadAll(full.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headerEnd := bytes.Index(body, []byte("\r\n\r\n"))
+	tests := []struct {
+		name        string
+		body        []byte
+		contentType string
+		code        string
+	}{
+		{"inside the file", body[:len(body)/2], contentType, "incomplete_upload"},
+		{"before the closing boundary", body[:len(body)-10], contentType, "incomplete_upload"},
+		{"inside the part headers", body[:headerEnd-5], contentType, "incomplete_upload"},
+		{"empty", nil, contentType, "malformed_multipart"},
+		{"missing boundary", body, "multipart/form-data", "malformed_multipart"},
+		{"not multipart", body, "application/octet-stream", "malformed_multipart"},
+	}
+	s := newTestService(t, nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/file", bytes.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			w := httptest.NewRecorder()
+			s.Handler().ServeHTTP(w, r)
+			if w.Code != http.StatusBadRequest || errorCode(t, w) != tt.code {
+				t.Errorf("got %d %s, want 400 %s", w.Code, w.Body, tt.code)
+			}
+		})
+	}
+}
+
+func TestCloseDelimiterReaderAcrossReads(t *testing.T) {
+	for _, body := range []string{"--b\r\n\r\nx\r\n--b--", "--b\r\n\r\nx\r\n--b--\r\n", "--b--"} {
+		for name, wrap := range map[string]func(io.Reader) io.Reader{
+			"whole":    func(r io.Reader) io.Reader { return r },
+			"one byte": iotest.OneByteReader,
+			"half":     iotest.HalfReader,
+		} {
+			d := &closeDelimiterReader{ReadCloser: io.NopCloser(wrap(strings.NewReader(body))), delimiter: []byte("--b--")}
+			io.Copy(io.Discard, d)
+			if !d.seen {
+				t.Errorf("%s reads of %q: close delimiter not seen", name, body)
+			}
+			d = &closeDelimiterReader{ReadCloser: io.NopCloser(wrap(strings.NewReader(body[:strings.LastIndex(body, "--")+1]))), delimiter: []byte("--b--")}
+			io.Copy(io.Discard, d)
+			if d.seen {
+				t.Errorf("%s reads of %q: close delimiter seen in truncated body", name, body)
+			}
+		}
+	}
+}
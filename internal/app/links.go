@@ -0,0 +1,56 @@
+package app
+
+import (
+	"net/http"
+	"strings"
+)
+
+// pageLinks configures the Link headers of paginated listings.
+type pageLinks struct {
+	// baseURL is prepended to the links; empty links are relative to the
+	// request.
+	baseURL string
+}
+
+// setPageLinks adds RFC 8288 Link headers to a listing page: rel="next" with
+// nextToken, rel="first" on later pages and rel="prev" where the previous
+// page is known. DynamoDB pages only run forward, so the next link carries
+// the current token as prev_token; a page reached through a prev link has no
+// prev link of its own.
+func (s *Service) setPageLinks(w http.ResponseWriter, r *http.Request, nextToken string) {
+	if s.pageLinks == nil {
+		return
+	}
+	query := r.URL.Query()
+	current := query.Get("next_token")
+	link := func(token string, prev *string) string {
+		q := r.URL.Query()
+		q.Del("next_token")
+		q.Del("prev_token")
+		if token != "" {
+			q.Set("next_token", token)
+		}
+		if prev != nil {
+			q.Set("prev_token", *prev)
+		}
+		u := s.pageLinks.baseURL + r.URL.Path
+		if encoded := q.Encode(); encoded != "" {
+			u += "?" + encoded
+		}
+		return u
+	}
+
+	var links []string
+	if nextToken != "" {
+		links = append(links, `<`+link(nextToken, &current)+`>; rel="next"`)
+	}
+	if query.Has("prev_token") {
+		links = append(links, `<`+link(query.Get("prev_token"), nil)+`>; rel="prev"`)
+	}
+	if current != "" {
+		links = append(links, `<`+link("", nil)+`>; rel="first"`)
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+}
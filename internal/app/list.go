@@ -0,0 +1,156 @@
+package app
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 1000
+)
+
+// ListedFile is one entry of a file listing. PresignedURL and URLs are only
+// filled in when the listing was requested with ?with_urls=true; otherwise
+// Self links to the file's GetFile endpoint, which returns them.
+type ListedFile struct {
+	Metadata     *FileMetadata     `json:"metadata"`
+	Self         string            `json:"self"`
+	PresignedURL string            `json:"presigned_url,omitempty"`
+	URLs         map[string]string `json:"urls,omitempty"`
+}
+
+type ListFilesResponse struct {
+	Files     []ListedFile `json:"files"`
+	NextToken string       `json:"next_token,omitempty"`
+}
+
+// ListFiles pages through the caller's files. Signing URLs costs a little for
+// every item, so it is opt-in with ?with_urls=true.
+func (s *Service) ListFiles(w http.ResponseWriter, r *http.Request) {
+	limit, err := pageSize(r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	startKey, err := decodePageToken(r.URL.Query().Get("next_token"))
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	withURLs := r.URL.Query().Get("with_urls") == "true"
+
+	input := &dynamodb.ScanInput{
+		TableName:                aws.String(s.dbFileTableName),
+		Limit:                    aws.Int64(limit),
+		ExclusiveStartKey:        startKey,
+		ExpressionAttributeNames: map[string]*string{},
+	}
+	values := map[string]*dynamodb.AttributeValue{}
+	input.FilterExpression = s.listFilter(r, input.ExpressionAttributeNames, values)
+	if len(values) > 0 {
+		input.ExpressionAttributeValues = values
+	}
+	result, err := s.db.ScanWithContext(r.Context(), input)
+	if err != nil {
+		s.writeError(w, r, fmt.Errorf("failed to scan DynamoDB: %w", err))
+		return
+	}
+
+	response, err := s.listResponse(r, result.Items, result.LastEvaluatedKey, withURLs)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	s.setPageLinks(w, r, response.NextToken)
+	s.writeResponse(w, r, http.StatusOK, response)
+}
+
+// listFilter returns the filter expression selecting the files the caller of
+// r may list: those not soft-deleted and, when there is an owner, the
+// owner's. Its names and values are added to the given maps.
+func (s *Service) listFilter(r *http.Request, names map[string]*string, values map[string]*dynamodb.AttributeValue) *string {
+	filter := "attribute_not_exists(#deleted)"
+	names["#deleted"] = aws.String("DeletedAt")
+	if owner := s.owner(r); owner != "" {
+		filter += " AND (attribute_not_exists(#owner) OR #owner = :owner)"
+		names["#owner"] = aws.String("OwnerID")
+		values[":owner"] = &dynamodb.AttributeValue{S: aws.String(owner)}
+	}
+	return aws.String(filter)
+}
+
+func (s *Service) listResponse(r *http.Request, items []map[string]*dynamodb.AttributeValue, lastKey map[string]*dynamodb.AttributeValue, withURLs bool) (ListFilesResponse, error) {
+	var files []FileMetadata
+	if err := dynamodbattribute.UnmarshalListOfMaps(items, &files); err != nil {
+		return ListFilesResponse{}, fmt.Errorf("failed to unmarshal files: %w", err)
+	}
+
+	response := ListFilesResponse{Files: make([]ListedFile, len(files))}
+	for i := range files {
+		listed := ListedFile{Metadata: s.visibleMetadata(r, &files[i]), Self: "/file/" + files[i].ID}
+		if withURLs {
+			fileResponse, err := s.fileResponse(r.Context(), listed.Metadata, s.presignExpiry)
+			if err != nil {
+				return ListFilesResponse{}, err
+			}
+			listed.PresignedURL = fileResponse.PresignedURL
+			listed.URLs = fileResponse.URLs
+		}
+		response.Files[i] = listed
+	}
+
+	nextToken, err := encodePageToken(lastKey)
+	if err != nil {
+		return ListFilesResponse{}, err
+	}
+	response.NextToken = nextToken
+	return response, nil
+}
+
+func pageSize(r *http.Request) (int64, error) {
+	value := r.URL.Query().Get("limit")
+	if value == "" {
+		return defaultPageSize, nil
+	}
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || limit <= 0 || limit > maxPageSize {
+		return 0, newAPIError(http.StatusBadRequest, "invalid_limit",
+			fmt.Sprintf("limit must be between 1 and %d", maxPageSize))
+	}
+	return limit, nil
+}
+
+// encodePageToken turns a DynamoDB LastEvaluatedKey into an opaque token.
+func encodePageToken(key map[string]*dynamodb.AttributeValue) (string, error) {
+	if len(key) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode page token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodePageToken(token string) (map[string]*dynamodb.AttributeValue, error) {
+	if token == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, "invalid_token", "next_token is malformed")
+	}
+	var key map[string]*dynamodb.AttributeValue
+	if err := json.Unmarshal(b, &key); err != nil {
+		return nil, newAPIError(http.StatusBadRequest, "invalid_token", "next_token is malformed")
+	}
+	return key, nil
+}
@@ -0,0 +1,186 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	uploadReservationKey
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// RequestIDFromContext returns the ID assigned to the request by the service,
+// or an empty string outside of a request.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// requestIDMiddleware reuses a client-supplied X-Request-ID or generates one,
+// echoes it in the response and stores it in the request context.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > 128 {
+			id = uuid.New().String()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// statusRecorder captures the status code and body size written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+type AccessLogFormat int
+
+const (
+	// AccessLogCommon writes one line per request in Common Log Format.
+	AccessLogCommon AccessLogFormat = iota
+	// AccessLogJSON writes one JSON object per request.
+	AccessLogJSON
+)
+
+// accessLogger writes access log records to its own writer, independent of
+// the application logger. Writes are serialized so records never interleave,
+// which lets any io.Writer (a file, stdout, a rotating writer) be used.
+type accessLogger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	format AccessLogFormat
+}
+
+type accessLogRecord struct {
+	Time       string  `json:"time"`
+	RequestID  string  `json:"request_id"`
+	RemoteAddr string  `json:"remote_addr"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Proto      string  `json:"proto"`
+	Status     int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	DurationMS float64 `json:"duration_ms"`
+	UserAgent  string  `json:"user_agent"`
+}
+
+func (l *accessLogger) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		l.write(r, rec, start)
+	})
+}
+
+// clfEscaper escapes the characters that would break up the quoted request
+// line of a Common Log Format entry.
+var clfEscaper = strings.NewReplacer(`"`, `\"`, " ", "%20")
+
+func (l *accessLogger) write(r *http.Request, rec *statusRecorder, start time.Time) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	var line []byte
+	switch l.format {
+	case AccessLogJSON:
+		line, _ = json.Marshal(accessLogRecord{
+			Time:       start.UTC().Format(time.RFC3339Nano),
+			RequestID:  RequestIDFromContext(r.Context()),
+			RemoteAddr: host,
+			Method:     r.Method,
+			Path:       r.URL.RequestURI(),
+			Proto:      r.Proto,
+			Status:     rec.status,
+			Bytes:      rec.bytes,
+			DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+			UserAgent:  r.UserAgent(),
+		})
+	default:
+		size := "-"
+		if rec.bytes > 0 {
+			size = strconv.FormatInt(rec.bytes, 10)
+		}
+		line = fmt.Appendf(nil, "%s - - [%s] \"%s %s %s\" %d %s",
+			host,
+			start.Format("02/Jan/2006:15:04:05 -0700"),
+			clfEscaper.Replace(r.Method),
+			clfEscaper.Replace(r.URL.RequestURI()),
+			clfEscaper.Replace(r.Proto),
+			rec.status,
+			size,
+		)
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(line)
+}
+
+// defaultSecurityHeaders are set on every response unless overridden with
+// WithSecurityHeader. There is no default Content-Security-Policy, since the
+// right policy depends on what is served next to the API.
+var defaultSecurityHeaders = map[string]string{
+	"X-Content-Type-Options": "nosniff",
+	"X-Frame-Options":        "DENY",
+	"Referrer-Policy":        "no-referrer",
+}
+
+func securityHeadersMiddleware(headers map[string]string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range headers {
+			w.Header().Set(name, value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,42 @@
+package app
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCommonAccessLogLine(t *testing.T) {
+	tests := []struct {
+		name string
+		uri  string
+		body string
+		want string
+	}{
+		{"plain", "/file/abc", "hello", `"GET /file/abc HTTP/1.1" 200 5`},
+		{"no body", "/file/abc", "", `"GET /file/abc HTTP/1.1" 200 -`},
+		{"quote", `/file/a"b`, "", `"GET /file/a\"b HTTP/1.1" 200 -`},
+		{"space", "/file/a b", "", `"GET /file/a%20b HTTP/1.1" 200 -`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			l := &accessLogger{out: &out, format: AccessLogCommon}
+			handler := l.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.body))
+			}))
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			// An opaque URL is written out as is, so unescaped characters
+			// reach the log.
+			r.URL.Opaque = tt.uri
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+
+			line := strings.TrimSuffix(out.String(), "\n")
+			if !strings.HasPrefix(line, "192.0.2.1 - - [") || !strings.HasSuffix(line, "] "+tt.want) {
+				t.Errorf("access log line %q, want it to end in %q", line, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"mime"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// MigrateOptions controls Migrate.
+type MigrateOptions struct {
+	// DryRun reports what would change without writing.
+	DryRun bool
+	// Dimensions also downloads images without Width/Height to measure
+	// them, which costs a GetObject per row.
+	Dimensions bool
+	// ContentTypes also fixes objects stored without a proper Content-Type,
+	// which costs a HeadObject per row.
+	ContentTypes bool
+	// StartToken resumes a previous run from its last checkpoint.
+	StartToken string
+	// Checkpoint, if set, is called with a token after every finished page.
+	// Passing the last token as StartToken continues from there.
+	Checkpoint func(token string) error
+}
+
+// MigrateReport counts the rows Migrate looked at.
+type MigrateReport struct {
+	Scanned int `json:"scanned"`
+	Updated int `json:"updated"`
+	// Failed rows are logged and left unchanged; running again retries them.
+	Failed int `json:"failed"`
+}
+
+// Migrate backfills attributes introduced after rows were written: Key,
+// Kind, Size (from HeadObject) and optionally Width and Height. Only missing
+// attributes are set, so it is safe to run repeatedly. With ContentTypes it
+// also gives objects S3 serves as octet-stream the content type of their
+// extension.
+func (s *Service) Migrate(ctx context.Context, opts MigrateOptions) (*MigrateReport, error) {
+	startKey, err := decodePageToken(opts.StartToken)
+	if err != nil {
+		return nil, err
+	}
+	report := &MigrateReport{}
+	for {
+		page, err := s.db.ScanWithContext(ctx, &dynamodb.ScanInput{
+			TableName:         aws.String(s.dbFileTableName),
+			ExclusiveStartKey: startKey,
+		})
+		if err != nil {
+			return report, fmt.Errorf("failed to scan DynamoDB: %w", err)
+		}
+		var files []FileMetadata
+		if err := dynamodbattribute.UnmarshalListOfMaps(page.Items, &files); err != nil {
+			return report, fmt.Errorf("failed to unmarshal files: %w", err)
+		}
+		for i := range files {
+			report.Scanned++
+			updated, err := s.migrateFile(ctx, &files[i], opts)
+			if err != nil {
+				s.logger.Warn("migration failed", "id", files[i].ID, "error", err)
+				report.Failed++
+				continue
+			}
+			if updated {
+				report.Updated++
+			}
+		}
+
+		if len(page.LastEvaluatedKey) == 0 {
+			return report, nil
+		}
+		startKey = page.LastEvaluatedKey
+		if opts.Checkpoint != nil {
+			token, err := encodePageToken(startKey)
+			if err != nil {
+				return report, err
+			}
+			if err := opts.Checkpoint(token); err != nil {
+				return report, fmt.Errorf("failed to save checkpoint: %w", err)
+			}
+		}
+	}
+}
+
+// migrateFile fills in the missing attributes of one row and reports
+// whether it changed.
+func (s *Service) migrateFile(ctx context.Context, metadata *FileMetadata, opts MigrateOptions) (bool, error) {
+	set := make(map[string]*dynamodb.AttributeValue)
+	key := objectKey(metadata)
+	if metadata.Key == "" {
+		set["Key"] = &dynamodb.AttributeValue{S: aws.String(key)}
+	}
+	if metadata.Kind == "" {
+		set["Kind"] = &dynamodb.AttributeValue{S: aws.String(fileKind)}
+	}
+	// The size of compressed objects is only known after decompressing.
+	needSize := metadata.Size == 0 && metadata.ContentEncoding == ""
+	needDimensions := opts.Dimensions && metadata.Width == 0
+
+	if needSize {
+		head, err := s.fileStorage.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(s.fileStorageBucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return false, fmt.Errorf("failed to head object: %w", err)
+		}
+		set["Size"] = numberAttribute(aws.Int64Value(head.ContentLength))
+	}
+	if needDimensions {
+		width, height, err := s.objectDimensions(ctx, key)
+		if err != nil {
+			return false, err
+		}
+		set["Width"] = numberAttribute(int64(width))
+		set["Height"] = numberAttribute(int64(height))
+	}
+	fixedContentType := false
+	if opts.ContentTypes {
+		contentType := metadata.ContentType
+		if contentType == "" {
+			contentType = mime.TypeByExtension(strings.ToLower(metadata.Extension))
+			if contentType != "" {
+				set["ContentType"] = &dynamodb.AttributeValue{S: aws.String(contentType)}
+			}
+		}
+		var err error
+		if fixedContentType, err = s.fixContentType(ctx, key, contentType, opts.DryRun); err != nil {
+			return false, err
+		}
+	}
+	if len(set) == 0 {
+		return fixedContentType, nil
+	}
+	if opts.DryRun {
+		s.logger.Info("would migrate", "id", metadata.ID, "attributes", attributeNames(set))
+		return true, nil
+	}
+
+	var assignments []string
+	names := make(map[string]*string, len(set))
+	values := make(map[string]*dynamodb.AttributeValue, len(set))
+	for name, value := range set {
+		assignments = append(assignments, "#"+name+" = :"+name)
+		names["#"+name] = aws.String(name)
+		values[":"+name] = value
+	}
+	_, err := s.db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(s.dbFileTableName),
+		Key:                       map[string]*dynamodb.AttributeValue{"ID": {S: aws.String(metadata.ID)}},
+		UpdateExpression:          aws.String("SET " + strings.Join(assignments, ", ")),
+		ConditionExpression:       aws.String("attribute_exists(ID)"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			// Deleted while migrating; nothing to do.
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to update item: %w", err)
+	}
+	if s.metadataCache != nil {
+		s.metadataCache.remove(metadata.ID)
+	}
+	return true, nil
+}
+
+// isGenericContentType reports whether S3 has no real content type for an
+// object: it reports binary/octet-stream for objects stored without one.
+func isGenericContentType(contentType string) bool {
+	switch contentType {
+	case "", "binary/octet-stream", "application/octet-stream":
+		return true
+	}
+	return false
+}
+
+// fixContentType sets contentType on the object at key if S3 serves it with
+// a generic one, by copying the object onto itself with replaced metadata.
+// The other headers are carried over, and the copy only happens if the
+// object is unchanged since it was inspected.
+func (s *Service) fixContentType(ctx context.Context, key, contentType string, dryRun bool) (bool, error) {
+	if isGenericContentType(contentType) {
+		return false, nil
+	}
+	head, err := s.fileStorage.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.fileStorageBucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to head object: %w", err)
+	}
+	if !isGenericContentType(aws.StringValue(head.ContentType)) {
+		return false, nil
+	}
+	if dryRun {
+		s.logger.Info("would set content type", "key", key, "content_type", contentType)
+		return true, nil
+	}
+
+	input := &s3.CopyObjectInput{
+		Bucket:             aws.String(s.fileStorageBucket),
+		Key:                aws.String(key),
+		CopySource:         aws.String(url.PathEscape(s.fileStorageBucket + "/" + key)),
+		CopySourceIfMatch:  head.ETag,
+		MetadataDirective:  aws.String(s3.MetadataDirectiveReplace),
+		ContentType:        aws.String(contentType),
+		ContentEncoding:    head.ContentEncoding,
+		ContentDisposition: head.ContentDisposition,
+		CacheControl:       head.CacheControl,
+		Metadata:           head.Metadata,
+	}
+	if s.s3Checksum {
+		input.ChecksumAlgorithm = aws.String(s3.ChecksumAlgorithmSha256)
+	}
+	if _, err := s.fileStorage.CopyObjectWithContext(ctx, input); err != nil {
+		return false, fmt.Errorf("failed to copy object: %w", err)
+	}
+	if s.diskCache != nil {
+		s.diskCache.remove(key)
+	}
+	return true, nil
+}
+
+// objectDimensions reads just enough of the object to decode the image
+// header.
+func (s *Service) objectDimensions(ctx context.Context, key string) (int, int, error) {
+	object, err := s.fileStorage.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.fileStorageBucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get object: %w", err)
+	}
+	defer object.Body.Close()
+
+	var body io.Reader = object.Body
+	if aws.StringValue(object.ContentEncoding) == "gzip" {
+		gz, err := gzip.NewReader(object.Body)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to decompress object: %w", err)
+		}
+		defer gz.Close()
+		body = gz
+	}
+	config, _, err := image.DecodeConfig(body)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to decode image: %w", err)
+	}
+	return config.Width, config.Height, nil
+}
+
+// imageDimensions returns the width and height of an image, or zeros if
+// data can't be decoded.
+func imageDimensions(data []byte) (int, int) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0
+	}
+	return config.Width, config.Height
+}
+
+func numberAttribute(n int64) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(n, 10))}
+}
+
+func attributeNames(set map[string]*dynamodb.AttributeValue) []string {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,80 @@
+package app
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// multipartETag computes the ETag S3 gives an object uploaded by the
+// s3manager uploader: the hex MD5 of the content for a single PutObject, or,
+// for a multipart upload, the hex MD5 of the concatenated binary MD5s of the
+// parts followed by "-<number of parts>". The uploader's part boundaries are
+// reproduced from its part size.
+type multipartETag struct {
+	partSize int64
+	// streamed is set for bodies of unknown size, which the uploader reads
+	// part by part: it then uses multipart as soon as a full part was read.
+	streamed bool
+	part     hash.Hash
+	partLen  int64
+	sums     []byte
+	parts    int
+}
+
+// newMultipartETag starts the ETag of a body of size bytes, or of unknown
+// size if size is negative, uploaded with partSize.
+func newMultipartETag(partSize, size int64) *multipartETag {
+	if size >= 0 && size/partSize >= s3manager.MaxUploadParts {
+		// The uploader grows the part size to fit bodies of known size
+		// into the maximum number of parts.
+		partSize = size/s3manager.MaxUploadParts + 1
+	}
+	return &multipartETag{partSize: partSize, streamed: size < 0, part: md5.New()}
+}
+
+func (e *multipartETag) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		n := min(int64(len(p)), e.partSize-e.partLen)
+		e.part.Write(p[:n])
+		e.partLen += n
+		p = p[n:]
+		if e.partLen == e.partSize {
+			e.endPart()
+		}
+	}
+	return written, nil
+}
+
+func (e *multipartETag) endPart() {
+	e.sums = e.part.Sum(e.sums)
+	e.parts++
+	e.part.Reset()
+	e.partLen = 0
+}
+
+// sum returns the ETag, without the quotes S3 puts around it.
+func (e *multipartETag) sum() string {
+	fullParts := e.parts
+	if e.partLen > 0 || e.parts == 0 {
+		e.endPart()
+	}
+	// A body of known size fitting into one part is sent with PutObject; a
+	// streamed one only if the first part wasn't filled.
+	if e.parts == 1 && (!e.streamed || fullParts == 0) {
+		return hex.EncodeToString(e.sums)
+	}
+	sum := md5.Sum(e.sums)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), e.parts)
+}
+
+// objectETag is the ETag S3 gives data uploaded with partSize.
+func objectETag(data []byte, partSize int64) string {
+	etag := newMultipartETag(partSize, int64(len(data)))
+	etag.Write(data)
+	return etag.sum()
+}
@@ -0,0 +1,837 @@
+package app
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Option configures optional Service behavior.
+type Option func(*Service)
+
+// WithDedup controls whether uploads whose content the owner already stored
+// return the existing file (the default). Disabled, every upload creates a
+// new object and metadata row, and the table needs no HashIndex. Hashes are
+// still stored, and WithUploadDedupWindow still answers repeated uploads
+// from memory.
+func WithDedup(enabled bool) Option {
+	return func(s *Service) {
+		s.dedup = enabled
+	}
+}
+
+// WithBatchDedup controls whether files repeated within a single batch upload
+// are detected by hash and collapsed to one stored object. Enabled by default.
+func WithBatchDedup(enabled bool) Option {
+	return func(s *Service) {
+		s.batchDedup = enabled
+	}
+}
+
+// WithBatchConcurrency sets how many files of a batch upload or delete are
+// processed at once. Defaults to 4; 1 processes them one after another.
+func WithBatchConcurrency(n int) Option {
+	return func(s *Service) {
+		s.batchConcurrency = n
+	}
+}
+
+// WithSlowDownBackoff retries S3 calls answered with 503 SlowDown with
+// exponential, jittered backoff that adapts to how often S3 pushes back.
+// Calls still failing get 503 slow_down with Retry-After.
+func WithSlowDownBackoff(backoff SlowDownBackoff) Option {
+	return func(s *Service) {
+		s.slowDownBackoff = &backoff
+	}
+}
+
+// WithUploaderInfo stores the client IP and User-Agent of each upload with
+// the file. The IP is taken from X-Forwarded-For only for requests arriving
+// from trustedProxies. Off by default.
+func WithUploaderInfo(trustedProxies ...netip.Prefix) Option {
+	return func(s *Service) {
+		s.uploaderInfo = &uploaderInfo{trustedProxies: trustedProxies}
+	}
+}
+
+// WithFlagMissingObjects marks a file's row with ObjectMissingAt when
+// GET /file/{id}?verify=true finds its object missing, so that such files
+// can be found and reconciled later.
+func WithFlagMissingObjects(enabled bool) Option {
+	return func(s *Service) {
+		s.flagMissingObjects = enabled
+	}
+}
+
+// WithMaxDownloadsPerFile limits how many downloads of the same file are
+// streamed from S3 at once; more are rejected with 503 and Retry-After.
+// Downloads served from the disk cache don't count. Unlimited by default.
+func WithMaxDownloadsPerFile(n int) Option {
+	return func(s *Service) {
+		s.downloadLimiter = newDownloadLimiter(n)
+	}
+}
+
+// WithTagSchema restricts tags to the keys of schema, with values of the
+// given type or from the given list, on uploads and tag updates. Violations
+// are rejected with 400 invalid_tags naming the offending keys.
+func WithTagSchema(schema TagSchema) Option {
+	return func(s *Service) {
+		s.tagSchema = schema
+	}
+}
+
+// WithPaginationLinks adds Link headers with the next, previous and first
+// pages to file listings. baseURL, e.g. "https://files.example.com", makes
+// the links absolute; empty leaves them relative to the request.
+func WithPaginationLinks(baseURL string) Option {
+	return func(s *Service) {
+		s.pageLinks = &pageLinks{baseURL: strings.TrimSuffix(baseURL, "/")}
+	}
+}
+
+// WithAsyncProcessing makes CreateFile store the original and answer 202,
+// leaving the blur hash, dominant color and post-upload hooks to a pool of
+// workers fed by a queue of up to queueSize files.
+func WithAsyncProcessing(workers, queueSize int) Option {
+	return func(s *Service) {
+		s.processing = &processingPool{workers: workers, queueSize: queueSize}
+	}
+}
+
+// WithNotReadyConflict makes GetFile answer 409 file_not_ready for files
+// whose background processing hasn't finished, instead of their metadata
+// without URLs.
+func WithNotReadyConflict(enabled bool) Option {
+	return func(s *Service) {
+		s.notReadyConflict = enabled
+	}
+}
+
+// WithBackgroundReconcile runs Reconcile with opts every interval while the
+// service runs. Deleting orphans requires MinAge and MaxDeletes.
+func WithBackgroundReconcile(interval time.Duration, opts ReconcileOptions) Option {
+	return func(s *Service) {
+		s.reconciler = &backgroundReconcile{interval: interval, opts: opts}
+	}
+}
+
+// WithMetadataRetryQueue keeps uploaded objects whose metadata write fails,
+// queueing the write in a bbolt file at path and retrying it every interval
+// (backing off while it keeps failing) instead of deleting the object.
+func WithMetadataRetryQueue(path string, interval time.Duration) Option {
+	return func(s *Service) {
+		s.metadataRetries = &metadataRetryQueue{path: path, interval: interval}
+	}
+}
+
+// WithRequestDeadline bounds the total duration of every request, body and
+// AWS calls included, and lets clients ask for a shorter or longer one with
+// X-Request-Timeout up to deadline.Max. Requests running out get 504.
+func WithRequestDeadline(deadline RequestDeadline) Option {
+	return func(s *Service) {
+		s.deadline = &deadline
+	}
+}
+
+// WithImageDimensions rejects uploads whose width or height is outside
+// bounds with 422 image_dimensions_out_of_range. Only the image header is
+// read for the check.
+func WithImageDimensions(bounds DimensionBounds) Option {
+	return func(s *Service) {
+		s.dimensionBounds = bounds
+	}
+}
+
+// WithImmutableDownloads sends Cache-Control: public, max-age=<maxAge>,
+// immutable (private for owned files) with successful downloads, so that
+// browsers and CDNs keep the bytes without revalidating. Off by default.
+func WithImmutableDownloads(maxAge time.Duration) Option {
+	return func(s *Service) {
+		s.immutableMaxAge = maxAge
+	}
+}
+
+// WithStreamingUploads streams uploads larger than threshold bytes, or of
+// unknown size, to S3 instead of buffering them, and deduplicates them once
+// the upload has finished. Zero (the default) buffers every upload.
+func WithStreamingUploads(threshold int64) Option {
+	return func(s *Service) {
+		s.streamThreshold = threshold
+	}
+}
+
+// WithKeyPrefix places every new object under prefix, e.g. "uploads/".
+func WithKeyPrefix(prefix string) Option {
+	return func(s *Service) {
+		s.keyPrefix = prefix
+	}
+}
+
+// WithExtensionKeyPrefixes places new objects under a prefix chosen by their
+// extension, e.g. {".jpg": "images/jpg/"}. Extensions are matched
+// case-insensitively, with or without the dot; others use WithKeyPrefix.
+func WithExtensionKeyPrefixes(prefixes map[string]string) Option {
+	return func(s *Service) {
+		s.extensionKeyPrefixes = make(map[string]string, len(prefixes))
+		for ext, prefix := range prefixes {
+			ext = strings.ToLower(ext)
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			s.extensionKeyPrefixes[ext] = prefix
+		}
+	}
+}
+
+// WithErrorMasking controls whether 5xx responses hide the underlying error
+// behind a generic message (on by default). Turn it off for local
+// development to see AWS errors in responses.
+func WithErrorMasking(enabled bool) Option {
+	return func(s *Service) {
+		s.maskErrors = enabled
+	}
+}
+
+// WithHashScan looks up files by content hash with a table scan instead of
+// querying HashIndex, so the table needs no index. Every upload then reads
+// the whole table; this only suits small datasets.
+func WithHashScan(enabled bool) Option {
+	return func(s *Service) {
+		s.hashScan = enabled
+	}
+}
+
+// WithTableBilling sets how the metadata table is billed if
+// EnsureInfrastructure creates it (on-demand by default).
+func WithTableBilling(billing TableBilling) Option {
+	return func(s *Service) {
+		s.tableBilling = billing
+	}
+}
+
+// WithKeyStrategy sets how new objects are named. KeyStrategyContentHash
+// stores identical content once, however many files refer to it.
+func WithKeyStrategy(strategy KeyStrategy) Option {
+	return func(s *Service) {
+		s.keyStrategy = strategy
+	}
+}
+
+// WithReservedKeyPrefixes replaces the key prefixes reserved for internal use.
+// Client input resolving to a key or ID under one of them is rejected with 400.
+func WithReservedKeyPrefixes(prefixes ...string) Option {
+	return func(s *Service) {
+		s.reservedKeyPrefixes = prefixes
+	}
+}
+
+// WithRetryAfter sets the Retry-After sent with 429, 503 and 504 responses.
+func WithRetryAfter(d time.Duration) Option {
+	return func(s *Service) {
+		s.retryAfter = d
+	}
+}
+
+// WithLogger sets the application logger. Defaults to slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Service) {
+		s.logger = logger
+	}
+}
+
+// WithAccessLog writes one access log record per request to out, separately
+// from the application logger. out may be any io.Writer, such as os.Stdout, a
+// file, or a rotating writer like lumberjack.Logger.
+func WithAccessLog(out io.Writer, format AccessLogFormat) Option {
+	return func(s *Service) {
+		s.accessLog = &accessLogger{out: out, format: format}
+	}
+}
+
+// WithRequireFilename controls whether uploads must have a filename with an
+// extension (rejected with 400 missing_filename otherwise). Enabled by default;
+// when disabled, nameless uploads get the extension of their sniffed type.
+func WithRequireFilename(required bool) Option {
+	return func(s *Service) {
+		s.requireFilename = required
+	}
+}
+
+// WithContentTypeOverrides lets multipart uploads choose the stored content
+// type with a "content_type" form field, among the overrides listed for the
+// type the content was sniffed as.
+func WithContentTypeOverrides(overrides ContentTypeOverrides) Option {
+	return func(s *Service) {
+		s.contentTypeOverrides = overrides
+	}
+}
+
+// WithExtensionSource selects where the stored extension comes from. The
+// default, ExtensionFromFilename, uses the uploaded filename;
+// ExtensionFromContentType derives it from the sniffed content type so that
+// stored extensions never depend on what the client named the file.
+func WithExtensionSource(source ExtensionSource) Option {
+	return func(s *Service) {
+		s.extensionSource = source
+	}
+}
+
+// WithPresignedDisposition makes the presigned URLs of GetFile carry a
+// Content-Disposition of dispositionType ("inline" or "attachment") with the
+// original filename, and the stored Content-Type, as if ?disposition= was
+// passed.
+func WithPresignedDisposition(dispositionType string) Option {
+	return func(s *Service) {
+		s.presignDisposition = dispositionType
+	}
+}
+
+// WithPresignExpiry sets the default lifetime of presigned URLs (15 minutes).
+func WithPresignExpiry(d time.Duration) Option {
+	return func(s *Service) {
+		s.presignExpiry = d
+	}
+}
+
+// WithRedirectExpiry sets the lifetime of the presigned URL that
+// GET /file/{id}?redirect=true redirects to (1 minute).
+func WithRedirectExpiry(d time.Duration) Option {
+	return func(s *Service) {
+		s.redirectExpiry = d
+	}
+}
+
+// WithMaxPresignExpiry caps the lifetime clients may request with
+// ?expires_in=. It cannot exceed the 7 day SigV4 limit.
+func WithMaxPresignExpiry(d time.Duration) Option {
+	return func(s *Service) {
+		s.maxPresignExpiry = d
+	}
+}
+
+// WithPrincipalFunc sets how the caller's identity is read from a request,
+// e.g. from a header set by an authenticating proxy or from claims an auth
+// middleware stored in the request context.
+func WithPrincipalFunc(fn func(*http.Request) string) Option {
+	return func(s *Service) {
+		s.principalFunc = fn
+	}
+}
+
+// WithUploadDrainTimeout sets how long uploads in flight at shutdown may
+// take to finish before they are cancelled (30 seconds).
+func WithUploadDrainTimeout(d time.Duration) Option {
+	return func(s *Service) {
+		s.uploadDrainTimeout = d
+	}
+}
+
+// WithUploadDedupWindow answers an upload of content the same owner stored
+// within the last window with the earlier file, without looking it up in
+// DynamoDB. It guards against double submits from UIs and retries.
+func WithUploadDedupWindow(window time.Duration) Option {
+	return func(s *Service) {
+		s.dedupWindow = newDedupWindow(window)
+	}
+}
+
+// WithDebugStats serves the counters of upload, deduplication and cache
+// events since start at GET /debug/stats.
+func WithDebugStats(enabled bool) Option {
+	return func(s *Service) {
+		s.debugStats = enabled
+	}
+}
+
+// WithUniqueFilenames sets what happens when an owner uploads a file under a
+// name already in use. Any policy but FilenamesAllowDuplicates needs the
+// OwnerNameIndex, which EnsureInfrastructure creates with the table.
+func WithUniqueFilenames(policy FilenamePolicy) Option {
+	return func(s *Service) {
+		s.filenamePolicy = policy
+	}
+}
+
+// WithLocationFields adds the bucket and region that a file's URLs point to
+// to file responses, as backend ("s3://<bucket>") and region.
+func WithLocationFields(enabled bool) Option {
+	return func(s *Service) {
+		s.locationFields = enabled
+	}
+}
+
+// WithDownloadTokens adds a download_url to file responses: a link to
+// GET /file/{id}/download signed with key (at least 32 bytes), which works
+// without authentication until it expires. Instances sharing traffic must
+// share the key.
+func WithDownloadTokens(key []byte) Option {
+	return func(s *Service) {
+		s.downloadTokenKey = key
+	}
+}
+
+// WithSoftDelete makes deletes only mark files as deleted, keeping their
+// objects and metadata until they are purged with POST /admin/purge.
+func WithSoftDelete(enabled bool) Option {
+	return func(s *Service) {
+		s.softDelete = enabled
+	}
+}
+
+// WithAdmins allows the given principals (see WithPrincipalFunc) to use the
+// admin routes. Everyone else gets 403.
+func WithAdmins(principals ...string) Option {
+	return func(s *Service) {
+		if s.admins == nil {
+			s.admins = make(map[string]struct{}, len(principals))
+		}
+		for _, principal := range principals {
+			s.admins[principal] = struct{}{}
+		}
+	}
+}
+
+// WithAdminFunc additionally treats callers for which fn returns true as
+// admins, e.g. based on a scope or claim an auth middleware stored in the
+// request context.
+func WithAdminFunc(fn func(*http.Request) bool) Option {
+	return func(s *Service) {
+		s.adminFunc = fn
+	}
+}
+
+// WithAuditSink additionally persists audit records of deletes, e.g. to a
+// DynamoDBAuditSink. Audit records are always written to the logger.
+func WithAuditSink(sink AuditSink) Option {
+	return func(s *Service) {
+		s.auditSink = sink
+	}
+}
+
+// WithNearDuplicateDetection rejects uploads that look like a recent upload:
+// a perceptual hash (dHash) is computed for each new image and, when it is
+// within maxDistance bits of one of the last window files stored by this
+// instance, the existing file is returned as if it were an exact duplicate.
+// Disabled by default because it decodes every upload.
+func WithNearDuplicateDetection(maxDistance, window int) Option {
+	return func(s *Service) {
+		s.nearDuplicateDistance = maxDistance
+		s.recentPerceptualHashes = newRecentPerceptualHashes(window)
+	}
+}
+
+// WithMaxUploadSize rejects upload requests with bodies larger than n bytes
+// with 413. Unlimited by default.
+func WithMaxUploadSize(n int64) Option {
+	return func(s *Service) {
+		s.maxUploadSize = n
+	}
+}
+
+// WithRequireContentLength rejects upload requests without a Content-Length,
+// e.g. chunked ones, with 411, so that the size limit and the memory budget
+// are applied before the body is read.
+func WithRequireContentLength(required bool) Option {
+	return func(s *Service) {
+		s.requireContentLength = required
+	}
+}
+
+// WithUploadMemoryBudget caps the bytes held by all concurrent uploads at
+// capacity, weighting each upload by its Content-Length. Uploads that don't fit
+// wait up to queueTimeout and are then rejected with 503.
+func WithUploadMemoryBudget(capacity int64, queueTimeout time.Duration) Option {
+	return func(s *Service) {
+		s.uploadBudget = newUploadMemoryBudget(capacity, queueTimeout)
+	}
+}
+
+// WithMaxConcurrentPresigns caps the number of URLs signed at once across
+// all requests at max. Presigns that don't get a slot wait up to queueTimeout
+// and then fail the request with 503. Presign cache hits don't count.
+func WithMaxConcurrentPresigns(max int64, queueTimeout time.Duration) Option {
+	return func(s *Service) {
+		s.presignLimiter = newPresignLimiter(max, queueTimeout)
+	}
+}
+
+// WithIDGenerator sets the generator of new file IDs. Defaults to random
+// UUIDs.
+func WithIDGenerator(g IDGenerator) Option {
+	return func(s *Service) {
+		s.idGenerator = g
+	}
+}
+
+// WithClock sets the clock of the timestamps stored in metadata. Defaults to
+// the system clock.
+func WithClock(c Clock) Option {
+	return func(s *Service) {
+		s.clock = c
+	}
+}
+
+// WithMultipartMaxMemory sets how many bytes of a multipart upload form are
+// held in memory; larger file parts are spooled to temporary files. Defaults
+// to 32 MB.
+func WithMultipartMaxMemory(n int64) Option {
+	return func(s *Service) {
+		s.multipartMaxMemory = n
+	}
+}
+
+// WithEventFormat sets the format of published file events, EventFormatRaw
+// by default. source is the CloudEvents source, a URI reference identifying the
+// service instance; it defaults to the service name.
+func WithEventFormat(format EventFormat, source string) Option {
+	return func(s *Service) {
+		s.eventFormat = format
+		s.eventSource = source
+	}
+}
+
+// WithEventPublishers publishes an event to each publisher whenever a file
+// is stored, deleted or restored, encoded as set with WithEventFormat.
+func WithEventPublishers(publishers ...EventPublisher) Option {
+	return func(s *Service) {
+		s.eventPublishers = append(s.eventPublishers, publishers...)
+	}
+}
+
+// WithStrictJSON controls whether JSON request bodies with unknown fields are
+// rejected with 400 (the default) or the unknown fields are ignored.
+func WithStrictJSON(strict bool) Option {
+	return func(s *Service) {
+		s.strictJSON = strict
+	}
+}
+
+// WithDefaultOwner attributes uploads to owner when the request has no
+// authenticated principal (see WithPrincipalFunc). In single-tenant
+// deployments without auth this makes every caller the same owner.
+func WithDefaultOwner(owner string) Option {
+	return func(s *Service) {
+		s.defaultOwner = owner
+	}
+}
+
+// WithS3Checksum sends the upload's SHA-256 with PutObject so S3 validates the
+// bytes it receives and stores the checksum alongside the object.
+func WithS3Checksum(enabled bool) Option {
+	return func(s *Service) {
+		s.s3Checksum = enabled
+	}
+}
+
+// WithDegradedReads keeps GetFile working while DynamoDB is unavailable: the
+// metadata of up to size recently read or written files is remembered, and
+// when a DynamoDB read fails, a copy no older than maxAge is served with
+// "degraded": true. Presigned URLs only need S3, so they keep working.
+func WithDegradedReads(size int, maxAge time.Duration) Option {
+	return func(s *Service) {
+		s.metadataCache = newMetadataCache(size, maxAge)
+	}
+}
+
+// WithSecondaryStorage adds a read-only fallback bucket, such as a
+// cross-region replica of the primary bucket. When the primary can't serve an
+// object, presigned URLs and checksums come from the secondary instead.
+// Writes always go to the primary.
+func WithSecondaryStorage(client *s3.S3, bucket string) Option {
+	return func(s *Service) {
+		s.secondaryStore = &objectStore{
+			client: client,
+			bucket: bucket,
+			region: aws.StringValue(client.Config.Region),
+		}
+	}
+}
+
+// WithLowercaseExtensions controls whether filename extensions are lowercased
+// before they are used in object keys and metadata, so "PHOTO.JPG" and
+// "photo.jpg" are stored alike. Enabled by default.
+func WithLowercaseExtensions(enabled bool) Option {
+	return func(s *Service) {
+		s.lowercaseExtensions = enabled
+	}
+}
+
+// WithUploadBodyTimeout bounds how long upload endpoints wait for the request
+// body to arrive. Slower clients get 408 Request Timeout. Other routes are not
+// affected.
+func WithUploadBodyTimeout(d time.Duration) Option {
+	return func(s *Service) {
+		s.uploadBodyTimeout = d
+	}
+}
+
+// WithCompression gzips uploads of the given content types (e.g.
+// "image/svg+xml", "application/json") before storing them, with
+// Content-Encoding: gzip so browsers decompress them transparently. Image
+// formats that are already compressed are never gzipped.
+func WithCompression(contentTypes ...string) Option {
+	return func(s *Service) {
+		s.compressTypes = make(map[string]bool, len(contentTypes))
+		for _, contentType := range contentTypes {
+			s.compressTypes[contentType] = true
+		}
+	}
+}
+
+// WithMaxFilenameLength limits stored original filenames to n bytes (255 by
+// default). Longer names are rejected with 400, or truncated before the
+// extension when truncate is true.
+func WithMaxFilenameLength(n int, truncate bool) Option {
+	return func(s *Service) {
+		s.maxFilenameLength = n
+		s.truncateFilenames = truncate
+	}
+}
+
+// WithDebugCapture writes a JSON record of every upload request that fails
+// with a 4xx or 5xx status to out: request line, headers and the first
+// maxBodyBytes of the body. The values of redactHeaders are replaced with
+// [REDACTED]; without any, DefaultRedactedHeaders are. Off by default; meant
+// for diagnosing malformed client uploads.
+func WithDebugCapture(out io.Writer, maxBodyBytes int, redactHeaders ...string) Option {
+	return func(s *Service) {
+		s.debugCapture = newDebugCapture(out, maxBodyBytes, redactHeaders)
+	}
+}
+
+// WithEpochTimestamps additionally stores CreatedAt and UpdatedAt as epoch
+// seconds (CreatedAtEpoch, UpdatedAtEpoch) so they can be used in numeric
+// range conditions and as a TTL base. Responses keep the RFC 3339 strings.
+func WithEpochTimestamps(enabled bool) Option {
+	return func(s *Service) {
+		s.epochTimestamps = enabled
+	}
+}
+
+// WithCreatedAtIndex sets the name of the GSI (partition key Kind, sort key
+// CreatedAt) used by GET /files/by-date. Defaults to "CreatedAtIndex".
+func WithCreatedAtIndex(name string) Option {
+	return func(s *Service) {
+		s.createdAtIndex = name
+	}
+}
+
+// WithUploadConcurrency sets how many parts of a multipart S3 upload are sent
+// in parallel (1-32, default 5). Each in-flight part is buffered in memory.
+func WithUploadConcurrency(n int) Option {
+	return func(s *Service) {
+		s.uploadConcurrency = n
+	}
+}
+
+// WithUploadPartSize sets the multipart part size in bytes (5 MiB-5 GiB,
+// default 5 MiB). Bodies up to one part are sent with a single PutObject.
+func WithUploadPartSize(size int64) Option {
+	return func(s *Service) {
+		s.uploadPartSize = size
+	}
+}
+
+// WithRouteTimeouts sets per-route request deadlines. NewService fails if
+// the configuration names unknown routes or would time out a streaming one.
+func WithRouteTimeouts(timeouts RouteTimeouts) Option {
+	return func(s *Service) {
+		s.routeTimeouts = newRouteTimeouts(timeouts)
+	}
+}
+
+// WithProblemJSON makes every error an RFC 7807 application/problem+json
+// response. Without it, clients can still ask for that format by sending
+// Accept: application/problem+json.
+func WithProblemJSON(enabled bool) Option {
+	return func(s *Service) {
+		s.problemJSON = enabled
+	}
+}
+
+// WithObjectTagRules tags uploaded S3 objects according to rules, e.g. for
+// lifecycle rules that expire or archive by tag. The applied tags are stored
+// in the metadata. NewService fails if the rules exceed S3's tag limits or
+// objects are shared through KeyStrategyContentHash.
+func WithObjectTagRules(rules ...TagRule) Option {
+	return func(s *Service) {
+		s.tagRules = rules
+	}
+}
+
+// WithUploadCoalescing controls whether identical uploads (same owner and
+// hash) that are in flight at the same time on this instance share a single
+// S3 write. Enabled by default.
+func WithUploadCoalescing(enabled bool) Option {
+	return func(s *Service) {
+		s.coalesceUploads = enabled
+	}
+}
+
+// WithSecurityHeader sets a header on every response, e.g.
+// Content-Security-Policy. An empty value removes one of the defaults
+// (X-Content-Type-Options, X-Frame-Options and Referrer-Policy).
+func WithSecurityHeader(name, value string) Option {
+	return func(s *Service) {
+		name = http.CanonicalHeaderKey(name)
+		if value == "" {
+			delete(s.securityHeaders, name)
+			return
+		}
+		s.securityHeaders[name] = value
+	}
+}
+
+// WithTagLimits bounds the number of tags per file and the length of tag
+// keys and values. Defaults are 10 tags, 128-character keys and
+// 256-character values.
+func WithTagLimits(maxTags, maxKeyLength, maxValueLength int) Option {
+	return func(s *Service) {
+		s.tagLimits.maxTags = maxTags
+		s.tagLimits.maxKeyLen = maxKeyLength
+		s.tagLimits.maxValueLen = maxValueLength
+	}
+}
+
+// WithAllowedTagKeys restricts tags to the given keys. By default any key
+// is accepted.
+func WithAllowedTagKeys(keys ...string) Option {
+	return func(s *Service) {
+		s.tagLimits.allowedKeys = make(map[string]bool, len(keys))
+		for _, key := range keys {
+			s.tagLimits.allowedKeys[key] = true
+		}
+	}
+}
+
+// WithHTTPSOnlyURLs rewrites every returned presigned URL to https, so
+// signed URLs are never handed out for plaintext use. NewService fails if a
+// custom S3 endpoint evidently doesn't serve HTTPS.
+func WithHTTPSOnlyURLs(enabled bool) Option {
+	return func(s *Service) {
+		s.httpsOnlyURLs = enabled
+	}
+}
+
+// WithHashBlocklist rejects uploads whose SHA-256 hash is on the blocklist
+// with 451 and enables POST /admin/blocklist to add hashes.
+func WithHashBlocklist(blocklist HashBlocklist) Option {
+	return func(s *Service) {
+		s.blocklist = blocklist
+	}
+}
+
+// WithImageDecodeLimits bounds image processing: images with more than
+// maxPixels pixels are rejected with 422 before decoding, and decodes taking
+// longer than timeout are abandoned with 422. Defaults are 50 megapixels and
+// 10 seconds.
+func WithImageDecodeLimits(maxPixels int64, timeout time.Duration) Option {
+	return func(s *Service) {
+		s.maxImagePixels = maxPixels
+		s.imageDecodeTimeout = timeout
+	}
+}
+
+// WithDownloadCache caches objects served by the download endpoint in dir,
+// up to maxBytes in total, evicting the least recently used. The directory
+// is owned by the service: cache files left in it are removed on start.
+func WithDownloadCache(dir string, maxBytes int64) Option {
+	return func(s *Service) {
+		s.diskCache = newDiskCache(dir, maxBytes)
+	}
+}
+
+// WithBlurHash stores a BlurHash placeholder of every uploaded image in the
+// metadata. It requires decoding the full image, which is shared with the
+// other processing steps.
+func WithBlurHash(enabled bool) Option {
+	return func(s *Service) {
+		s.blurHash = enabled
+	}
+}
+
+// WithDominantColor stores the average color of every uploaded image in the
+// metadata, e.g. as a placeholder background.
+func WithDominantColor(enabled bool) Option {
+	return func(s *Service) {
+		s.dominantColor = enabled
+	}
+}
+
+// WithServiceIdentity sets the name and version the service adds to the
+// User-Agent of its AWS requests, along with the request ID.
+func WithServiceIdentity(name, version string) Option {
+	return func(s *Service) {
+		s.serviceName = name
+		s.serviceVersion = version
+	}
+}
+
+// WithAcceptAnyImage accepts any image a registered Go decoder recognizes
+// (JPEG, PNG and GIF, plus formats registered by the embedding program)
+// instead of JPEG files only. The stored extension and content type follow
+// the detected format; the filename's extension is ignored.
+func WithAcceptAnyImage(enabled bool) Option {
+	return func(s *Service) {
+		s.acceptAnyImage = enabled
+	}
+}
+
+// WithPresignCache reuses a presigned URL for the same object and expiry for
+// up to window (and at most a quarter of the expiry), remembering up to size
+// URLs. Expiries are rounded up to a multiple of window, so clients may
+// receive URLs with somewhat more or less lifetime left than requested.
+func WithPresignCache(window time.Duration, size int) Option {
+	return func(s *Service) {
+		s.presignCache = newPresignCache(window, size)
+	}
+}
+
+// WithStatsTable keeps running totals of stored files and bytes in table
+// (keyed by an ID string) and serves them at GET /stats.
+func WithStatsTable(db *dynamodb.DynamoDB, table string) Option {
+	return func(s *Service) {
+		if s.stats == nil {
+			s.stats = &storageStats{}
+		}
+		s.stats.db = db
+		s.stats.tableName = table
+	}
+}
+
+// WithStorageCeiling rejects uploads with 507 once the stored bytes reach
+// maxBytes. The totals are re-read at most every maxStaleness, so the
+// ceiling can be overshot by what is uploaded in that time. Requires
+// WithStatsTable.
+func WithStorageCeiling(maxBytes int64, maxStaleness time.Duration) Option {
+	return func(s *Service) {
+		if s.stats == nil {
+			s.stats = &storageStats{}
+		}
+		s.stats.ceiling = maxBytes
+		s.stats.maxStaleness = maxStaleness
+	}
+}
+
+// WithPreUploadHooks adds hooks run in order before every upload is stored.
+// They can reject the upload or change its filename and tags.
+func WithPreUploadHooks(hooks ...PreUploadHook) Option {
+	return func(s *Service) {
+		s.preUploadHooks = append(s.preUploadHooks, hooks...)
+	}
+}
+
+// WithPostUploadHooks adds hooks run in order after a new file is stored.
+func WithPostUploadHooks(hooks ...PostUploadHook) Option {
+	return func(s *Service) {
+		s.postUploadHooks = append(s.postUploadHooks, hooks...)
+	}
+}
@@ -0,0 +1,19 @@
+package app
+
+import "net/http"
+
+// owner returns the owner files are attributed to for r: the authenticated
+// principal, or the configured default owner when there is none.
+func (s *Service) owner(r *http.Request) string {
+	if principal := s.principal(r); principal != "" {
+		return principal
+	}
+	return s.defaultOwner
+}
+
+// canAccess reports whether the caller of r may see or modify a file. Files
+// without an owner, written before ownership was recorded or with no owner
+// configured, are accessible to everyone.
+func (s *Service) canAccess(r *http.Request, metadata *FileMetadata) bool {
+	return metadata.OwnerID == "" || metadata.OwnerID == s.owner(r)
+}
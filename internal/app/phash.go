@@ -0,0 +1,138 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	"math/bits"
+	"slices"
+	"sync"
+)
+
+// differenceHash computes a 64-bit dHash: the image is reduced to a 9x8
+// grayscale grid and each bit records whether a cell is darker than its right
+// neighbour. Visually similar images produce hashes with a small Hamming
+// distance.
+func differenceHash(img image.Image) uint64 {
+	const cols, rows = 9, 8
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	var grid [rows][cols]float64
+	for cy := 0; cy < rows; cy++ {
+		y0, y1 := b.Min.Y+cy*h/rows, b.Min.Y+(cy+1)*h/rows
+		y1 = max(y1, y0+1)
+		for cx := 0; cx < cols; cx++ {
+			x0, x1 := b.Min.X+cx*w/cols, b.Min.X+(cx+1)*w/cols
+			x1 = max(x1, x0+1)
+			// Sample at most 8x8 points per cell to bound the cost on large images.
+			stepX, stepY := max((x1-x0)/8, 1), max((y1-y0)/8, 1)
+			var sum, n float64
+			for y := y0; y < y1; y += stepY {
+				for x := x0; x < x1; x += stepX {
+					sum += float64(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+					n++
+				}
+			}
+			grid[cy][cx] = sum / n
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols-1; x++ {
+			hash <<= 1
+			if grid[y][x] < grid[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+func formatPerceptualHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+// recentPerceptualHashes remembers the perceptual hashes of the last uploads
+// handled by this instance. A Hamming-distance search can't be expressed as a
+// DynamoDB key lookup, so near-duplicate detection is bounded to this window.
+type recentPerceptualHashes struct {
+	mu      sync.Mutex
+	entries []perceptualHashEntry
+	next    int
+	size    int
+}
+
+type perceptualHashEntry struct {
+	id   string
+	hash uint64
+}
+
+func newRecentPerceptualHashes(size int) *recentPerceptualHashes {
+	return &recentPerceptualHashes{entries: make([]perceptualHashEntry, 0, size), size: size}
+}
+
+func (r *recentPerceptualHashes) add(id string, hash uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.entries) < r.size {
+		r.entries = append(r.entries, perceptualHashEntry{id: id, hash: hash})
+		return
+	}
+	r.entries[r.next] = perceptualHashEntry{id: id, hash: hash}
+	r.next = (r.next + 1) % r.size
+}
+
+// closest returns the IDs of remembered files within maxDistance of hash,
+// nearest first.
+func (r *recentPerceptualHashes) closest(hash uint64, maxDistance int) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var matches []perceptualHashEntry
+	for _, entry := range r.entries {
+		if entry.id != "" && bits.OnesCount64(entry.hash^hash) <= maxDistance {
+			matches = append(matches, entry)
+		}
+	}
+	slices.SortStableFunc(matches, func(a, b perceptualHashEntry) int {
+		return bits.OnesCount64(a.hash^hash) - bits.OnesCount64(b.hash^hash)
+	})
+	ids := make([]string, len(matches))
+	for i, match := range matches {
+		ids[i] = match.id
+	}
+	return ids
+}
+
+func (r *recentPerceptualHashes) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, entry := range r.entries {
+		if entry.id == id {
+			r.entries[i].id = ""
+		}
+	}
+}
+
+// findNearDuplicate returns a recently stored file of ownerID whose perceptual
+// hash is within the configured distance of hash, or nil.
+func (s *Service) findNearDuplicate(ctx context.Context, hash uint64, ownerID string) (*FileMetadata, error) {
+	for _, id := range s.recentPerceptualHashes.closest(hash, s.nearDuplicateDistance) {
+		metadata, err := s.retrieveMetadataFromDB(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if metadata == nil {
+			s.recentPerceptualHashes.remove(id)
+			continue
+		}
+		if metadata.OwnerID != "" && metadata.OwnerID != ownerID {
+			continue
+		}
+		return metadata, nil
+	}
+	return nil, nil
+}
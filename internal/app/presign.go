@@ -0,0 +1,243 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/sync/semaphore"
+)
+
+const (
+	defaultPresignExpiry = 15 * time.Minute
+	// defaultRedirectExpiry is short because a redirect is followed at once;
+	// a longer-lived URL would only help whoever copies the Location.
+	defaultRedirectExpiry = time.Minute
+	// maxSigV4Expiry is the longest lifetime S3 accepts for a SigV4 presigned
+	// URL; longer URLs are signed fine but rejected by S3 with 403.
+	maxSigV4Expiry = 7 * 24 * time.Hour
+	// gaugePresignsInFlight is the number of URLs being signed.
+	gaugePresignsInFlight = "presigns_in_flight"
+)
+
+func (s *Service) generatePresignedURL(ctx context.Context, objectKey string, expiry time.Duration) (string, error) {
+	return s.presignFrom(ctx, s.primaryStore(), objectKey, expiry)
+}
+
+// responseOverrides are response headers S3 sets when serving a presigned
+// URL, in place of those stored on the object.
+type responseOverrides struct {
+	contentDisposition string
+	contentType        string
+}
+
+func (s *Service) presignFrom(ctx context.Context, store objectStore, objectKey string, expiry time.Duration) (string, error) {
+	return s.presignWithOverrides(ctx, store, objectKey, expiry, responseOverrides{})
+}
+
+// presignLimiter bounds the number of URLs signed at once, so that list and
+// batch requests presigning many URLs can't monopolize the CPU.
+type presignLimiter struct {
+	max          int64
+	sem          *semaphore.Weighted
+	queueTimeout time.Duration
+	inFlight     atomic.Int64
+}
+
+func newPresignLimiter(max int64, queueTimeout time.Duration) *presignLimiter {
+	return &presignLimiter{max: max, sem: semaphore.NewWeighted(max), queueTimeout: queueTimeout}
+}
+
+// acquire waits up to the queue timeout for a slot and fails with 503 if
+// none frees up.
+func (l *presignLimiter) acquire(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, l.queueTimeout)
+	defer cancel()
+	if err := l.sem.Acquire(ctx, 1); err != nil {
+		return newAPIError(http.StatusServiceUnavailable, "presign_capacity_exceeded",
+			"too many URLs being signed, retry later")
+	}
+	l.inFlight.Add(1)
+	return nil
+}
+
+func (l *presignLimiter) release() {
+	l.inFlight.Add(-1)
+	l.sem.Release(1)
+}
+
+func (s *Service) presignWithOverrides(ctx context.Context, store objectStore, objectKey string, expiry time.Duration, overrides responseOverrides) (string, error) {
+	if expiry > s.maxPresignExpiry {
+		return "", newAPIError(http.StatusBadRequest, "expiry_too_long",
+			fmt.Sprintf("expiry %s exceeds the maximum of %s", expiry, s.maxPresignExpiry))
+	}
+
+	if s.presignCache != nil {
+		// The URL is signed for the rounded expiry too, so a cached URL
+		// lives exactly as long as its key says.
+		expiry = s.presignCache.roundExpiry(expiry, s.maxPresignExpiry)
+	}
+	cacheKey := presignCacheKey{bucket: store.bucket, key: objectKey, expiry: expiry, overrides: overrides}
+	if s.presignCache != nil {
+		if url, ok := s.presignCache.get(cacheKey); ok {
+			s.event(ctx, eventPresignCacheHit, "key", objectKey)
+			return url, nil
+		}
+		s.event(ctx, eventPresignCacheMiss, "key", objectKey)
+	}
+	if s.presignLimiter != nil {
+		if err := s.presignLimiter.acquire(ctx); err != nil {
+			return "", err
+		}
+		defer s.presignLimiter.release()
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(objectKey),
+	}
+	if overrides.contentDisposition != "" {
+		input.ResponseContentDisposition = aws.String(overrides.contentDisposition)
+	}
+	if overrides.contentType != "" {
+		input.ResponseContentType = aws.String(overrides.contentType)
+	}
+	req, _ := store.client.GetObjectRequest(input)
+
+	presignedURL, err := req.Presign(expiry)
+	if err != nil {
+		return "", err
+	}
+
+	presignedURL = replaceLocalstackHostWithLocalhost(presignedURL)
+	if s.httpsOnlyURLs {
+		presignedURL = httpsURL(presignedURL)
+	}
+	if s.presignCache != nil {
+		s.presignCache.put(cacheKey, presignedURL)
+	}
+
+	return presignedURL, nil
+}
+
+// httpsURL rewrites a presigned http URL to https. Neither the scheme nor a
+// default port is part of the SigV4 signature, so the URL stays valid; an
+// explicit port 80 is dropped, since it would be wrong for https.
+func httpsURL(presignedURL string) string {
+	u, err := url.Parse(presignedURL)
+	if err != nil || u.Scheme != "http" {
+		return presignedURL
+	}
+	u.Scheme = "https"
+	if u.Port() == "80" {
+		u.Host = strings.TrimSuffix(u.Host, ":80")
+	}
+	return u.String()
+}
+
+// checkHTTPSEndpoint fails if URLs for client can't be served over HTTPS:
+// a custom plain-HTTP endpoint on a non-default port, such as LocalStack's
+// http://localhost:4566, has no TLS listener an https URL could reach.
+func checkHTTPSEndpoint(client *s3.S3) error {
+	endpoint := aws.StringValue(client.Config.Endpoint)
+	if endpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid S3 endpoint %q: %w", endpoint, err)
+	}
+	if u.Scheme == "http" && u.Port() != "" && u.Port() != "80" {
+		return fmt.Errorf("HTTPS-only URLs require an HTTPS endpoint, got %s", endpoint)
+	}
+	return nil
+}
+
+// requestedOverrides returns the response headers asked for with
+// ?disposition=inline|attachment and an optional ?filename=, or with the
+// configured default disposition. The filename defaults to the original
+// name; both it and the content type are checked so that nothing can be
+// injected into the headers S3 sends.
+func (s *Service) requestedOverrides(r *http.Request, metadata *FileMetadata) (responseOverrides, error) {
+	query := r.URL.Query()
+	disposition := query.Get("disposition")
+	if disposition == "" {
+		disposition = s.presignDisposition
+	}
+	if disposition == "" {
+		if query.Has("filename") {
+			return responseOverrides{}, newAPIError(http.StatusBadRequest, "invalid_disposition", "filename requires a disposition")
+		}
+		return responseOverrides{}, nil
+	}
+	if disposition != "inline" && disposition != "attachment" {
+		return responseOverrides{}, newAPIError(http.StatusBadRequest, "invalid_disposition", "disposition must be inline or attachment")
+	}
+
+	filename := metadata.OriginalName
+	if query.Has("filename") {
+		raw := query.Get("filename")
+		if strings.ContainsFunc(raw, unicode.IsControl) {
+			return responseOverrides{}, newAPIError(http.StatusBadRequest, "invalid_filename", "filename must not contain control characters")
+		}
+		var err error
+		if filename, err = s.cleanFilename(raw); err != nil {
+			return responseOverrides{}, err
+		}
+	}
+	overrides := responseOverrides{contentDisposition: contentDisposition(disposition, filename)}
+	if metadata.ContentType != "" {
+		contentType, err := normalizeContentType(metadata.ContentType)
+		if err != nil {
+			return responseOverrides{}, fmt.Errorf("invalid stored content type %q: %w", metadata.ContentType, err)
+		}
+		overrides.contentType = contentType
+	}
+	return overrides, nil
+}
+
+// redirectToFile answers with a 302 to a presigned URL of the original. The
+// redirect must not be cached: a client or proxy replaying it after the URL
+// expired would land on a 403 from S3, so it is marked no-store and the URL is
+// signed for the redirect expiry rather than the longer default.
+func (s *Service) redirectToFile(w http.ResponseWriter, r *http.Request, metadata *FileMetadata) {
+	overrides, err := s.requestedOverrides(r, metadata)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	key := objectKey(metadata)
+	presignedURL, err := s.presignWithOverrides(r.Context(), s.readStore(r.Context(), key), key, s.redirectExpiry, overrides)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, presignedURL, http.StatusFound)
+}
+
+// requestedExpiry returns the URL lifetime asked for with ?expires_in=<seconds>,
+// or the configured default.
+func (s *Service) requestedExpiry(r *http.Request) (time.Duration, error) {
+	value := r.URL.Query().Get("expires_in")
+	if value == "" {
+		return s.presignExpiry, nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds <= 0 {
+		return 0, newAPIError(http.StatusBadRequest, "invalid_expiry", "expires_in must be a positive number of seconds")
+	}
+	if seconds > int64(s.maxPresignExpiry/time.Second) {
+		return 0, newAPIError(http.StatusBadRequest, "expiry_too_long",
+			fmt.Sprintf("expires_in %d exceeds the maximum of %d seconds", seconds, int64(s.maxPresignExpiry/time.Second)))
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
@@ -0,0 +1,154 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestRequestedExpiryBoundary(t *testing.T) {
+	s := newTestService(t, nil)
+	limit := int64(maxSigV4Expiry / time.Second)
+	tests := []struct {
+		expiresIn string
+		code      string
+	}{
+		{strconv.FormatInt(limit, 10), ""},
+		{strconv.FormatInt(limit+1, 10), "expiry_too_long"},
+		{"1", ""},
+		{"0", "invalid_expiry"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expiresIn, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/file/a?expires_in="+tt.expiresIn, nil)
+			expiry, err := s.requestedExpiry(r)
+			if code := apiErrorCode(err); code != tt.code {
+				t.Fatalf("error code = %q (%v), want %q", code, err, tt.code)
+			}
+			if err != nil {
+				return
+			}
+			if _, err := s.presignFrom(r.Context(), s.primaryStore(), "a.jpg", expiry); err != nil {
+				t.Errorf("presign at %s: %v", expiry, err)
+			}
+		})
+	}
+}
+
+func TestPresignRejectsExpiryOverMaximum(t *testing.T) {
+	s := newTestService(t, nil, WithMaxPresignExpiry(time.Hour))
+	presigned, err := s.presignFrom(context.Background(), s.primaryStore(), "a.jpg", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(presigned)
+	if got := u.Query().Get("X-Amz-Expires"); got != "3600" {
+		t.Errorf("X-Amz-Expires = %s, want 3600", got)
+	}
+	_, err = s.presignFrom(context.Background(), s.primaryStore(), "a.jpg", time.Hour+time.Second)
+	if code := apiErrorCode(err); code != "expiry_too_long" {
+		t.Errorf("error code = %q, want expiry_too_long", code)
+	}
+}
+
+func TestMaxPresignExpiryCappedBySigV4(t *testing.T) {
+	fileStorage, db := newTestClients(t, nil)
+	for _, limit := range []time.Duration{maxSigV4Expiry, maxSigV4Expiry + time.Second} {
+		s, err := NewService(fileStorage, testBucket, db, testTable, WithMaxPresignExpiry(limit))
+		if err == nil {
+			s.Close()
+		}
+		if over := limit > maxSigV4Expiry; (err != nil) != over {
+			t.Errorf("max presign expiry %s: NewService() error = %v", limit, err)
+		}
+	}
+}
+
+func apiErrorCode(err error) string {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+	if err != nil {
+		return "unexpected: " + err.Error()
+	}
+	return ""
+}
+
+func TestHTTPSURL(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"http://s3.example.com/bucket/a.jpg?X-Amz-Signature=abc", "https://s3.example.com/bucket/a.jpg?X-Amz-Signature=abc"},
+		{"http://s3.example.com:80/bucket/a.jpg?X-Amz-Signature=abc", "https://s3.example.com/bucket/a.jpg?X-Amz-Signature=abc"},
+		{"http://s3.example.com/bucket/a%20b%2Bc%C3%A9.jpg?X-Amz-Credential=a%2Fb", "https://s3.example.com/bucket/a%20b%2Bc%C3%A9.jpg?X-Amz-Credential=a%2Fb"},
+		{"https://s3.example.com/bucket/a.jpg", "https://s3.example.com/bucket/a.jpg"},
+	}
+	for _, tt := range tests {
+		if got := httpsURL(tt.in); got != tt.want {
+			t.Errorf("httpsURL(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestHTTPSOnlyURLsWithPort80Endpoint(t *testing.T) {
+	_, db := newTestClients(t, nil)
+	fileStorage := s3.New(session.Must(session.NewSession(&aws.Config{
+		Region:           aws.String("us-east-1"),
+		Endpoint:         aws.String("http://s3.example.com:80"),
+		Credentials:      credentials.NewStaticCredentials("test", "test", ""),
+		S3ForcePathStyle: aws.Bool(true),
+	})))
+	s, err := NewService(fileStorage, testBucket, db, testTable, WithHTTPSOnlyURLs(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	presigned, err := s.generatePresignedURL(context.Background(), "a.jpg", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(presigned, "https://s3.example.com/") {
+		t.Errorf("presigned URL = %s, want https without port 80", presigned)
+	}
+}
+
+func TestPresignCacheRoundsExpiry(t *testing.T) {
+	s := newTestService(t, nil, WithPresignCache(time.Minute, 10), WithMaxPresignExpiry(2*time.Hour))
+	first, err := s.presignFrom(context.Background(), s.primaryStore(), "a.jpg", time.Hour+time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(first)
+	if got := u.Query().Get("X-Amz-Expires"); got != "3660" {
+		t.Errorf("X-Amz-Expires = %s, want 3660", got)
+	}
+	second, err := s.presignFrom(context.Background(), s.primaryStore(), "a.jpg", time.Hour+59*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second != first {
+		t.Errorf("expiries within one window got different URLs:\n%s\n%s", first, second)
+	}
+
+	capped := newTestService(t, nil, WithPresignCache(time.Minute, 10), WithMaxPresignExpiry(time.Hour+time.Second))
+	presigned, err := capped.presignFrom(context.Background(), capped.primaryStore(), "a.jpg", time.Hour+time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ = url.Parse(presigned)
+	if got := u.Query().Get("X-Amz-Expires"); got != "3601" {
+		t.Errorf("capped X-Amz-Expires = %s, want 3601", got)
+	}
+}
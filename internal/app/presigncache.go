@@ -0,0 +1,81 @@
+package app
+
+import (
+	"sync"
+	"time"
+)
+
+// presignCache reuses presigned URLs for a short window, so hot files aren't
+// signed again for every request. A cached URL has less lifetime left than a
+// fresh one, so it is only reused while at least three quarters of the
+// requested expiry remain, and never longer than the window.
+type presignCache struct {
+	mu      sync.Mutex
+	window  time.Duration
+	size    int
+	entries map[presignCacheKey]presignCacheEntry
+}
+
+type presignCacheKey struct {
+	bucket    string
+	key       string
+	expiry    time.Duration
+	overrides responseOverrides
+}
+
+type presignCacheEntry struct {
+	url      string
+	signedAt time.Time
+}
+
+func newPresignCache(window time.Duration, size int) *presignCache {
+	return &presignCache{
+		window:  window,
+		size:    size,
+		entries: make(map[presignCacheKey]presignCacheEntry),
+	}
+}
+
+// roundExpiry rounds expiry up to a multiple of the window, so requests for
+// nearly the same lifetime share a cached URL, but never past limit.
+func (c *presignCache) roundExpiry(expiry, limit time.Duration) time.Duration {
+	if rem := expiry % c.window; rem != 0 {
+		expiry += c.window - rem
+	}
+	return min(expiry, limit)
+}
+
+func (c *presignCache) maxAge(expiry time.Duration) time.Duration {
+	return min(c.window, expiry/4)
+}
+
+func (c *presignCache) get(k presignCacheKey) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[k]
+	if !ok {
+		return "", false
+	}
+	if time.Since(entry.signedAt) >= c.maxAge(k.expiry) {
+		delete(c.entries, k)
+		return "", false
+	}
+	return entry.url, true
+}
+
+func (c *presignCache) put(k presignCacheKey, url string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.size {
+		for key, entry := range c.entries {
+			if time.Since(entry.signedAt) >= c.maxAge(key.expiry) {
+				delete(c.entries, key)
+			}
+		}
+		// Still full of live entries: start over rather than track recency.
+		if len(c.entries) >= c.size {
+			clear(c.entries)
+		}
+	}
+	c.entries[k] = presignCacheEntry{url: url, signedAt: time.Now()}
+}
@@ -0,0 +1,302 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/gorilla/mux"
+)
+
+// FileStatus is the processing state of a file. Files stored with
+// processing at upload have none, which counts as ready.
+type FileStatus string
+
+const (
+	// StatusPending files wait for a worker.
+	StatusPending FileStatus = "pending"
+	// StatusProcessing files are being processed by a worker.
+	StatusProcessing FileStatus = "processing"
+	// StatusReady files are fully processed.
+	StatusReady FileStatus = "ready"
+	// StatusFailed files could not be processed; ProcessingError says why.
+	StatusFailed FileStatus = "failed"
+)
+
+// abandonTimeout bounds recording that a job was abandoned at shutdown, which
+// can't use the cancelled processing context.
+const abandonTimeout = 5 * time.Second
+
+// errProcessingAbandoned is the processing error of files whose processing
+// was cut off by a shutdown.
+var errProcessingAbandoned = errors.New("processing was abandoned at shutdown; upload the file again")
+
+// statusTransitions lists the statuses each status may change to.
+var statusTransitions = map[FileStatus][]FileStatus{
+	StatusPending:    {StatusProcessing, StatusFailed},
+	StatusProcessing: {StatusReady, StatusFailed},
+}
+
+func (from FileStatus) canBecome(to FileStatus) bool {
+	return slices.Contains(statusTransitions[from], to)
+}
+
+// ready reports whether the file is fully processed.
+func (m *FileMetadata) ready() bool {
+	return m.Status == "" || m.Status == StatusReady
+}
+
+// processingJob is the deferred processing of a stored file.
+type processingJob struct {
+	metadata FileMetadata
+	upload   *upload
+	// release returns the upload's memory budget reservation, which the job
+	// holds as long as it holds the upload's data.
+	release func()
+}
+
+// processingPool runs deferred processing on a fixed number of workers fed
+// by a bounded queue.
+type processingPool struct {
+	workers   int
+	queueSize int
+	jobs      chan processingJob
+	mu        sync.Mutex
+	closed    bool
+	wg        sync.WaitGroup
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+func (p *processingPool) validate() error {
+	if p == nil {
+		return nil
+	}
+	if p.workers <= 0 || p.queueSize <= 0 {
+		return fmt.Errorf("async processing workers and queue size must be positive")
+	}
+	return nil
+}
+
+func (s *Service) startProcessing() {
+	p := s.processing
+	p.jobs = make(chan processingJob, p.queueSize)
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	for range p.workers {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for job := range p.jobs {
+				if p.ctx.Err() != nil {
+					s.abandonProcessing(&job.metadata)
+				} else {
+					s.processFile(p.ctx, job)
+				}
+				job.release()
+			}
+		}()
+	}
+}
+
+// submit queues job, or returns false if the queue is full or the pool is
+// draining.
+func (p *processingPool) submit(job processingJob) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	select {
+	case p.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// defersProcessing reports whether u is stored with its processing left to
+// the background workers: async processing is enabled, there is processing
+// to defer, and u is buffered, since the workers need its data.
+func (s *Service) defersProcessing(u *upload) bool {
+	return s.processing != nil && !u.streamed() && (s.blurHash || s.dominantColor || len(s.postUploadHooks) > 0)
+}
+
+// processFile does the processing deferred at upload: the fields derived
+// from the decoded image and the post-upload hooks. The file goes from
+// pending to processing, and then to ready, or to failed if the image can't
+// be processed.
+func (s *Service) processFile(ctx context.Context, job processingJob) {
+	metadata := job.metadata
+	if err := s.transitionStatus(ctx, &metadata, StatusProcessing, nil); err != nil {
+		if ctx.Err() != nil {
+			s.abandonProcessing(&metadata)
+			return
+		}
+		s.logger.Warn("file processing skipped", "id", metadata.ID, "error", err)
+		return
+	}
+	set := map[string]*dynamodb.AttributeValue{}
+	if s.blurHash || s.dominantColor {
+		img, err := s.uploadImage(ctx, job.upload)
+		if err != nil && ctx.Err() != nil {
+			s.abandonProcessing(&metadata)
+			return
+		}
+		if err != nil {
+			s.logger.Error("file processing failed", "id", metadata.ID, "error", err)
+			metadata.ProcessingError = err.Error()
+			set["ProcessingError"] = &dynamodb.AttributeValue{S: aws.String(metadata.ProcessingError)}
+			if err := s.transitionStatus(ctx, &metadata, StatusFailed, set); err != nil {
+				s.logger.Error("failed to record file processing failure", "id", metadata.ID, "error", err)
+			}
+			return
+		}
+		if s.blurHash {
+			metadata.BlurHash = blurHash(img)
+			set["BlurHash"] = &dynamodb.AttributeValue{S: aws.String(metadata.BlurHash)}
+		}
+		if s.dominantColor {
+			metadata.DominantColor = averageColor(img)
+			set["DominantColor"] = &dynamodb.AttributeValue{S: aws.String(metadata.DominantColor)}
+		}
+	}
+	if err := s.transitionStatus(ctx, &metadata, StatusReady, set); err != nil {
+		if ctx.Err() != nil {
+			s.abandonProcessing(&metadata)
+			return
+		}
+		s.logger.Error("failed to save file processing results", "id", metadata.ID, "error", err)
+		return
+	}
+	s.fileStored(ctx, &metadata)
+}
+
+// abandonProcessing marks a file whose processing was cut off by a shutdown
+// as failed, so that its status doesn't stay pending or processing forever.
+func (s *Service) abandonProcessing(metadata *FileMetadata) {
+	ctx, cancel := context.WithTimeout(context.Background(), abandonTimeout)
+	defer cancel()
+	metadata.ProcessingError = errProcessingAbandoned.Error()
+	set := map[string]*dynamodb.AttributeValue{"ProcessingError": {S: aws.String(metadata.ProcessingError)}}
+	if err := s.transitionStatus(ctx, metadata, StatusFailed, set); err != nil {
+		s.logger.Error("failed to record abandoned file processing", "id", metadata.ID, "error", err)
+		return
+	}
+	s.logger.Warn("file processing abandoned at shutdown", "id", metadata.ID)
+}
+
+// errStatusChanged reports a status transition whose file was deleted or
+// changed status meanwhile.
+var errStatusChanged = errors.New("file was deleted or its status changed")
+
+// transitionStatus changes the status of metadata to to, together with the
+// attributes in set. The update is conditional on the stored status still
+// being the one metadata has, so that concurrent workers can't both take a
+// file or undo each other's results.
+func (s *Service) transitionStatus(ctx context.Context, metadata *FileMetadata, to FileStatus, set map[string]*dynamodb.AttributeValue) error {
+	from := metadata.Status
+	if !from.canBecome(to) {
+		return fmt.Errorf("invalid status transition from %q to %q", from, to)
+	}
+	updatedAt := s.now().Format(time.RFC3339)
+	expression := "SET #Status = :to, #UpdatedAt = :UpdatedAt"
+	names := map[string]*string{"#Status": aws.String("Status"), "#UpdatedAt": aws.String("UpdatedAt")}
+	values := map[string]*dynamodb.AttributeValue{
+		":to":        {S: aws.String(string(to))},
+		":from":      {S: aws.String(string(from))},
+		":UpdatedAt": {S: aws.String(updatedAt)},
+	}
+	for name, value := range set {
+		expression += ", #" + name + " = :" + name
+		names["#"+name] = aws.String(name)
+		values[":"+name] = value
+	}
+	_, err := s.db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(s.dbFileTableName),
+		Key:                       map[string]*dynamodb.AttributeValue{"ID": {S: aws.String(metadata.ID)}},
+		UpdateExpression:          aws.String(expression),
+		ConditionExpression:       aws.String("#Status = :from"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	if s.metadataCache != nil {
+		s.metadataCache.remove(metadata.ID)
+	}
+	if isConditionFailed(err) {
+		return errStatusChanged
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update file status: %w", err)
+	}
+	metadata.Status, metadata.UpdatedAt = to, updatedAt
+	return nil
+}
+
+// drainProcessing stops accepting jobs and waits up to timeout for the
+// queued ones, then cancels the rest. Files whose processing was cut off
+// are marked failed.
+func (s *Service) drainProcessing(timeout time.Duration) {
+	if s.processing == nil {
+		return
+	}
+	p := s.processing
+	p.mu.Lock()
+	p.closed = true
+	queued := len(p.jobs)
+	close(p.jobs)
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		s.logger.Info("file processing drained", "queued", queued)
+		return
+	case <-timer.C:
+	}
+	abandoned := len(p.jobs)
+	p.cancel()
+	<-done
+	s.logger.Warn("file processing cancelled after drain timeout", "abandoned", abandoned, "timeout", timeout)
+}
+
+// statusURL is the URL clients poll for the processing status of file id.
+func statusURL(id string) string {
+	return "/file/" + url.PathEscape(id) + "/status"
+}
+
+type FileStatusResponse struct {
+	ID              string     `json:"id"`
+	Status          FileStatus `json:"status"`
+	ProcessingError string     `json:"processing_error,omitempty"`
+}
+
+// GetFileStatus returns the processing status of a file.
+func (s *Service) GetFileStatus(w http.ResponseWriter, r *http.Request) {
+	metadata, err := s.loadFile(r, mux.Vars(r)["id"])
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	status := metadata.Status
+	if status == "" {
+		status = StatusReady
+	}
+	s.writeResponse(w, r, http.StatusOK, FileStatusResponse{
+		ID:              metadata.ID,
+		Status:          status,
+		ProcessingError: metadata.ProcessingError,
+	})
+}
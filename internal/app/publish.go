@@ -0,0 +1,115 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Types of the file lifecycle events the service publishes.
+const (
+	FileEventStored   = "file.stored"
+	FileEventDeleted  = "file.deleted"
+	FileEventRestored = "file.restored"
+)
+
+// EventPublisher sends an encoded file event to another system.
+type EventPublisher interface {
+	Publish(ctx context.Context, body []byte, contentType string) error
+}
+
+// SNSPublisher publishes events to an SNS topic.
+type SNSPublisher struct {
+	Client   *sns.SNS
+	TopicARN string
+}
+
+func (p SNSPublisher) Publish(ctx context.Context, body []byte, contentType string) error {
+	_, err := p.Client.PublishWithContext(ctx, &sns.PublishInput{
+		TopicArn: aws.String(p.TopicARN),
+		Message:  aws.String(string(body)),
+		MessageAttributes: map[string]*sns.MessageAttributeValue{
+			"content-type": {DataType: aws.String("String"), StringValue: aws.String(contentType)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish to SNS topic %s: %w", p.TopicARN, err)
+	}
+	return nil
+}
+
+// SQSPublisher sends events to an SQS queue.
+type SQSPublisher struct {
+	Client   *sqs.SQS
+	QueueURL string
+}
+
+func (p SQSPublisher) Publish(ctx context.Context, body []byte, contentType string) error {
+	_, err := p.Client.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(p.QueueURL),
+		MessageBody: aws.String(string(body)),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"content-type": {DataType: aws.String("String"), StringValue: aws.String(contentType)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send to SQS queue %s: %w", p.QueueURL, err)
+	}
+	return nil
+}
+
+// WebhookPublisher POSTs events to a URL. Responses other than 2xx are
+// errors. A nil Client uses http.DefaultClient.
+type WebhookPublisher struct {
+	Client *http.Client
+	URL    string
+}
+
+func (p WebhookPublisher) Publish(ctx context.Context, body []byte, contentType string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post event to %s: %w", p.URL, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %s answered %s", p.URL, resp.Status)
+	}
+	return nil
+}
+
+// publishFileEvent encodes an event about a file in the configured format and
+// sends it to every publisher. Failures are logged; what the event reports
+// has already happened, so it is published even if the request that caused it
+// is cancelled.
+func (s *Service) publishFileEvent(ctx context.Context, eventType string, metadata *FileMetadata) {
+	if len(s.eventPublishers) == 0 {
+		return
+	}
+	body, contentType, err := s.EncodeFileEvent(eventType, *metadata)
+	if err != nil {
+		s.logger.Error("failed to encode file event", "type", eventType, "id", metadata.ID, "error", err)
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	for _, publisher := range s.eventPublishers {
+		if err := publisher.Publish(ctx, body, contentType); err != nil {
+			s.logger.Error("failed to publish file event", "type", eventType, "id", metadata.ID, "error", err)
+		}
+	}
+}
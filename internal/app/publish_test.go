@@ -0,0 +1,61 @@
+package app
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestUploadPublishesCloudEvent(t *testing.T) {
+	var mu sync.Mutex
+	var events []map[string]any
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != cloudEventsContentType {
+			t.Errorf("webhook content type = %q", ct)
+		}
+		body, _ := io.ReadAll(r.Body)
+		var event map[string]any
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("webhook body %s: %v", body, err)
+		}
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+	}))
+	defer webhook.Close()
+
+	var puts atomic.Int32
+	s := newTestService(t, storingFake(&puts), WithUploaderInfo(),
+		WithEventFormat(EventFormatCloudEvents, "/test"),
+		WithEventPublishers(WebhookPublisher{URL: webhook.URL}))
+	w := httptest.NewRecorder()
+	r := multipartUpload(t, "photo.jpg", testJPEG(t))
+	r.Header.Set("User-Agent", "uploader-agent")
+	s.Handler().ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("upload: got %d %s", w.Code, w.Body)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 1 {
+		t.Fatalf("%d events published, want 1", len(events))
+	}
+	event := events[0]
+	if event["type"] != FileEventStored || event["source"] != "/test" || event["specversion"] != "1.0" {
+		t.Errorf("event = %v", event)
+	}
+	data, _ := event["data"].(map[string]any)
+	if data["id"] == nil || data["id"] != event["subject"] {
+		t.Errorf("event data = %v, subject %v", data, event["subject"])
+	}
+	for _, field := range []string{"uploader_ip", "uploader_user_agent"} {
+		if _, ok := data[field]; ok {
+			t.Errorf("event data carries %s", field)
+		}
+	}
+}
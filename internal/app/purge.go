@@ -0,0 +1,141 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/gorilla/mux"
+)
+
+// maxPurgePerRequest bounds the files one purge request deletes, so that it
+// finishes well within request timeouts; the rest is left for the next
+// request via its next_token.
+const maxPurgePerRequest = 1000
+
+// markDeleted soft-deletes a file: it disappears from reads, listings and
+// deduplication, but its objects stay until it is purged.
+func (s *Service) markDeleted(ctx context.Context, metadata *FileMetadata) error {
+	_, err := s.db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:                aws.String(s.dbFileTableName),
+		Key:                      map[string]*dynamodb.AttributeValue{"ID": {S: aws.String(metadata.ID)}},
+		UpdateExpression:         aws.String("SET #deleted = :deleted"),
+		ConditionExpression:      aws.String("attribute_exists(ID) AND attribute_not_exists(#deleted)"),
+		ExpressionAttributeNames: map[string]*string{"#deleted": aws.String("DeletedAt")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":deleted": {S: aws.String(s.now().Format(time.RFC3339))},
+		},
+	})
+	if isConditionFailed(err) {
+		return newAPIError(http.StatusNotFound, "not_found", "file not found")
+	}
+	return err
+}
+
+// RestoreFile undoes the soft delete of file {id} and returns it like GetFile.
+// Only soft-deleted files can be restored; anything else is 404.
+func (s *Service) RestoreFile(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if err := s.sanitizeKeyComponent(id); err != nil {
+		s.writeJSONError(w, r, http.StatusBadRequest, "invalid_id", err.Error())
+		return
+	}
+	out, err := s.db.UpdateItemWithContext(r.Context(), &dynamodb.UpdateItemInput{
+		TableName:                aws.String(s.dbFileTableName),
+		Key:                      map[string]*dynamodb.AttributeValue{"ID": {S: aws.String(id)}},
+		UpdateExpression:         aws.String("REMOVE #deleted"),
+		ConditionExpression:      aws.String("attribute_exists(#deleted)"),
+		ExpressionAttributeNames: map[string]*string{"#deleted": aws.String("DeletedAt")},
+		ReturnValues:             aws.String(dynamodb.ReturnValueAllNew),
+	})
+	if isConditionFailed(err) {
+		s.writeJSONError(w, r, http.StatusNotFound, "not_found", "no soft-deleted file with this ID")
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	var metadata FileMetadata
+	if err := dynamodbattribute.UnmarshalMap(out.Attributes, &metadata); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	s.audit(r, "restore", &metadata)
+	s.publishFileEvent(r.Context(), FileEventRestored, &metadata)
+
+	response, err := s.fileResponse(r.Context(), s.visibleMetadata(r, &metadata), s.presignExpiry)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	s.writeResponse(w, r, http.StatusOK, response)
+}
+
+type PurgeResponse struct {
+	Purged int `json:"purged"`
+	// NextToken is set when more soft-deleted files may be due; pass it as
+	// ?next_token= to continue.
+	NextToken string `json:"next_token,omitempty"`
+}
+
+// PurgeFiles deletes the objects and metadata of files soft-deleted more than
+// ?older_than= (a Go duration such as 720h) ago. Purging is idempotent, so an
+// interrupted purge can simply be repeated or continued with its next_token.
+func (s *Service) PurgeFiles(w http.ResponseWriter, r *http.Request) {
+	olderThan, err := time.ParseDuration(r.URL.Query().Get("older_than"))
+	if err != nil || olderThan < 0 {
+		s.writeJSONError(w, r, http.StatusBadRequest, "invalid_older_than", "older_than must be a non-negative duration such as 720h")
+		return
+	}
+	startKey, err := decodePageToken(r.URL.Query().Get("next_token"))
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	cutoff := s.now().Add(-olderThan).Format(time.RFC3339)
+	input := &dynamodb.ScanInput{
+		TableName:                aws.String(s.dbFileTableName),
+		FilterExpression:         aws.String("#deleted < :cutoff"),
+		ExpressionAttributeNames: map[string]*string{"#deleted": aws.String("DeletedAt")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":cutoff": {S: aws.String(cutoff)},
+		},
+		ExclusiveStartKey: startKey,
+	}
+	var response PurgeResponse
+	var purgeErr error
+	var lastKey map[string]*dynamodb.AttributeValue
+	err = s.db.ScanPagesWithContext(r.Context(), input, func(page *dynamodb.ScanOutput, _ bool) bool {
+		for _, item := range page.Items {
+			var metadata FileMetadata
+			if purgeErr = dynamodbattribute.UnmarshalMap(item, &metadata); purgeErr != nil {
+				return false
+			}
+			if purgeErr = s.removeFile(r.Context(), &metadata); purgeErr != nil {
+				return false
+			}
+			response.Purged++
+			s.audit(r, "purge", &metadata)
+		}
+		lastKey = page.LastEvaluatedKey
+		return response.Purged < maxPurgePerRequest
+	})
+	if err == nil {
+		err = purgeErr
+	}
+	if err != nil {
+		s.writeError(w, r, fmt.Errorf("purge stopped after %d files: %w", response.Purged, err))
+		return
+	}
+	if response.NextToken, err = encodePageToken(lastKey); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	s.writeResponse(w, r, http.StatusOK, response)
+}
@@ -0,0 +1,246 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ReconcileOptions controls Reconcile.
+type ReconcileOptions struct {
+	// MinAge skips objects modified more recently than this. An upload
+	// writes its object before its metadata, so young objects without
+	// metadata are usually uploads in progress.
+	MinAge time.Duration
+	// DeleteOrphans deletes objects no metadata refers to.
+	DeleteOrphans bool
+	// MaxDeletes is a safety limit for DeleteOrphans: if more orphans are
+	// found, which rather hints at a misconfigured prefix or table, none
+	// are deleted. Zero means no limit.
+	MaxDeletes int
+	// FlagMissing marks files whose object is missing with
+	// object_missing_at, as verified reads do.
+	FlagMissing bool
+	// PageSize bounds the items per scan page and the keys per listing
+	// page, and PageDelay pauses between pages, to leave DynamoDB and S3
+	// throughput to live traffic. Zero means the service defaults and no
+	// pause.
+	PageSize  int64
+	PageDelay time.Duration
+}
+
+func (o ReconcileOptions) validate() error {
+	if o.MinAge < 0 || o.MaxDeletes < 0 || o.PageSize < 0 || o.PageDelay < 0 {
+		return fmt.Errorf("reconcile options must not be negative")
+	}
+	return nil
+}
+
+// ReconcileReport lists the differences between the table and the bucket.
+type ReconcileReport struct {
+	// MissingObjects are the IDs of files whose object is not in the bucket.
+	MissingObjects []string `json:"missing_objects"`
+	// OrphanObjects are keys of objects no metadata refers to.
+	OrphanObjects []string `json:"orphan_objects"`
+	// DeletedOrphans is set when orphans were deleted.
+	DeletedOrphans int `json:"deleted_orphans"`
+	// FlaggedMissing is set when files with missing objects were flagged.
+	FlaggedMissing int `json:"flagged_missing"`
+}
+
+// Reconcile compares the metadata table with the objects under the key
+// prefixes of the primary bucket.
+func (s *Service) Reconcile(ctx context.Context, opts ReconcileOptions) (*ReconcileReport, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	// Every key the table refers to, mapped to the owning file ID. Variant
+	// keys map to an empty ID, since a missing variant isn't a missing file.
+	referenced := make(map[string]string)
+	scan := &dynamodb.ScanInput{TableName: aws.String(s.dbFileTableName)}
+	if opts.PageSize > 0 {
+		scan.Limit = aws.Int64(opts.PageSize)
+	}
+	var scanErr error
+	err := s.db.ScanPagesWithContext(ctx, scan, func(page *dynamodb.ScanOutput, last bool) bool {
+		var files []FileMetadata
+		if scanErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &files); scanErr != nil {
+			return false
+		}
+		for _, metadata := range files {
+			referenced[objectKey(&metadata)] = metadata.ID
+			for _, key := range metadata.Variants {
+				referenced[key] = ""
+			}
+		}
+		if !last {
+			if scanErr = pause(ctx, opts.PageDelay); scanErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = scanErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan DynamoDB: %w", err)
+	}
+	if s.metadataRetries != nil {
+		// Objects whose metadata write is queued are not orphans.
+		pending, err := s.metadataRetries.pendingWrites()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the metadata retry queue: %w", err)
+		}
+		for _, metadata := range pending {
+			referenced[objectKey(&metadata)] = ""
+		}
+	}
+
+	report := &ReconcileReport{}
+	found := make(map[string]bool, len(referenced))
+	cutoff := time.Now().Add(-opts.MinAge)
+	for _, prefix := range s.keyPrefixes() {
+		list := &s3.ListObjectsV2Input{
+			Bucket: aws.String(s.fileStorageBucket),
+			Prefix: aws.String(prefix),
+		}
+		if opts.PageSize > 0 {
+			list.MaxKeys = aws.Int64(opts.PageSize)
+		}
+		var listErr error
+		err = s.fileStorage.ListObjectsV2PagesWithContext(ctx, list, func(page *s3.ListObjectsV2Output, last bool) bool {
+			for _, object := range page.Contents {
+				key := aws.StringValue(object.Key)
+				if _, ok := referenced[key]; ok {
+					found[key] = true
+					continue
+				}
+				if aws.TimeValue(object.LastModified).After(cutoff) {
+					continue
+				}
+				report.OrphanObjects = append(report.OrphanObjects, key)
+			}
+			if !last {
+				if listErr = pause(ctx, opts.PageDelay); listErr != nil {
+					return false
+				}
+			}
+			return true
+		})
+		if err == nil {
+			err = listErr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects: %w", err)
+		}
+	}
+
+	for key, id := range referenced {
+		if id != "" && !found[key] {
+			report.MissingObjects = append(report.MissingObjects, id)
+		}
+	}
+
+	if opts.FlagMissing {
+		for _, id := range report.MissingObjects {
+			if err := s.flagMissingObject(ctx, id); err != nil {
+				return report, err
+			}
+			report.FlaggedMissing++
+		}
+	}
+	if opts.DeleteOrphans && opts.MaxDeletes > 0 && len(report.OrphanObjects) > opts.MaxDeletes {
+		s.logger.Error("too many orphan objects to delete them, check the configuration",
+			"orphans", len(report.OrphanObjects), "max_deletes", opts.MaxDeletes)
+	} else if opts.DeleteOrphans {
+		for _, key := range report.OrphanObjects {
+			_, err := s.fileStorage.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+				Bucket: aws.String(s.fileStorageBucket),
+				Key:    aws.String(key),
+			})
+			if err != nil {
+				return report, fmt.Errorf("failed to delete orphan %s: %w", key, err)
+			}
+			report.DeletedOrphans++
+		}
+	}
+	return report, nil
+}
+
+// pause waits for d, or returns the context error if ctx ends first.
+func pause(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// backgroundReconcile runs Reconcile periodically.
+type backgroundReconcile struct {
+	interval time.Duration
+	opts     ReconcileOptions
+}
+
+func (b *backgroundReconcile) validate() error {
+	if b == nil {
+		return nil
+	}
+	if b.interval <= 0 {
+		return fmt.Errorf("reconcile interval must be positive")
+	}
+	if err := b.opts.validate(); err != nil {
+		return err
+	}
+	if b.opts.DeleteOrphans && (b.opts.MinAge <= 0 || b.opts.MaxDeletes <= 0) {
+		return fmt.Errorf("background reconcile can only delete orphans with a minimum age and a delete limit")
+	}
+	return nil
+}
+
+// RunReconciler reconciles the table and the bucket every interval until ctx
+// is done, counting what it finds as reconcile_orphan_objects and
+// reconcile_missing_objects events. Run calls it in the background; programs
+// serving Handler themselves should do the same.
+func (s *Service) RunReconciler(ctx context.Context) {
+	if s.reconciler == nil {
+		return
+	}
+	ticker := time.NewTicker(s.reconciler.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		start := time.Now()
+		report, err := s.Reconcile(ctx, s.reconciler.opts)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			s.logger.Error("background reconcile failed", "error", err)
+		}
+		if report == nil {
+			continue
+		}
+		s.events.counts[eventReconcileOrphan].Add(int64(len(report.OrphanObjects)))
+		s.events.counts[eventReconcileMissing].Add(int64(len(report.MissingObjects)))
+		s.logger.Info("background reconcile done", "duration", time.Since(start),
+			"orphan_objects", len(report.OrphanObjects), "missing_objects", len(report.MissingObjects),
+			"deleted_orphans", report.DeletedOrphans, "flagged_missing", report.FlaggedMissing)
+	}
+}
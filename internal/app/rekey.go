@@ -0,0 +1,126 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gorilla/mux"
+)
+
+// RekeyFile moves a file's object to the key the current key prefix and
+// strategy would give it, e.g. after changing either. The object is copied
+// first and the metadata updated only if the copy succeeded; the old object
+// is deleted last, so a failure at any step leaves the file readable under
+// its old key. Variant objects keep their keys.
+func (s *Service) RekeyFile(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if err := s.sanitizeKeyComponent(id); err != nil {
+		s.writeJSONError(w, r, http.StatusBadRequest, "invalid_id", err.Error())
+		return
+	}
+	metadata, err := s.retrieveMetadataFromDB(r.Context(), id)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if metadata == nil {
+		s.writeJSONError(w, r, http.StatusNotFound, "not_found", "file not found")
+		return
+	}
+
+	updated, err := s.rekeyFile(r.Context(), metadata)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	s.audit(r, "rekey", updated)
+	s.writeResponse(w, r, http.StatusOK, updated)
+}
+
+func (s *Service) rekeyFile(ctx context.Context, metadata *FileMetadata) (*FileMetadata, error) {
+	oldKey := objectKey(metadata)
+	newKey, err := s.newObjectKey(metadata.ID, &upload{hash: metadata.Hash, ext: metadata.Extension})
+	if err != nil {
+		return nil, err
+	}
+	if newKey == oldKey {
+		return metadata, nil
+	}
+
+	// CopyObject keeps the content type, encoding, disposition and tags.
+	_, err = s.fileStorage.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(s.fileStorageBucket),
+		Key:        aws.String(newKey),
+		CopySource: aws.String(url.PathEscape(s.fileStorageBucket + "/" + oldKey)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy object: %w", err)
+	}
+	rekeyed := *metadata
+	rekeyed.Key = newKey
+
+	// The condition fails if the file was deleted or rekeyed meanwhile.
+	condition := "#key = :old"
+	if metadata.Key == "" {
+		condition = "attribute_not_exists(#key) AND attribute_exists(ID)"
+	}
+	result, err := s.db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:                aws.String(s.dbFileTableName),
+		Key:                      map[string]*dynamodb.AttributeValue{"ID": {S: aws.String(metadata.ID)}},
+		UpdateExpression:         aws.String("SET #key = :new"),
+		ConditionExpression:      aws.String(condition),
+		ExpressionAttributeNames: map[string]*string{"#key": aws.String("Key")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":old": {S: aws.String(oldKey)},
+			":new": {S: aws.String(newKey)},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueAllNew),
+	})
+	if err != nil {
+		s.removeUnreferencedObject(ctx, &rekeyed)
+		if isConditionFailed(err) {
+			return nil, newAPIError(http.StatusConflict, "file_changed", "the file was changed or deleted during the rekey")
+		}
+		return nil, fmt.Errorf("failed to update key: %w", err)
+	}
+	var updated FileMetadata
+	if err := dynamodbattribute.UnmarshalMap(result.Attributes, &updated); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal metadata: %w", err)
+	}
+	if s.metadataCache != nil {
+		s.metadataCache.put(updated)
+	}
+	if s.dedupWindow != nil {
+		s.dedupWindow.remove(updated.ID)
+	}
+
+	// The file is now served from the new key; an old object that can't be
+	// deleted is only an orphan for reconciliation.
+	s.removeUnreferencedObject(ctx, metadata)
+	return &updated, nil
+}
+
+// removeUnreferencedObject deletes the object of metadata unless it is a
+// shared object another file still refers to. Failures are logged.
+func (s *Service) removeUnreferencedObject(ctx context.Context, metadata *FileMetadata) {
+	key := objectKey(metadata)
+	if sharedObjectKey(metadata) {
+		referenced, err := s.objectReferenced(ctx, metadata)
+		if err != nil {
+			s.logger.Warn("failed to check object references", "key", key, "error", err)
+			return
+		}
+		if referenced {
+			return
+		}
+	}
+	if err := s.deleteObject(ctx, key); err != nil {
+		s.logger.Warn("failed to delete object", "key", key, "error", err)
+	}
+}
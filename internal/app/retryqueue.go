@@ -0,0 +1,175 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// gaugePendingMetadataWrites is the depth of the metadata retry queue.
+	gaugePendingMetadataWrites = "pending_metadata_writes"
+	// maxMetadataRetryDelay caps the backoff between retry rounds while
+	// DynamoDB keeps failing.
+	maxMetadataRetryDelay = 5 * time.Minute
+)
+
+var pendingMetadataBucket = []byte("pending")
+
+// metadataRetryQueue persists metadata writes that failed after the object
+// was uploaded, so they can be retried until they land instead of deleting
+// the object. The queue is a bbolt file, keyed by file ID.
+type metadataRetryQueue struct {
+	path     string
+	interval time.Duration
+	db       *bolt.DB
+	pending  atomic.Int64
+}
+
+// open opens or creates the queue file and counts the writes left over from
+// a previous run. bbolt locks the file, so only one process can use it.
+func (q *metadataRetryQueue) open() error {
+	db, err := bolt.Open(q.path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("failed to open metadata retry queue: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(pendingMetadataBucket)
+		if err != nil {
+			return err
+		}
+		q.pending.Store(int64(bucket.Stats().KeyN))
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("failed to open metadata retry queue: %w", err)
+	}
+	q.db = db
+	return nil
+}
+
+func (q *metadataRetryQueue) push(metadata FileMetadata) error {
+	value, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	return q.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(pendingMetadataBucket)
+		existed := bucket.Get([]byte(metadata.ID)) != nil
+		if err := bucket.Put([]byte(metadata.ID), value); err != nil {
+			return err
+		}
+		if !existed {
+			q.pending.Add(1)
+		}
+		return nil
+	})
+}
+
+// pendingWrites returns the queued metadata, in file ID order.
+func (q *metadataRetryQueue) pendingWrites() ([]FileMetadata, error) {
+	var writes []FileMetadata
+	err := q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(pendingMetadataBucket).ForEach(func(_, value []byte) error {
+			var metadata FileMetadata
+			if err := json.Unmarshal(value, &metadata); err != nil {
+				return err
+			}
+			writes = append(writes, metadata)
+			return nil
+		})
+	})
+	return writes, err
+}
+
+func (q *metadataRetryQueue) remove(id string) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(pendingMetadataBucket)
+		if bucket.Get([]byte(id)) == nil {
+			return nil
+		}
+		if err := bucket.Delete([]byte(id)); err != nil {
+			return err
+		}
+		q.pending.Add(-1)
+		return nil
+	})
+}
+
+// saveUploadedMetadata saves the metadata of a file whose object was just
+// uploaded. With the retry queue enabled a failed write is queued instead,
+// and the upload succeeds: the file becomes visible once a retry lands.
+// Otherwise, and if queueing fails too, the error is returned and the caller
+// deletes the object.
+func (s *Service) saveUploadedMetadata(ctx context.Context, metadata FileMetadata) error {
+	err := s.saveMetadataToDB(ctx, metadata)
+	if err == nil || s.metadataRetries == nil {
+		return err
+	}
+	if queueErr := s.metadataRetries.push(metadata); queueErr != nil {
+		s.logger.Error("failed to queue metadata write", "id", metadata.ID, "error", queueErr)
+		return err
+	}
+	s.logger.Warn("metadata write failed, queued for retry", "id", metadata.ID, "error", err,
+		"request_id", RequestIDFromContext(ctx))
+	return nil
+}
+
+// RetryMetadataWrites retries the queued metadata writes until ctx is done,
+// backing off while DynamoDB keeps failing. Run calls it in the background;
+// programs serving Handler themselves should do the same.
+func (s *Service) RetryMetadataWrites(ctx context.Context) {
+	if s.metadataRetries == nil {
+		return
+	}
+	delay := s.metadataRetries.interval
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if err := s.retryMetadataWrites(ctx); err != nil {
+			if !errors.Is(err, context.Canceled) {
+				s.logger.Warn("metadata write retry failed", "pending", s.metadataRetries.pending.Load(), "error", err)
+			}
+			delay = min(2*delay, maxMetadataRetryDelay)
+			continue
+		}
+		delay = s.metadataRetries.interval
+	}
+}
+
+// retryMetadataWrites saves every queued write, stopping at the first
+// failure since the rest would most likely fail the same way.
+func (s *Service) retryMetadataWrites(ctx context.Context) error {
+	writes, err := s.metadataRetries.pendingWrites()
+	if err != nil {
+		return err
+	}
+	for _, metadata := range writes {
+		if err := s.saveMetadataToDB(ctx, metadata); err != nil {
+			return err
+		}
+		if err := s.metadataRetries.remove(metadata.ID); err != nil {
+			return err
+		}
+		s.logger.Info("queued metadata write landed", "id", metadata.ID)
+	}
+	return nil
+}
+
+// Close releases the resources the service holds open, i.e. the metadata
+// retry queue.
+func (s *Service) Close() error {
+	if s.metadataRetries == nil || s.metadataRetries.db == nil {
+		return nil
+	}
+	return s.metadataRetries.db.Close()
+}
@@ -0,0 +1,229 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// searchPlan is how a search reads the table: a Query on index with
+// keyCondition when an index fits the parameters, a Scan otherwise. The
+// remaining parameters become filters either way.
+type searchPlan struct {
+	index        string
+	keyCondition string
+	filters      []string
+	names        map[string]*string
+	values       map[string]*dynamodb.AttributeValue
+}
+
+func (p *searchPlan) value(name string, v *dynamodb.AttributeValue) string {
+	p.values[name] = v
+	return name
+}
+
+func stringValue(s string) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{S: aws.String(s)}
+}
+
+// SearchFiles combines the file filters in one call. The parameters are
+// ext, owner, name, hash, tag (key or key:value, repeatable), min_size,
+// max_size, from and to (RFC 3339), plus order, limit, next_token and
+// with_urls as for the other listings. The most selective index the
+// parameters allow is queried; see planSearch.
+func (s *Service) SearchFiles(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	plan, err := s.planSearch(r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	limit, err := pageSize(r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	startKey, err := decodePageToken(query.Get("next_token"))
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	filter := aws.StringValue(s.listFilter(r, plan.names, plan.values))
+	for _, f := range plan.filters {
+		filter += " AND " + f
+	}
+	var items []map[string]*dynamodb.AttributeValue
+	var lastKey map[string]*dynamodb.AttributeValue
+	if plan.index != "" {
+		result, err := s.db.QueryWithContext(r.Context(), &dynamodb.QueryInput{
+			TableName:                 aws.String(s.dbFileTableName),
+			IndexName:                 aws.String(plan.index),
+			KeyConditionExpression:    aws.String(plan.keyCondition),
+			FilterExpression:          aws.String(filter),
+			ExpressionAttributeNames:  plan.names,
+			ExpressionAttributeValues: plan.values,
+			ScanIndexForward:          aws.Bool(query.Get("order") != "desc"),
+			Limit:                     aws.Int64(limit),
+			ExclusiveStartKey:         startKey,
+		})
+		if err != nil {
+			s.writeError(w, r, fmt.Errorf("failed to query DynamoDB: %w", err))
+			return
+		}
+		items, lastKey = result.Items, result.LastEvaluatedKey
+	} else {
+		input := &dynamodb.ScanInput{
+			TableName:                aws.String(s.dbFileTableName),
+			FilterExpression:         aws.String(filter),
+			ExpressionAttributeNames: plan.names,
+			Limit:                    aws.Int64(limit),
+			ExclusiveStartKey:        startKey,
+		}
+		if len(plan.values) > 0 {
+			input.ExpressionAttributeValues = plan.values
+		}
+		result, err := s.db.ScanWithContext(r.Context(), input)
+		if err != nil {
+			s.writeError(w, r, fmt.Errorf("failed to scan DynamoDB: %w", err))
+			return
+		}
+		items, lastKey = result.Items, result.LastEvaluatedKey
+	}
+
+	response, err := s.listResponse(r, items, lastKey, query.Get("with_urls") == "true")
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	s.setPageLinks(w, r, response.NextToken)
+	s.writeResponse(w, r, http.StatusOK, response)
+}
+
+// planSearch picks the index for a search, in this order: CreatedAtIndex
+// when an order is requested, HashIndex for hash, OwnerNameIndex for owner
+// and name together (if filenames are unique per owner, which creates it),
+// CreatedAtIndex for from or to, and a Scan otherwise.
+func (s *Service) planSearch(r *http.Request) (*searchPlan, error) {
+	query := r.URL.Query()
+	plan := &searchPlan{
+		names:  map[string]*string{},
+		values: map[string]*dynamodb.AttributeValue{},
+	}
+	order := query.Get("order")
+	if order != "" && order != "asc" && order != "desc" {
+		return nil, newAPIError(http.StatusBadRequest, "invalid_order", "order must be asc or desc")
+	}
+	from, to := query.Get("from"), query.Get("to")
+	hash, owner, name := strings.ToLower(query.Get("hash")), query.Get("owner"), query.Get("name")
+
+	byDate := false
+	switch {
+	case order != "":
+		byDate = true
+	case hash != "" && s.needsHashIndex():
+		plan.index = hashIndex
+		plan.keyCondition = "#hash = :hash"
+		plan.names["#hash"] = aws.String("Hash")
+		plan.values[":hash"] = stringValue(hash)
+		hash = ""
+	case owner != "" && name != "" && s.hasOwnerNameIndex():
+		plan.index = ownerNameIndex
+		plan.keyCondition = "#searchOwner = :searchOwner AND #name = :name"
+		plan.names["#searchOwner"], plan.names["#name"] = aws.String("OwnerID"), aws.String("OriginalName")
+		plan.values[":searchOwner"], plan.values[":name"] = stringValue(owner), stringValue(name)
+		owner, name = "", ""
+	case from != "" || to != "":
+		byDate = true
+	}
+	if byDate {
+		fromValue, err := parseTimeParam(from, "0001-01-01T00:00:00Z")
+		if err != nil {
+			return nil, err
+		}
+		toValue, err := parseTimeParam(to, "9999-12-31T23:59:59Z")
+		if err != nil {
+			return nil, err
+		}
+		if fromValue > toValue {
+			return nil, newAPIError(http.StatusBadRequest, "invalid_range", "from must not be after to")
+		}
+		plan.index = s.createdAtIndex
+		plan.keyCondition = "#kind = :kind AND #created BETWEEN :from AND :to"
+		plan.names["#kind"], plan.names["#created"] = aws.String("Kind"), aws.String("CreatedAt")
+		plan.values[":kind"] = stringValue(fileKind)
+		plan.values[":from"], plan.values[":to"] = stringValue(fromValue), stringValue(toValue)
+		from, to = "", ""
+	}
+
+	// Whatever the index did not cover is filtered.
+	equal := func(param, attr, value string) {
+		if value == "" {
+			return
+		}
+		plan.names["#"+param] = aws.String(attr)
+		plan.filters = append(plan.filters, fmt.Sprintf("#%s = %s", param, plan.value(":"+param, stringValue(value))))
+	}
+	ext := query.Get("ext")
+	if ext != "" && !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	equal("ext", "Extension", ext)
+	equal("hash", "Hash", hash)
+	equal("searchOwner", "OwnerID", owner)
+	equal("name", "OriginalName", name)
+	bounds := []struct{ param, attr, op, value string }{
+		{"from", "CreatedAt", ">=", from},
+		{"to", "CreatedAt", "<=", to},
+		{"min_size", "Size", ">=", query.Get("min_size")},
+		{"max_size", "Size", "<=", query.Get("max_size")},
+	}
+	for _, b := range bounds {
+		if b.value == "" {
+			continue
+		}
+		var v *dynamodb.AttributeValue
+		if b.attr == "Size" {
+			size, err := strconv.ParseInt(b.value, 10, 64)
+			if err != nil || size < 0 {
+				return nil, newAPIError(http.StatusBadRequest, "invalid_size", b.param+" must be a non-negative integer")
+			}
+			v = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(size, 10))}
+		} else {
+			t, err := parseTimeParam(b.value, "")
+			if err != nil {
+				return nil, err
+			}
+			v = stringValue(t)
+		}
+		attrName := "#" + strings.ToLower(b.attr)
+		plan.names[attrName] = aws.String(b.attr)
+		plan.filters = append(plan.filters, fmt.Sprintf("%s %s %s", attrName, b.op, plan.value(":"+b.param, v)))
+	}
+	for i, tag := range query["tag"] {
+		key, value, hasValue := strings.Cut(tag, ":")
+		if key == "" {
+			return nil, newAPIError(http.StatusBadRequest, "invalid_tag", "tag must be key or key:value")
+		}
+		plan.names["#tags"] = aws.String("Tags")
+		tagName := fmt.Sprintf("#tag%d", i)
+		plan.names[tagName] = aws.String(key)
+		if hasValue {
+			v := plan.value(fmt.Sprintf(":tag%d", i), stringValue(value))
+			plan.filters = append(plan.filters, fmt.Sprintf("#tags.%s = %s", tagName, v))
+		} else {
+			plan.filters = append(plan.filters, fmt.Sprintf("attribute_exists(#tags.%s)", tagName))
+		}
+	}
+	return plan, nil
+}
+
+// hasOwnerNameIndex reports whether the table has OwnerNameIndex, which is
+// only created along with a filename policy.
+func (s *Service) hasOwnerNameIndex() bool {
+	return s.filenamePolicy != FilenamesAllowDuplicates
+}
@@ -0,0 +1,63 @@
+package app
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Serializer encodes response bodies in one media type.
+type Serializer interface {
+	ContentType() string
+	Encode(w io.Writer, v any) error
+}
+
+type jsonSerializer struct{}
+
+func (jsonSerializer) ContentType() string { return "application/json" }
+
+func (jsonSerializer) Encode(w io.Writer, v any) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+// msgpackSerializer reuses the json struct tags, omitempty included, so both
+// formats carry the same fields under the same names.
+type msgpackSerializer struct{}
+
+func (msgpackSerializer) ContentType() string { return "application/msgpack" }
+
+func (msgpackSerializer) Encode(w io.Writer, v any) error {
+	enc := msgpack.NewEncoder(w)
+	enc.SetCustomStructTag("json")
+	return enc.Encode(v)
+}
+
+// negotiateSerializer picks MessagePack when the client accepts it and JSON
+// otherwise.
+func negotiateSerializer(r *http.Request) Serializer {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil || params["q"] == "0" {
+			continue
+		}
+		if mediaType == "application/msgpack" || mediaType == "application/x-msgpack" {
+			return msgpackSerializer{}
+		}
+	}
+	return jsonSerializer{}
+}
+
+// writeResponse writes v with status in the format negotiated for r.
+func (s *Service) writeResponse(w http.ResponseWriter, r *http.Request, status int, v any) {
+	serializer := negotiateSerializer(r)
+	w.Header().Set("Content-Type", serializer.ContentType())
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(status)
+	if err := serializer.Encode(w, v); err != nil {
+		s.logger.Error("failed to encode response", "error", err)
+	}
+}
@@ -0,0 +1,52 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// TestMsgpackMatchesJSONFields checks that both formats carry the same
+// fields: zero values without omitempty are kept, omitempty ones dropped.
+func TestMsgpackMatchesJSONFields(t *testing.T) {
+	for _, v := range []any{
+		BatchResponse{Results: []BatchFileResult{{Filename: "a.jpg", Deduplicated: false}}},
+		ListFilesResponse{Files: []ListedFile{}},
+	} {
+		var jsonBody, msgpackBody bytes.Buffer
+		if err := (jsonSerializer{}).Encode(&jsonBody, v); err != nil {
+			t.Fatal(err)
+		}
+		if err := (msgpackSerializer{}).Encode(&msgpackBody, v); err != nil {
+			t.Fatal(err)
+		}
+		var fromJSON, fromMsgpack map[string]any
+		if err := json.Unmarshal(jsonBody.Bytes(), &fromJSON); err != nil {
+			t.Fatal(err)
+		}
+		if err := msgpack.Unmarshal(msgpackBody.Bytes(), &fromMsgpack); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(normalize(t, fromJSON), normalize(t, fromMsgpack)) {
+			t.Errorf("%T: msgpack %v, json %v", v, fromMsgpack, fromJSON)
+		}
+	}
+}
+
+// normalize round-trips v through JSON so that numbers and slices decoded
+// from either format compare equal.
+func normalize(t *testing.T, v map[string]any) map[string]any {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]any
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
@@ -2,29 +2,136 @@ package app
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/google/uuid"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/gorilla/mux"
+	"golang.org/x/sync/singleflight"
 	"io"
+	"log/slog"
+	"maps"
 	"net/http"
-	"path/filepath"
+	"os"
+	"os/signal"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 type Service struct {
-	router            *mux.Router
-	fileStorage       *s3.S3
-	fileStorageBucket string
-	db                *dynamodb.DynamoDB
-	dbFileTableName   string
+	router                 *mux.Router
+	fileStorage            *s3.S3
+	fileStorageBucket      string
+	db                     *dynamodb.DynamoDB
+	dbFileTableName        string
+	batchDedup             bool
+	keyPrefix              string
+	reservedKeyPrefixes    []string
+	retryAfter             time.Duration
+	logger                 *slog.Logger
+	accessLog              *accessLogger
+	requireFilename        bool
+	extensionSource        ExtensionSource
+	presignExpiry          time.Duration
+	redirectExpiry         time.Duration
+	maxPresignExpiry       time.Duration
+	principalFunc          func(*http.Request) string
+	auditSink              AuditSink
+	recentPerceptualHashes *recentPerceptualHashes
+	nearDuplicateDistance  int
+	maxUploadSize          int64
+	uploadBudget           *uploadMemoryBudget
+	strictJSON             bool
+	defaultOwner           string
+	s3Checksum             bool
+	metadataCache          *metadataCache
+	secondaryStore         *objectStore
+	lowercaseExtensions    bool
+	uploadBodyTimeout      time.Duration
+	compressTypes          map[string]bool
+	maxFilenameLength      int
+	truncateFilenames      bool
+	debugCapture           *debugCapture
+	epochTimestamps        bool
+	createdAtIndex         string
+	uploadConcurrency      int
+	uploadPartSize         int64
+	uploader               *s3manager.Uploader
+	// ready is set once EnsureInfrastructure has succeeded.
+	ready                atomic.Bool
+	routeTimeouts        *routeTimeouts
+	problemJSON          bool
+	tagRules             []TagRule
+	coalesceUploads      bool
+	uploadGroup          singleflight.Group
+	securityHeaders      map[string]string
+	tagLimits            tagLimits
+	httpsOnlyURLs        bool
+	blocklist            HashBlocklist
+	imageDecodeTimeout   time.Duration
+	maxImagePixels       int64
+	diskCache            *diskCache
+	blurHash             bool
+	dominantColor        bool
+	serviceName          string
+	serviceVersion       string
+	acceptAnyImage       bool
+	presignCache         *presignCache
+	stats                *storageStats
+	preUploadHooks       []PreUploadHook
+	postUploadHooks      []PostUploadHook
+	eventPublishers      []EventPublisher
+	keyStrategy          KeyStrategy
+	tableBilling         TableBilling
+	hashScan             bool
+	maskErrors           bool
+	admins               map[string]struct{}
+	adminFunc            func(*http.Request) bool
+	uploads              uploadTracker
+	uploadDrainTimeout   time.Duration
+	softDelete           bool
+	dedupWindow          *dedupWindow
+	events               *eventCounters
+	filenamePolicy       FilenamePolicy
+	locationFields       bool
+	downloadTokenKey     []byte
+	debugStats           bool
+	streamThreshold      int64
+	dedup                bool
+	immutableMaxAge      time.Duration
+	dimensionBounds      DimensionBounds
+	extensionKeyPrefixes map[string]string
+	slowDownBackoff      *SlowDownBackoff
+	uploaderInfo         *uploaderInfo
+	flagMissingObjects   bool
+	downloadLimiter      *downloadLimiter
+	tagSchema            TagSchema
+	pageLinks            *pageLinks
+	deadline             *RequestDeadline
+	contentTypeOverrides ContentTypeOverrides
+	metadataRetries      *metadataRetryQueue
+	requireContentLength bool
+	reconciler           *backgroundReconcile
+	processing           *processingPool
+	notReadyConflict     bool
+	presignDisposition   string
+	batchConcurrency     int
+	batchStats           map[string]*batchStats
+	presignLimiter       *presignLimiter
+	idGenerator          IDGenerator
+	clock                Clock
+	multipartMaxMemory   int64
+	eventFormat          EventFormat
+	eventSource          string
 }
 
 func NewService(
@@ -32,80 +139,447 @@ func NewService(
 	fileStorageBucket string,
 	db *dynamodb.DynamoDB,
 	dbFileTableName string,
-) *Service {
+	opts ...Option,
+) (*Service, error) {
 	service := &Service{
-		router:            mux.NewRouter(),
-		fileStorage:       fileStorage,
-		fileStorageBucket: fileStorageBucket,
-		db:                db,
-		dbFileTableName:   dbFileTableName,
+		router:              mux.NewRouter(),
+		fileStorage:         fileStorage,
+		fileStorageBucket:   fileStorageBucket,
+		db:                  db,
+		dbFileTableName:     dbFileTableName,
+		batchDedup:          true,
+		reservedKeyPrefixes: defaultReservedKeyPrefixes,
+		retryAfter:          defaultRetryAfter,
+		logger:              slog.Default(),
+		requireFilename:     true,
+		presignExpiry:       defaultPresignExpiry,
+		redirectExpiry:      defaultRedirectExpiry,
+		maxPresignExpiry:    maxSigV4Expiry,
+		strictJSON:          true,
+		lowercaseExtensions: true,
+		maxFilenameLength:   defaultMaxFilenameLength,
+		createdAtIndex:      defaultCreatedAtIndex,
+		uploadConcurrency:   s3manager.DefaultUploadConcurrency,
+		uploadPartSize:      s3manager.DefaultUploadPartSize,
+		coalesceUploads:     true,
+		keyStrategy:         KeyStrategyID,
+		maskErrors:          true,
+		events:              newEventCounters(),
+		uploadDrainTimeout:  defaultUploadDrainTimeout,
+		tableBilling:        TableBilling{Mode: dynamodb.BillingModePayPerRequest},
+		securityHeaders:     maps.Clone(defaultSecurityHeaders),
+		tagLimits:           tagLimits{maxTags: defaultMaxTags, maxKeyLen: defaultMaxTagKeyLen, maxValueLen: defaultMaxTagValueLen},
+		imageDecodeTimeout:  defaultImageDecodeTimeout,
+		maxImagePixels:      defaultMaxImagePixels,
+		serviceName:         defaultServiceName,
+		serviceVersion:      defaultServiceVersion,
+		dedup:               true,
+		batchConcurrency:    defaultBatchConcurrency,
+		batchStats:          newBatchStats(),
+		idGenerator:         uuidGenerator{},
+		clock:               systemClock{},
+		multipartMaxMemory:  defaultMultipartMaxMemory,
+		eventFormat:         EventFormatRaw,
+	}
+	for _, opt := range opts {
+		opt(service)
+	}
+	if err := service.validate(); err != nil {
+		return nil, err
+	}
+	if service.hashScan && service.dedup {
+		service.logger.Warn("content hash lookups scan the whole table; only use this with small tables", "table", service.dbFileTableName)
+	}
+	if service.eventSource == "" {
+		service.eventSource = service.serviceName
+	}
+	service.uploader = s3manager.NewUploaderWithClient(fileStorage, func(u *s3manager.Uploader) {
+		u.Concurrency = service.uploadConcurrency
+		u.PartSize = service.uploadPartSize
+	})
+	service.instrumentClient(&fileStorage.Handlers)
+	service.instrumentClient(&db.Handlers)
+	service.instrumentS3Client(fileStorage)
+	if service.secondaryStore != nil {
+		service.instrumentClient(&service.secondaryStore.client.Handlers)
+		service.instrumentS3Client(service.secondaryStore.client)
+	}
+	if service.diskCache != nil {
+		if err := service.diskCache.init(); err != nil {
+			return nil, err
+		}
+	}
+	if service.metadataRetries != nil {
+		if err := service.metadataRetries.open(); err != nil {
+			return nil, err
+		}
+	}
+	if service.processing != nil {
+		service.startProcessing()
 	}
 	service.routes()
-	return service
+	if service.routeTimeouts != nil {
+		if err := service.routeTimeouts.validate(service.router); err != nil {
+			return nil, err
+		}
+		service.router.Use(service.routeTimeouts.middleware)
+	}
+	if service.deadline != nil {
+		service.router.Use(service.requestDeadline)
+	}
+	return service, nil
+}
+
+func (s *Service) validate() error {
+	if err := s.eventFormat.validate(); err != nil {
+		return err
+	}
+	if s.idGenerator == nil || s.clock == nil {
+		return fmt.Errorf("ID generator and clock must not be nil")
+	}
+	if s.presignExpiry <= 0 || s.presignExpiry > s.maxPresignExpiry {
+		return fmt.Errorf("presign expiry %s must be positive and at most %s", s.presignExpiry, s.maxPresignExpiry)
+	}
+	if s.redirectExpiry <= 0 || s.redirectExpiry > s.maxPresignExpiry {
+		return fmt.Errorf("redirect expiry %s must be positive and at most %s", s.redirectExpiry, s.maxPresignExpiry)
+	}
+	if s.multipartMaxMemory <= 0 {
+		return fmt.Errorf("multipart max memory must be positive")
+	}
+	if s.batchConcurrency <= 0 {
+		return fmt.Errorf("batch concurrency must be positive")
+	}
+	if s.presignDisposition != "" && s.presignDisposition != "inline" && s.presignDisposition != "attachment" {
+		return fmt.Errorf("presigned disposition %q must be inline or attachment", s.presignDisposition)
+	}
+	if s.maxPresignExpiry > maxSigV4Expiry {
+		return fmt.Errorf("max presign expiry %s exceeds the SigV4 limit of %s", s.maxPresignExpiry, maxSigV4Expiry)
+	}
+	if s.recentPerceptualHashes != nil {
+		if s.recentPerceptualHashes.size <= 0 {
+			return fmt.Errorf("near-duplicate window must be positive")
+		}
+		if s.nearDuplicateDistance < 0 || s.nearDuplicateDistance > 64 {
+			return fmt.Errorf("near-duplicate distance %d must be between 0 and 64", s.nearDuplicateDistance)
+		}
+	}
+	if s.uploadBudget != nil && s.uploadBudget.capacity <= 0 {
+		return fmt.Errorf("upload memory budget must be positive")
+	}
+	if s.presignLimiter != nil && s.presignLimiter.max <= 0 {
+		return fmt.Errorf("maximum concurrent presigns must be positive")
+	}
+	if s.metadataCache != nil && (s.metadataCache.size <= 0 || s.metadataCache.ttl <= 0) {
+		return fmt.Errorf("degraded read cache size and max age must be positive")
+	}
+	if s.metadataRetries != nil && s.metadataRetries.interval <= 0 {
+		return fmt.Errorf("metadata retry interval must be positive")
+	}
+	if s.downloadLimiter != nil && s.downloadLimiter.limit <= 0 {
+		return fmt.Errorf("max downloads per file must be positive")
+	}
+	if err := s.processing.validate(); err != nil {
+		return err
+	}
+	if err := s.reconciler.validate(); err != nil {
+		return err
+	}
+	if err := s.deadline.validate(); err != nil {
+		return err
+	}
+	if err := s.slowDownBackoff.validate(); err != nil {
+		return err
+	}
+	if err := s.dimensionBounds.validate(); err != nil {
+		return err
+	}
+	if s.maxFilenameLength <= 0 {
+		return fmt.Errorf("max filename length must be positive")
+	}
+	if s.imageDecodeTimeout <= 0 || s.maxImagePixels <= 0 {
+		return fmt.Errorf("image decode timeout and pixel limit must be positive")
+	}
+	if s.serviceName == "" || s.serviceVersion == "" || strings.ContainsAny(s.serviceName+s.serviceVersion, " /()") {
+		return fmt.Errorf("service name and version must be non-empty and free of spaces, slashes and parentheses")
+	}
+	if s.downloadTokenKey != nil && len(s.downloadTokenKey) < minDownloadTokenKeyLength {
+		return fmt.Errorf("download token key must be at least %d bytes", minDownloadTokenKeyLength)
+	}
+	switch s.filenamePolicy {
+	case FilenamesAllowDuplicates, FilenamesVersion, FilenamesReject, FilenamesOverwrite:
+	default:
+		return fmt.Errorf("unknown filename policy %q", s.filenamePolicy)
+	}
+	if !s.dedup {
+		switch {
+		case s.keyStrategy == KeyStrategyContentHash:
+			return fmt.Errorf("content-hash keys require dedup")
+		case s.recentPerceptualHashes != nil:
+			return fmt.Errorf("near-duplicate detection requires dedup")
+		}
+	}
+	if s.dedupWindow != nil && s.dedupWindow.window <= 0 {
+		return fmt.Errorf("upload dedup window must be positive")
+	}
+	if s.streamThreshold < 0 {
+		return fmt.Errorf("streaming upload threshold must not be negative")
+	}
+	if s.uploadDrainTimeout < 0 {
+		return fmt.Errorf("upload drain timeout must not be negative")
+	}
+	if err := s.tableBilling.validate(); err != nil {
+		return err
+	}
+	if s.keyStrategy != KeyStrategyID && s.keyStrategy != KeyStrategyContentHash {
+		return fmt.Errorf("unknown key strategy %q", s.keyStrategy)
+	}
+	if s.stats != nil && s.stats.db == nil {
+		return fmt.Errorf("storage ceiling requires a stats table")
+	}
+	if s.stats != nil && s.stats.ceiling > 0 && s.stats.maxStaleness <= 0 {
+		return fmt.Errorf("storage ceiling staleness must be positive")
+	}
+	if s.presignCache != nil && (s.presignCache.window <= 0 || s.presignCache.size <= 0) {
+		return fmt.Errorf("presign cache window and size must be positive")
+	}
+	if s.diskCache != nil && (s.diskCache.dir == "" || s.diskCache.maxBytes <= 0) {
+		return fmt.Errorf("download cache needs a directory and a positive size")
+	}
+	if s.tagLimits.maxTags <= 0 || s.tagLimits.maxKeyLen <= 0 || s.tagLimits.maxValueLen <= 0 {
+		return fmt.Errorf("tag limits must be positive")
+	}
+	if s.httpsOnlyURLs {
+		if err := checkHTTPSEndpoint(s.fileStorage); err != nil {
+			return err
+		}
+		if s.secondaryStore != nil {
+			if err := checkHTTPSEndpoint(s.secondaryStore.client); err != nil {
+				return err
+			}
+		}
+	}
+	if err := s.contentTypeOverrides.validate(); err != nil {
+		return err
+	}
+	if err := s.tagSchema.validate(); err != nil {
+		return err
+	}
+	if err := validateTagRules(s.tagRules); err != nil {
+		return err
+	}
+	if len(s.tagRules) > 0 && s.keyStrategy == KeyStrategyContentHash {
+		// A shared object keeps the tags of its first upload, which a
+		// lifecycle rule could expire while later files still refer to it.
+		return fmt.Errorf("object tag rules can't be combined with content-hash keys")
+	}
+	if s.uploadConcurrency < 1 || s.uploadConcurrency > maxUploadConcurrency {
+		return fmt.Errorf("upload concurrency %d must be between 1 and %d", s.uploadConcurrency, maxUploadConcurrency)
+	}
+	if s.uploadPartSize < s3manager.MinUploadPartSize || s.uploadPartSize > maxUploadPartSize {
+		return fmt.Errorf("upload part size %d must be between %d and %d bytes", s.uploadPartSize, s3manager.MinUploadPartSize, maxUploadPartSize)
+	}
+	return nil
 }
 
 func (s *Service) routes() {
+	s.router.HandleFunc("/healthz", s.Healthz).Methods(http.MethodGet)
+	s.router.HandleFunc("/ready", s.Ready).Methods(http.MethodGet)
 	s.router.HandleFunc("/file/{id}", s.GetFile).Methods(http.MethodGet)
 	s.router.HandleFunc("/file/{id}", s.DeleteFile).Methods(http.MethodDelete)
-	s.router.HandleFunc("/file", s.CreateFile).Methods(http.MethodPost)
+	s.router.HandleFunc("/file/{id}/checksum", s.GetFileChecksum).Methods(http.MethodGet)
+	s.router.HandleFunc("/file/{id}/status", s.GetFileStatus).Methods(http.MethodGet)
+	s.router.HandleFunc("/file/{id}/tags", s.UpdateFileTags).Methods(http.MethodPatch)
+	s.router.HandleFunc("/file/{id}/download", s.DownloadFile).Methods(http.MethodGet)
+	s.router.Handle("/file/{id}/rekey", s.requireAdmin(http.HandlerFunc(s.RekeyFile))).Methods(http.MethodPost)
+	s.router.Handle("/file/{id}/inspect", s.requireAdmin(http.HandlerFunc(s.InspectFile))).Methods(http.MethodGet)
+	s.router.HandleFunc("/file", s.trackUploads(s.captureFailures(s.limitUploads(s.CreateFile, true)))).Methods(http.MethodPost)
+	s.router.HandleFunc("/files", s.ListFiles).Methods(http.MethodGet)
+	s.router.HandleFunc("/files/export", s.ExportFiles).Methods(http.MethodGet)
+	s.router.HandleFunc("/files/by-date", s.ListFilesByDate).Methods(http.MethodGet)
+	s.router.HandleFunc("/files/search", s.SearchFiles).Methods(http.MethodGet)
+	s.router.HandleFunc("/files/batch", s.trackUploads(s.captureFailures(s.limitUploads(s.CreateFiles, false)))).Methods(http.MethodPost)
+	s.router.HandleFunc("/files/batch/delete", s.DeleteFiles).Methods(http.MethodPost)
+
+	if s.stats != nil {
+		s.router.HandleFunc("/stats", s.GetStats).Methods(http.MethodGet)
+	}
+	if s.debugStats {
+		s.router.HandleFunc("/debug/stats", s.GetDebugStats).Methods(http.MethodGet)
+	}
+
+	admin := s.router.PathPrefix("/admin").Subrouter()
+	admin.Use(s.requireAdmin)
+	if s.blocklist != nil {
+		admin.HandleFunc("/blocklist", s.BlockHash).Methods(http.MethodPost)
+	}
+	if s.softDelete {
+		admin.HandleFunc("/purge", s.PurgeFiles).Methods(http.MethodPost)
+		admin.HandleFunc("/file/{id}/restore", s.RestoreFile).Methods(http.MethodPost)
+	}
+}
+
+// Handler returns the service routes wrapped in its middleware.
+func (s *Service) Handler() http.Handler {
+	var handler http.Handler = s.router
+	if s.accessLog != nil {
+		handler = s.accessLog.middleware(handler)
+	}
+	if len(s.securityHeaders) > 0 {
+		handler = securityHeadersMiddleware(s.securityHeaders, handler)
+	}
+	return requestIDMiddleware(handler)
 }
 
+// Run serves on port until SIGINT or SIGTERM, then shuts down gracefully:
+// new uploads are rejected and those in flight get the upload drain timeout
+// to finish before they are cancelled, after which the remaining requests
+// get a short grace period.
 func (s *Service) Run(port string) error {
-	fmt.Printf("Starting server on %s...\n", port)
-	return http.ListenAndServe(port, s.router)
+	return s.RunContext(context.Background(), port)
+}
+
+// RunContext is Run that also shuts down gracefully when ctx is done.
+func (s *Service) RunContext(ctx context.Context, port string) error {
+	server := &http.Server{Addr: port, Handler: s.Handler()}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	s.logger.Info("starting server", "addr", port)
+	// Background work stops with the shutdown signal.
+	go s.RetryMetadataWrites(ctx)
+	go s.RunReconciler(ctx)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	stop()
+
+	s.logger.Info("shutting down")
+	s.drainUploads(s.uploadDrainTimeout)
+	s.drainProcessing(s.uploadDrainTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		s.logger.Warn("requests still running at shutdown were cut off", "error", err)
+		return server.Close()
+	}
+	return nil
 }
 
 type FileMetadata struct {
 	ID        string `json:"id" dynamodbav:"ID"`
 	Hash      string `json:"hash" dynamodbav:"Hash"`
 	Extension string `json:"extension" dynamodbav:"Extension"`
-	CreatedAt string `json:"created_at" dynamodbav:"CreatedAt"`
-	UpdatedAt string `json:"updated_at" dynamodbav:"UpdatedAt"`
+	Key       string `json:"key,omitempty" dynamodbav:"Key,omitempty"`
+	OwnerID   string `json:"owner_id,omitempty" dynamodbav:"OwnerID,omitempty"`
+	// Region is the region of the bucket the file was written to.
+	Region string `json:"region,omitempty" dynamodbav:"Region,omitempty"`
+	// Variants maps a variant name (e.g. "thumbnail") to its object key.
+	Variants map[string]string `json:"variants,omitempty" dynamodbav:"Variants,omitempty"`
+	// PHash is the hex dHash used for near-duplicate detection, when enabled.
+	PHash       string `json:"phash,omitempty" dynamodbav:"PHash,omitempty"`
+	ContentType string `json:"content_type,omitempty" dynamodbav:"ContentType,omitempty"`
+	// OriginalName is the cleaned filename the file was uploaded with.
+	OriginalName string `json:"original_name,omitempty" dynamodbav:"OriginalName,omitempty"`
+	// Size is the size of the uploaded content. When the object is stored
+	// compressed, ContentEncoding is set and StoredSize is its size in S3.
+	Size            int64  `json:"size,omitempty" dynamodbav:"Size,omitempty"`
+	ContentEncoding string `json:"content_encoding,omitempty" dynamodbav:"ContentEncoding,omitempty"`
+	StoredSize      int64  `json:"stored_size,omitempty" dynamodbav:"StoredSize,omitempty"`
+	CreatedAt       string `json:"created_at" dynamodbav:"CreatedAt"`
+	UpdatedAt       string `json:"updated_at" dynamodbav:"UpdatedAt"`
+	// Version numbers files sharing a name when filenames are versioned; the
+	// first one has none.
+	Version int `json:"version,omitempty" dynamodbav:"Version,omitempty"`
+	// DeletedAt is set on files deleted with soft delete enabled, until they
+	// are purged.
+	DeletedAt string `json:"deleted_at,omitempty" dynamodbav:"DeletedAt,omitempty"`
+	// UploaderIP and UploaderUserAgent identify the client that uploaded the
+	// file, when recorded. Only admins and the owner see them.
+	UploaderIP        string `json:"uploader_ip,omitempty" dynamodbav:"UploaderIP,omitempty"`
+	UploaderUserAgent string `json:"uploader_user_agent,omitempty" dynamodbav:"UploaderUserAgent,omitempty"`
+	// ObjectMissingAt is set when a verified read found the object missing,
+	// if missing objects are flagged.
+	ObjectMissingAt string `json:"object_missing_at,omitempty" dynamodbav:"ObjectMissingAt,omitempty"`
+	// ObjectETag is the ETag S3 gives the stored object, without quotes:
+	// the MD5 of the content, or for multipart uploads the MD5 of the part
+	// MD5s with a "-<parts>" suffix.
+	ObjectETag string `json:"object_etag,omitempty" dynamodbav:"ObjectETag,omitempty"`
+	// Status is the processing state of files processed in the background;
+	// files processed at upload have none. ProcessingError is set when the
+	// status is failed.
+	Status          FileStatus `json:"status,omitempty" dynamodbav:"Status,omitempty"`
+	ProcessingError string     `json:"processing_error,omitempty" dynamodbav:"ProcessingError,omitempty"`
+	// Width and Height are the image dimensions in pixels.
+	Width  int `json:"width,omitempty" dynamodbav:"Width,omitempty"`
+	Height int `json:"height,omitempty" dynamodbav:"Height,omitempty"`
+	// BlurHash is a compact placeholder of the image, when enabled.
+	BlurHash string `json:"blurhash,omitempty" dynamodbav:"BlurHash,omitempty"`
+	// DominantColor is the average color of the image as "#rrggbb", when
+	// enabled.
+	DominantColor string `json:"dominant_color,omitempty" dynamodbav:"DominantColor,omitempty"`
+	// Tags are the client-supplied tags of the file.
+	Tags map[string]string `json:"tags,omitempty" dynamodbav:"Tags,omitempty"`
+	// ObjectTags are the S3 object tags applied by the tag rules.
+	ObjectTags map[string]string `json:"object_tags,omitempty" dynamodbav:"ObjectTags,omitempty"`
+	// Kind is the constant partition key of the CreatedAt index.
+	Kind string `json:"-" dynamodbav:"Kind,omitempty"`
+	// CreatedAtEpoch and UpdatedAtEpoch mirror the timestamps as epoch seconds
+	// (DynamoDB numbers) for numeric range queries and TTL. They are only
+	// stored with WithEpochTimestamps and never returned to clients.
+	CreatedAtEpoch int64 `json:"-" dynamodbav:"CreatedAtEpoch,omitempty"`
+	UpdatedAtEpoch int64 `json:"-" dynamodbav:"UpdatedAtEpoch,omitempty"`
 }
 
-func validateFile(file io.Reader, fileHeader string) (string, error) {
-	ext := filepath.Ext(fileHeader)
-	if ext != ".jpeg" && ext != ".jpg" {
-		return "", fmt.Errorf("only JPEG files are allowed")
+// uploadToS3 stores body as the object of metadata, with the headers S3
+// should serve it with. hash is the hex SHA-256 of body, or empty if it is
+// not known before body has been read.
+func (s *Service) uploadToS3(ctx context.Context, metadata *FileMetadata, body io.Reader, hash string) error {
+	input := &s3manager.UploadInput{
+		Bucket:      aws.String(s.fileStorageBucket),
+		Key:         aws.String(objectKey(metadata)),
+		Body:        body,
+		ContentType: aws.String(metadata.ContentType),
 	}
-
-	buffer := make([]byte, 512)
-	_, err := file.Read(buffer)
-	if err != nil {
-		return "", fmt.Errorf("failed to read file: %w", err)
+	if metadata.ContentEncoding != "" {
+		input.ContentEncoding = aws.String(metadata.ContentEncoding)
 	}
-	if mimeType := http.DetectContentType(buffer); mimeType != "image/jpeg" {
-		return "", fmt.Errorf("file is not a valid JPEG image")
+	if len(metadata.ObjectTags) > 0 {
+		input.Tagging = aws.String(encodeObjectTags(metadata.ObjectTags))
 	}
-	return ext, nil
-}
-
-func (s *Service) generatePresignedURL(objectKey string) (string, error) {
-	req, _ := s.fileStorage.GetObjectRequest(&s3.GetObjectInput{
-		Bucket: aws.String(s.fileStorageBucket),
-		Key:    aws.String(objectKey),
-	})
-
-	presignedURL, err := req.Presign(15 * time.Minute)
+	if metadata.OriginalName != "" {
+		input.ContentDisposition = aws.String(contentDisposition("inline", metadata.OriginalName))
+	}
+	if s.s3Checksum && hash != "" {
+		// S3 verifies the body against the checksum and stores it, so it can
+		// later be read back with HeadObject.
+		checksum, err := hexToBase64(hash)
+		if err != nil {
+			return fmt.Errorf("invalid content hash: %w", err)
+		}
+		input.ChecksumAlgorithm = aws.String(s3.ChecksumAlgorithmSha256)
+		input.ChecksumSHA256 = aws.String(checksum)
+	}
+	// The uploader switches to a multipart upload for bodies larger than the
+	// part size; S3 then ignores the whole-object checksum.
+	output, err := s.uploader.UploadWithContext(ctx, input)
 	if err != nil {
-		return "", err
+		return err
 	}
-
-	presignedURL = replaceLocalstackHostWithLocalhost(presignedURL)
-
-	return presignedURL, nil
-}
-
-func (s *Service) uploadToS3(objectKey string, fileBuffer []byte) error {
-	_, err := s.fileStorage.PutObject(&s3.PutObjectInput{
-		Bucket: aws.String(s.fileStorageBucket),
-		Key:    aws.String(objectKey),
-		Body:   bytes.NewReader(fileBuffer),
-	})
-	return err
+	if etag := strings.Trim(aws.StringValue(output.ETag), `"`); metadata.ObjectETag != "" && etag != metadata.ObjectETag {
+		// Expected for encryption with KMS keys, whose ETags aren't MD5s.
+		s.logger.Warn("object ETag differs from the computed one", "key", objectKey(metadata),
+			"etag", etag, "computed", metadata.ObjectETag)
+	}
+	return nil
 }
 
-func (s *Service) saveMetadataToDB(metadata FileMetadata) error {
+func (s *Service) saveMetadataToDB(ctx context.Context, metadata FileMetadata) error {
 	if metadata.ID == "" || metadata.Hash == "" {
 		return fmt.Errorf("metadata must have non-empty ID and Hash")
 	}
@@ -115,170 +589,580 @@ func (s *Service) saveMetadataToDB(metadata FileMetadata) error {
 		return fmt.Errorf("failed to marshal metadata: %w", err)
 	}
 
-	_, err = s.db.PutItem(&dynamodb.PutItemInput{
+	_, err = s.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
 		TableName: aws.String(s.dbFileTableName),
 		Item:      item,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to save metadata to DynamoDB: %w", err)
 	}
+	if s.metadataCache != nil {
+		s.metadataCache.put(metadata)
+	}
 
 	return nil
 }
 
-func (s *Service) retrieveMetadataFromDB(id string) (*FileMetadata, error) {
-	result, err := s.db.GetItem(&dynamodb.GetItemInput{
+func (s *Service) retrieveMetadataFromDB(ctx context.Context, id string) (*FileMetadata, error) {
+	result, err := s.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
 		TableName: aws.String(s.dbFileTableName),
 		Key: map[string]*dynamodb.AttributeValue{
 			"ID": {S: aws.String(id)},
 		},
 	})
-	if err != nil || result.Item == nil {
+	if err != nil {
 		return nil, err
 	}
+	if result.Item == nil {
+		if s.metadataCache != nil {
+			s.metadataCache.remove(id)
+		}
+		return nil, nil
+	}
 	var metadata FileMetadata
-	err = dynamodbattribute.UnmarshalMap(result.Item, &metadata)
-	return &metadata, err
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &metadata); err != nil {
+		return nil, err
+	}
+	// Soft-deleted files only exist for purging.
+	if metadata.DeletedAt != "" {
+		if s.metadataCache != nil {
+			s.metadataCache.remove(id)
+		}
+		return nil, nil
+	}
+	if s.metadataCache != nil {
+		s.metadataCache.put(metadata)
+	}
+	return &metadata, nil
 }
 
+// FileResponse carries the presigned URL of the original in PresignedURL and,
+// when the file has variants, one URL per variant in URLs (including the
+// original under "original").
 type FileResponse struct {
-	Metadata     *FileMetadata `json:"metadata"`
-	PresignedURL string        `json:"presigned_url"`
+	Metadata     *FileMetadata     `json:"metadata"`
+	PresignedURL string            `json:"presigned_url,omitempty"`
+	URLs         map[string]string `json:"urls,omitempty"`
+	// Degraded is set when the metadata was served from cache because
+	// DynamoDB was unavailable.
+	Degraded bool `json:"degraded,omitempty"`
+	// DownloadURL is a signed link to the download endpoint, valid as long
+	// as the presigned URL, when download tokens are enabled.
+	DownloadURL string `json:"download_url,omitempty"`
+	// Backend and Region locate the bucket the URLs point to, when enabled.
+	Backend string `json:"backend,omitempty"`
+	Region  string `json:"region,omitempty"`
+	// StatusURL is where to poll the processing status of a file that isn't
+	// ready; such responses have no URLs.
+	StatusURL string `json:"status_url,omitempty"`
+}
+
+func (s *Service) fileResponse(ctx context.Context, metadata *FileMetadata, expiry time.Duration) (FileResponse, error) {
+	return s.fileResponseWithOverrides(ctx, metadata, expiry, responseOverrides{})
+}
+
+// fileResponseWithOverrides is fileResponse with response headers set on the
+// URL of the original.
+func (s *Service) fileResponseWithOverrides(ctx context.Context, metadata *FileMetadata, expiry time.Duration, overrides responseOverrides) (FileResponse, error) {
+	if !metadata.ready() {
+		// No URLs until the file is processed; the client polls instead.
+		return FileResponse{Metadata: metadata, StatusURL: statusURL(metadata.ID)}, nil
+	}
+	store := s.readStore(ctx, objectKey(metadata))
+	presignedURL, err := s.presignWithOverrides(ctx, store, objectKey(metadata), expiry, overrides)
+	if err != nil {
+		return FileResponse{}, err
+	}
+	response := FileResponse{Metadata: metadata, PresignedURL: presignedURL}
+	if s.locationFields {
+		response.Backend = "s3://" + store.bucket
+		response.Region = store.region
+	}
+	if s.downloadTokenKey != nil {
+		response.DownloadURL = s.downloadURL(metadata.ID, expiry)
+	}
+	if len(metadata.Variants) == 0 {
+		return response, nil
+	}
+
+	response.URLs = map[string]string{"original": presignedURL}
+	for name, key := range metadata.Variants {
+		url, err := s.presignFrom(ctx, store, key, expiry)
+		if err != nil {
+			return FileResponse{}, err
+		}
+		response.URLs[name] = url
+	}
+	return response, nil
 }
 
 func (s *Service) CreateFile(w http.ResponseWriter, r *http.Request) {
-	file, fileHeader, err := r.FormFile("file")
+	if err := s.checkStorageCeiling(r.Context()); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	file, err := s.readUpload(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		s.writeError(w, r, err)
 		return
 	}
-	defer file.Close()
 
-	ext, err := validateFile(file, fileHeader.Filename)
+	file.deferred = s.defersProcessing(file)
+	metadata, deduplicated, err := s.storeFile(r.Context(), file)
+	if errors.Is(err, errInvalidKey) {
+		s.writeJSONError(w, r, http.StatusBadRequest, "invalid_key", err.Error())
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		s.writeError(w, r, err)
 		return
 	}
-	file.Seek(0, io.SeekStart)
+	accepted := false
+	if file.deferred && !deduplicated {
+		// With the queue full or the service shutting down, the upload
+		// waits for its processing after all.
+		job := processingJob{metadata: *metadata, upload: file, release: handOffUploadReservation(r.Context())}
+		if accepted = s.processing.submit(job); !accepted {
+			takeBackUploadReservation(r.Context())
+			s.processFile(r.Context(), job)
+			if metadata, err = s.retrieveMetadataFromDB(r.Context(), metadata.ID); err == nil && metadata == nil {
+				err = newAPIError(http.StatusNotFound, "not_found", "file not found")
+			}
+			if err != nil {
+				s.writeError(w, r, err)
+				return
+			}
+		}
+	}
 
-	fileBuffer := new(bytes.Buffer)
-	_, err = io.Copy(fileBuffer, file)
+	response, err := s.fileResponse(r.Context(), s.visibleMetadata(r, metadata), s.presignExpiry)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.writeError(w, r, err)
 		return
 	}
 
-	hash := calculateHash(fileBuffer.Bytes())
-	existingFile, err := s.getFileIDByHash(hash)
+	status := http.StatusCreated
+	if deduplicated {
+		status = http.StatusOK
+	}
+	if accepted {
+		status = http.StatusAccepted
+		response.StatusURL = statusURL(metadata.ID)
+		w.Header().Set("Location", response.StatusURL)
+	}
+	s.writeResponse(w, r, status, response)
+}
+
+// storeFile uploads data and saves its metadata, unless the owner already has
+// a file with the same hash, in which case the existing metadata is returned
+// and deduplicated is true. Blocklisted content is rejected before anything
+// else, followed by the pre-upload hooks.
+func (s *Service) storeFile(ctx context.Context, u *upload) (*FileMetadata, bool, error) {
+	if u.streamed() {
+		return s.storeStreamedFile(ctx, u)
+	}
+	if err := s.checkBlocked(ctx, u.hash); err != nil {
+		return nil, false, err
+	}
+	if err := s.runPreUploadHooks(ctx, u); err != nil {
+		return nil, false, err
+	}
+	if s.dedupWindow != nil {
+		if metadata, ok := s.dedupWindow.get(u.ownerID, u.hash); ok {
+			s.uploadEvent(ctx, eventDedupWindow, u)
+			return &metadata, true, nil
+		}
+	}
+	metadata, deduplicated, err := s.storeFileCoalesced(ctx, u)
+	if err == nil && s.dedupWindow != nil {
+		s.dedupWindow.put(u.ownerID, *metadata)
+	}
+	return metadata, deduplicated, err
+}
+
+// storeFileCoalesced is storeFileOnce with concurrent identical uploads
+// collapsed into one, unless coalescing is disabled.
+func (s *Service) storeFileCoalesced(ctx context.Context, u *upload) (*FileMetadata, bool, error) {
+	if !s.coalesceUploads || !s.dedup {
+		return s.storeFileOnce(ctx, u)
+	}
+	// Identical uploads arriving together would all miss the hash lookup
+	// and be stored separately. Collapse them so that one stores the file
+	// and the others get its metadata as duplicates.
+	type stored struct {
+		metadata     *FileMetadata
+		deduplicated bool
+	}
+	leader := false
+	v, err, _ := s.uploadGroup.Do(u.ownerID+"\x00"+u.hash, func() (interface{}, error) {
+		leader = true
+		metadata, deduplicated, err := s.storeFileOnce(ctx, u)
+		return stored{metadata, deduplicated}, err
+	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, false, err
+	}
+	result := v.(stored)
+	if leader {
+		return result.metadata, result.deduplicated, nil
 	}
+	s.uploadEvent(ctx, eventDedupCoalesced, u)
+	metadata := *result.metadata
+	return &metadata, true, nil
+}
 
-	if existingFile != nil {
-		presignedURL, err := s.generatePresignedURL(existingFile.ID + existingFile.Extension)
+func (s *Service) storeFileOnce(ctx context.Context, u *upload) (metadata *FileMetadata, deduplicated bool, err error) {
+	if s.dedup {
+		existingFile, err := s.getFileIDByHash(ctx, u.hash, u.ownerID)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return nil, false, err
 		}
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(FileResponse{
-			Metadata:     existingFile,
-			PresignedURL: presignedURL,
+		if existingFile != nil {
+			s.uploadEvent(ctx, eventDedupExact, u)
+			return existingFile, true, nil
+		}
+	}
+
+	var phash uint64
+	if s.recentPerceptualHashes != nil {
+		img, err := s.uploadImage(ctx, u)
+		if err != nil {
+			return nil, false, err
+		}
+		phash = differenceHash(img)
+		similarFile, err := s.findNearDuplicate(ctx, phash, u.ownerID)
+		if err != nil {
+			return nil, false, err
+		}
+		if similarFile != nil {
+			s.uploadEvent(ctx, eventDedupNear, u)
+			return similarFile, true, nil
+		}
+	}
+
+	id := s.idGenerator.NewID()
+	key, err := s.newObjectKey(id, u)
+	if err != nil {
+		return nil, false, err
+	}
+	// With content-hash keys another file may already have stored this
+	// content; reuse its object as it is, since it may have been written
+	// under a different compression setting.
+	var existingObject *s3.HeadObjectOutput
+	if sharedObjectKey(&FileMetadata{ID: id, Key: key, Hash: u.hash, Extension: u.ext}) {
+		existingObject, err = s.fileStorage.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(s.fileStorageBucket),
+			Key:    aws.String(key),
 		})
-		return
+		if err != nil && !isNotFoundError(err) {
+			return nil, false, err
+		}
+	}
+	now := s.now()
+	metadata = &FileMetadata{
+		ID:           id,
+		Hash:         u.hash,
+		Extension:    u.ext,
+		Key:          key,
+		OwnerID:      u.ownerID,
+		Region:       s.primaryStore().region,
+		ContentType:  u.contentType,
+		OriginalName: u.originalName,
+		Size:         int64(len(u.data)),
+		Kind:         fileKind,
+		CreatedAt:    now.Format(time.RFC3339),
+		UpdatedAt:    now.Format(time.RFC3339),
+	}
+	if s.epochTimestamps {
+		metadata.CreatedAtEpoch = now.Unix()
+		metadata.UpdatedAtEpoch = now.Unix()
+	}
+	metadata.Width, metadata.Height = imageDimensions(u.data)
+	metadata.Tags = u.tags
+	metadata.UploaderIP, metadata.UploaderUserAgent = u.clientIP, u.userAgent
+	if u.deferred {
+		metadata.Status = StatusPending
+	}
+	if s.blurHash && !u.deferred {
+		img, err := s.uploadImage(ctx, u)
+		if err != nil {
+			return nil, false, err
+		}
+		metadata.BlurHash = blurHash(img)
+	}
+	if s.dominantColor && !u.deferred {
+		img, err := s.uploadImage(ctx, u)
+		if err != nil {
+			return nil, false, err
+		}
+		metadata.DominantColor = averageColor(img)
+	}
+	metadata.ObjectTags = s.objectTags(metadata)
+	replaced, err := s.applyFilenamePolicy(ctx, metadata)
+	if err != nil {
+		return nil, false, err
+	}
+
+	body, checksumHash := u.data, u.hash
+	if existingObject != nil {
+		metadata.ContentEncoding = aws.StringValue(existingObject.ContentEncoding)
+		metadata.ObjectETag = strings.Trim(aws.StringValue(existingObject.ETag), `"`)
+		if metadata.ContentEncoding != "" {
+			metadata.StoredSize = aws.Int64Value(existingObject.ContentLength)
+		}
+	} else if s.shouldCompress(u.contentType) {
+		compressed, err := gzipBytes(u.data)
+		if err != nil {
+			return nil, false, err
+		}
+		// Small or incompressible content may grow; keep it as is then.
+		if len(compressed) < len(u.data) {
+			body, checksumHash = compressed, calculateHash(compressed)
+			metadata.ContentEncoding = "gzip"
+			metadata.StoredSize = int64(len(compressed))
+		}
 	}
 
-	id := uuid.New().String()
-	objectKey := id + ext
-	now := time.Now().Format(time.RFC3339)
-	metadata := FileMetadata{
-		ID:        id,
-		Hash:      hash,
-		Extension: ext,
-		CreatedAt: now,
-		UpdatedAt: now,
+	if s.recentPerceptualHashes != nil {
+		metadata.PHash = formatPerceptualHash(phash)
 	}
 
-	if err := s.uploadToS3(objectKey, fileBuffer.Bytes()); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if existingObject == nil {
+		metadata.ObjectETag = objectETag(body, s.uploadPartSize)
+		if err := s.uploadToS3(ctx, metadata, bytes.NewReader(body), checksumHash); err != nil {
+			return nil, false, err
+		}
 	}
-	if err := s.saveMetadataToDB(metadata); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	save := s.saveMetadataToDB
+	if existingObject == nil {
+		save = s.saveUploadedMetadata
+	}
+	if err := save(ctx, *metadata); err != nil {
+		// Don't leave an object nothing refers to, e.g. when the request
+		// deadline ran out between the two writes.
+		if existingObject == nil && !sharedObjectKey(metadata) {
+			s.discardObject(ctx, key)
+		}
+		return nil, false, err
 	}
+	s.recordStored(ctx, metadata, existingObject == nil)
+	s.replaceFiles(ctx, replaced)
+	s.uploadEvent(ctx, eventUploadStored, u)
+	if !u.deferred {
+		s.fileStored(ctx, metadata)
+	}
+	if s.recentPerceptualHashes != nil {
+		s.recentPerceptualHashes.add(id, phash)
+	}
+	return metadata, false, nil
+}
+
+// loadFile returns the metadata of file id if the caller of r may access it.
+func (s *Service) loadFile(r *http.Request, id string) (*FileMetadata, error) {
+	return s.lookupFile(r, id, true)
+}
 
-	presignedURL, err := s.generatePresignedURL(objectKey)
+// lookupFile is loadFile, checking the caller's ownership only when
+// checkAccess is set.
+func (s *Service) lookupFile(r *http.Request, id string, checkAccess bool) (*FileMetadata, error) {
+	if err := s.sanitizeKeyComponent(id); err != nil {
+		return nil, newAPIError(http.StatusBadRequest, "invalid_id", err.Error())
+	}
+	metadata, err := s.retrieveMetadataFromDB(r.Context(), id)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
+	}
+	if metadata == nil || (checkAccess && !s.canAccess(r, metadata)) {
+		return nil, newAPIError(http.StatusNotFound, "not_found", "file not found")
 	}
+	return metadata, nil
+}
 
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(FileResponse{
-		Metadata:     &metadata,
-		PresignedURL: presignedURL,
-	})
+// loadFileForRead is loadFile for read-only handlers. With degraded reads
+// enabled, a DynamoDB failure falls back to the last metadata seen for the
+// file, and degraded is true.
+func (s *Service) loadFileForRead(r *http.Request, id string) (metadata *FileMetadata, degraded bool, err error) {
+	return s.readFile(r, id, true)
+}
+
+// readFile is loadFileForRead, checking the caller's ownership only when
+// checkAccess is set.
+func (s *Service) readFile(r *http.Request, id string, checkAccess bool) (metadata *FileMetadata, degraded bool, err error) {
+	metadata, err = s.lookupFile(r, id, checkAccess)
+	var apiErr *apiError
+	if err == nil || s.metadataCache == nil || errors.As(err, &apiErr) {
+		return metadata, false, err
+	}
+	cached, ok := s.metadataCache.get(id)
+	if !ok || (checkAccess && !s.canAccess(r, cached)) {
+		s.event(r.Context(), eventMetadataCacheMiss, "id", id)
+		return nil, false, err
+	}
+	s.event(r.Context(), eventMetadataCacheHit, "id", id)
+	s.logger.Warn("serving cached metadata, DynamoDB unavailable", "id", id, "error", err)
+	return cached, true, nil
 }
 
 func (s *Service) GetFile(w http.ResponseWriter, r *http.Request) {
-	id := mux.Vars(r)["id"]
-	metadata, err := s.retrieveMetadataFromDB(id)
+	metadata, degraded, err := s.loadFileForRead(r, mux.Vars(r)["id"])
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		s.writeError(w, r, err)
+		return
+	}
+
+	if r.URL.Query().Get("verify") == "true" {
+		if err := s.verifyObject(r.Context(), metadata); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+	}
+	if !metadata.ready() && (s.notReadyConflict || r.URL.Query().Get("redirect") == "true") {
+		s.writeJSONError(w, r, http.StatusConflict, "file_not_ready",
+			fmt.Sprintf("file is %s; poll %s until it is ready", metadata.Status, statusURL(metadata.ID)))
+		return
+	}
+	if r.URL.Query().Get("redirect") == "true" {
+		s.redirectToFile(w, r, metadata)
 		return
 	}
 
-	if metadata == nil {
-		http.Error(w, "file not found", http.StatusNotFound)
+	etag := metadataETag(metadata)
+	w.Header().Set("ETag", etag)
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag, false) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
-	objectKey := metadata.ID + metadata.Extension
-	presignedURL, err := s.generatePresignedURL(objectKey)
+	expiry, err := s.requestedExpiry(r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	overrides, err := s.requestedOverrides(r, metadata)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	response, err := s.fileResponseWithOverrides(r.Context(), s.visibleMetadata(r, metadata), expiry, overrides)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.writeError(w, r, err)
 		return
 	}
+	response.Degraded = degraded
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(FileResponse{
-		Metadata:     metadata,
-		PresignedURL: presignedURL,
-	})
+	s.writeResponse(w, r, http.StatusOK, response)
 }
 
 func (s *Service) DeleteFile(w http.ResponseWriter, r *http.Request) {
-	id := mux.Vars(r)["id"]
-	metadata, err := s.retrieveMetadataFromDB(id)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	if err := s.deleteFile(r, mux.Vars(r)["id"]); err != nil {
+		s.writeError(w, r, err)
 		return
 	}
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	objectKey := metadata.ID + metadata.Extension
-	_, err = s.fileStorage.DeleteObject(&s3.DeleteObjectInput{
-		Bucket: aws.String(s.fileStorageBucket),
-		Key:    aws.String(objectKey),
-	})
+// deleteFile removes a file's objects and metadata, or with soft delete only
+// marks it deleted, and records the deletion in the audit log.
+func (s *Service) deleteFile(r *http.Request, id string) error {
+	metadata, err := s.loadFile(r, id)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
+	}
+	if s.softDelete {
+		err = s.markDeleted(r.Context(), metadata)
+	} else {
+		err = s.removeFile(r.Context(), metadata)
+	}
+	if err != nil {
+		return err
+	}
+
+	if s.recentPerceptualHashes != nil {
+		s.recentPerceptualHashes.remove(id)
+	}
+	if s.metadataCache != nil {
+		s.metadataCache.remove(id)
+	}
+	if s.dedupWindow != nil {
+		s.dedupWindow.remove(id)
+	}
+	s.audit(r, "delete", metadata)
+	s.publishFileEvent(r.Context(), FileEventDeleted, metadata)
+	return nil
+}
+
+// removeFile deletes a file's objects and metadata for good.
+func (s *Service) removeFile(ctx context.Context, metadata *FileMetadata) error {
+	// Only the file's own objects are deleted. The service never creates
+	// zero-byte "directory" markers for key prefixes, so none can be left
+	// behind, and S3 prefixes disappear with their last object. A shared
+	// object is deleted after the metadata, once no other file refers to it.
+	shared := sharedObjectKey(metadata)
+	var keys []string
+	if !shared {
+		keys = append(keys, objectKey(metadata))
+	}
+	for _, key := range metadata.Variants {
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		if err := s.deleteObject(ctx, key); err != nil {
+			return err
+		}
 	}
 
-	_, err = s.db.DeleteItem(&dynamodb.DeleteItemInput{
+	_, err := s.db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
 		TableName: aws.String(s.dbFileTableName),
 		Key: map[string]*dynamodb.AttributeValue{
-			"ID": {S: aws.String(id)},
+			"ID": {S: aws.String(metadata.ID)},
 		},
 	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 
-	w.WriteHeader(http.StatusNoContent)
+	objectDeleted := !shared
+	if shared {
+		referenced, err := s.objectReferenced(ctx, metadata)
+		if err != nil {
+			return err
+		}
+		if !referenced {
+			if err := s.deleteObject(ctx, objectKey(metadata)); err != nil {
+				return err
+			}
+			objectDeleted = true
+		}
+	}
+	s.recordDeleted(ctx, metadata, objectDeleted)
+	return nil
+}
+
+func (s *Service) deleteObject(ctx context.Context, key string) error {
+	_, err := s.fileStorage.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.fileStorageBucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	if s.diskCache != nil {
+		s.diskCache.remove(key)
+	}
+	return nil
+}
+
+// objectReferenced reports whether any file other than metadata's still
+// refers to its object. Files sharing an object share its hash, so only
+// those are read.
+func (s *Service) objectReferenced(ctx context.Context, metadata *FileMetadata) (bool, error) {
+	item, err := s.firstItemWithHash(ctx, metadata.Hash, "#key = :key AND #id <> :id",
+		map[string]*string{"#key": aws.String("Key"), "#id": aws.String("ID")},
+		map[string]*dynamodb.AttributeValue{
+			":key": {S: aws.String(objectKey(metadata))},
+			":id":  {S: aws.String(metadata.ID)},
+		})
+	return item != nil, err
 }
 
 func calculateHash(data []byte) string {
@@ -286,33 +1170,27 @@ func calculateHash(data []byte) string {
 	return hex.EncodeToString(hash[:])
 }
 
-func (s *Service) getFileIDByHash(hash string) (*FileMetadata, error) {
+// getFileIDByHash returns a file with the given hash that ownerID can access.
+func (s *Service) getFileIDByHash(ctx context.Context, hash, ownerID string) (*FileMetadata, error) {
 	if hash == "" {
 		return nil, fmt.Errorf("hash cannot be empty")
 	}
 
-	result, err := s.db.Query(&dynamodb.QueryInput{
-		TableName:              aws.String(s.dbFileTableName),
-		IndexName:              aws.String("HashIndex"),
-		KeyConditionExpression: aws.String("#hash = :hash"),
-		ExpressionAttributeNames: map[string]*string{
-			"#hash": aws.String("Hash"),
-		},
-		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-			":hash": {S: aws.String(hash)},
-		},
-		Limit: aws.Int64(1),
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to query DynamoDB: %w", err)
+	filter := "attribute_not_exists(#deleted)"
+	names := map[string]*string{"#deleted": aws.String("DeletedAt")}
+	values := map[string]*dynamodb.AttributeValue{}
+	if ownerID != "" {
+		filter += " AND (attribute_not_exists(#owner) OR #owner = :owner)"
+		names["#owner"] = aws.String("OwnerID")
+		values[":owner"] = &dynamodb.AttributeValue{S: aws.String(ownerID)}
 	}
-
-	if len(result.Items) == 0 {
-		return nil, nil
+	item, err := s.firstItemWithHash(ctx, hash, filter, names, values)
+	if err != nil || item == nil {
+		return nil, err
 	}
 
 	var metadata FileMetadata
-	err = dynamodbattribute.UnmarshalMap(result.Items[0], &metadata)
+	err = dynamodbattribute.UnmarshalMap(item, &metadata)
 	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal query result: %w", err)
 	}
@@ -320,6 +1198,70 @@ func (s *Service) getFileIDByHash(hash string) (*FileMetadata, error) {
 	return &metadata, nil
 }
 
+// firstItemWithHash returns the first item with the given hash that matches
+// filter (which may be empty), or nil. It queries HashIndex, or with hash
+// scans enabled reads the whole table.
+func (s *Service) firstItemWithHash(ctx context.Context, hash, filter string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+	names["#hash"] = aws.String("Hash")
+	values[":hash"] = &dynamodb.AttributeValue{S: aws.String(hash)}
+	var found map[string]*dynamodb.AttributeValue
+	collect := func(items []map[string]*dynamodb.AttributeValue) bool {
+		if len(items) > 0 {
+			found = items[0]
+		}
+		return found == nil
+	}
+
+	if s.hashScan {
+		expression := "#hash = :hash"
+		if filter != "" {
+			expression += " AND (" + filter + ")"
+		}
+		err := s.db.ScanPagesWithContext(ctx, &dynamodb.ScanInput{
+			TableName:                 aws.String(s.dbFileTableName),
+			FilterExpression:          aws.String(expression),
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: values,
+		}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+			return collect(page.Items)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan DynamoDB: %w", err)
+		}
+		return found, nil
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(s.dbFileTableName),
+		IndexName:                 aws.String(hashIndex),
+		KeyConditionExpression:    aws.String("#hash = :hash"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	}
+	if filter == "" {
+		input.Limit = aws.Int64(1)
+	} else {
+		// Limit applies before the filter, so filtered lookups read all
+		// items sharing the hash.
+		input.FilterExpression = aws.String(filter)
+	}
+	err := s.db.QueryPagesWithContext(ctx, input, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		return collect(page.Items)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query DynamoDB: %w", err)
+	}
+	return found, nil
+}
+
+func hexToBase64(s string) (string, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
 func replaceLocalstackHostWithLocalhost(url string) string {
 	return strings.Replace(url, "http://localstack:4566", "http://localhost:4566", 1)
 }
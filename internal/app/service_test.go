@@ -0,0 +1,100 @@
+package app
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	testBucket = "file-storage-bucket"
+	testTable  = "file-storage-table"
+)
+
+// newTestService returns a service whose S3 and DynamoDB clients talk to
+// fake, which answers the calls the test expects; DynamoDB requests are told
+// apart by their X-Amz-Target header. Without a fake, any AWS call fails to
+// connect.
+func newTestService(t *testing.T, fake http.Handler, opts ...Option) *Service {
+	t.Helper()
+	fileStorage, db := newTestClients(t, fake)
+	opts = append([]Option{WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))}, opts...)
+	s, err := NewService(fileStorage, testBucket, db, testTable, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// newTestClients returns S3 and DynamoDB clients talking to fake, as
+// described for newTestService.
+func newTestClients(t *testing.T, fake http.Handler) (*s3.S3, *dynamodb.DynamoDB) {
+	t.Helper()
+	endpoint := "http://127.0.0.1:1"
+	if fake != nil {
+		server := httptest.NewServer(fake)
+		t.Cleanup(server.Close)
+		endpoint = server.URL
+	}
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:           aws.String("us-east-1"),
+		Endpoint:         aws.String(endpoint),
+		Credentials:      credentials.NewStaticCredentials("test", "test", ""),
+		S3ForcePathStyle: aws.Bool(true),
+		MaxRetries:       aws.Int(0),
+	}))
+	return s3.New(sess), dynamodb.New(sess)
+}
+
+// testJPEG returns a small valid JPEG image.
+func testJPEG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// isDynamoDB reports whether r is a DynamoDB call, as opposed to S3.
+func isDynamoDB(r *http.Request) bool {
+	return r.Header.Get("X-Amz-Target") != ""
+}
+
+// storingFake accepts every S3 and DynamoDB write and finds nothing on
+// reads, as for an empty bucket and table. It counts the S3 PUTs.
+func storingFake(puts *atomic.Int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isDynamoDB(r) {
+			w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+			switch target := r.Header.Get("X-Amz-Target"); {
+			case strings.HasSuffix(target, ".Query"), strings.HasSuffix(target, ".Scan"):
+				io.WriteString(w, `{"Items":[],"Count":0}`)
+			default:
+				io.WriteString(w, `{}`)
+			}
+			return
+		}
+		if r.Method == http.MethodPut {
+			puts.Add(1)
+			io.Copy(io.Discard, r.Body)
+			w.Header().Set("ETag", `"etag"`)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+}
@@ -0,0 +1,137 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const slowDownHandlerName = "app.SlowDown"
+
+// SlowDownBackoff configures the retries of S3 calls answered with 503
+// SlowDown.
+type SlowDownBackoff struct {
+	// MaxRetries is how often a call is retried before the client gets 503.
+	MaxRetries int
+	// MinDelay and MaxDelay bound the exponential, jittered delay between
+	// attempts.
+	MinDelay, MaxDelay time.Duration
+}
+
+func (b *SlowDownBackoff) validate() error {
+	if b == nil {
+		return nil
+	}
+	if b.MaxRetries < 0 || b.MinDelay <= 0 || b.MaxDelay < b.MinDelay {
+		return errors.New("slow down backoff needs non-negative retries and 0 < min delay <= max delay")
+	}
+	return nil
+}
+
+// slowDownRetryer is the SDK's retryer with a delay shared by all calls to
+// the bucket added to throttled retries. The delay grows while S3 keeps
+// answering SlowDown and shrinks again as calls succeed, so concurrent
+// requests back off together instead of each finding the rate limit anew.
+type slowDownRetryer struct {
+	client.DefaultRetryer
+	penalty  *atomic.Int64
+	maxDelay time.Duration
+}
+
+func (r slowDownRetryer) RetryRules(req *request.Request) time.Duration {
+	delay := r.DefaultRetryer.RetryRules(req)
+	if req.IsErrorThrottle() {
+		delay += time.Duration(r.penalty.Load())
+	}
+	return min(delay, r.maxDelay)
+}
+
+// instrumentS3Client counts the SlowDown responses of client and, with
+// backoff configured, installs the adaptive retryer.
+func (s *Service) instrumentS3Client(c *s3.S3) {
+	var penalty *atomic.Int64
+	if b := s.slowDownBackoff; b != nil {
+		penalty = new(atomic.Int64)
+		c.Retryer = slowDownRetryer{
+			DefaultRetryer: client.DefaultRetryer{
+				NumMaxRetries:    b.MaxRetries,
+				MinThrottleDelay: b.MinDelay,
+				MaxThrottleDelay: b.MaxDelay,
+			},
+			penalty:  penalty,
+			maxDelay: b.MaxDelay,
+		}
+	}
+
+	c.Handlers.AfterRetry.RemoveByName(slowDownHandlerName)
+	c.Handlers.AfterRetry.PushFrontNamed(request.NamedHandler{
+		Name: slowDownHandlerName,
+		Fn: func(r *request.Request) {
+			if !isSlowDownResponse(r) {
+				return
+			}
+			s.event(r.Context(), eventS3SlowDown, "operation", r.Operation.Name, "attempt", r.RetryCount+1)
+			if penalty != nil {
+				// Double the shared delay, starting from the minimum.
+				b := s.slowDownBackoff
+				updatePenalty(penalty, func(d int64) int64 { return min(max(2*d, int64(b.MinDelay)), int64(b.MaxDelay)) })
+			}
+		},
+	})
+	c.Handlers.Complete.RemoveByName(slowDownHandlerName)
+	if penalty != nil {
+		c.Handlers.Complete.PushBackNamed(request.NamedHandler{
+			Name: slowDownHandlerName,
+			Fn: func(r *request.Request) {
+				if r.Error == nil {
+					updatePenalty(penalty, func(d int64) int64 { return d / 2 })
+				}
+			},
+		})
+	}
+}
+
+func updatePenalty(penalty *atomic.Int64, next func(int64) int64) {
+	for {
+		old := penalty.Load()
+		if penalty.CompareAndSwap(old, next(old)) {
+			return
+		}
+	}
+}
+
+// maxErrorDepth bounds how far isSlowDownError follows original errors.
+const maxErrorDepth = 8
+
+// isSlowDownError reports whether err, or an error it wraps, is S3's
+// SlowDown. Other 503s, such as DynamoDB's, are not. Multipart upload
+// failures carry the cause as their original error.
+func isSlowDownError(err error) bool {
+	for range maxErrorDepth {
+		var awsErr awserr.Error
+		if !errors.As(err, &awsErr) {
+			return false
+		}
+		if awsErr.Code() == "SlowDown" {
+			return true
+		}
+		err = awsErr.OrigErr()
+	}
+	return false
+}
+
+// isSlowDownResponse reports whether an S3 call was answered with SlowDown.
+// Responses to HEAD requests have no body to carry the error code, so any 503
+// from S3 counts.
+func isSlowDownResponse(r *request.Request) bool {
+	if r.Error == nil {
+		return false
+	}
+	return isSlowDownError(r.Error) || (r.HTTPResponse != nil && r.HTTPResponse.StatusCode == http.StatusServiceUnavailable)
+}
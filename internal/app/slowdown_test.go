@@ -0,0 +1,37 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestIsSlowDownError(t *testing.T) {
+	slowDown := awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate.", nil), http.StatusServiceUnavailable, "req")
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"S3 SlowDown", slowDown, true},
+		{"multipart upload failure", awserr.New("MultipartUpload", "upload multipart failed", slowDown), true},
+		{"DynamoDB unavailable", awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "", nil), http.StatusServiceUnavailable, "req"), false},
+		{"DynamoDB throttling", awserr.NewRequestFailure(awserr.New("ProvisionedThroughputExceededException", "", nil), http.StatusBadRequest, "req"), false},
+		{"other error", errors.New("SlowDown"), false},
+	}
+	for _, tt := range tests {
+		if got := isSlowDownError(tt.err); got != tt.want {
+			t.Errorf("%s: isSlowDownError = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestClassifyDynamoDBUnavailable(t *testing.T) {
+	s := newTestService(t, nil)
+	err := awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "", nil), http.StatusServiceUnavailable, "req")
+	if _, code, _ := s.classifyError(err); code == "slow_down" {
+		t.Errorf("DynamoDB 503 classified as %s", code)
+	}
+}
@@ -0,0 +1,158 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// statsItemID is the ID of the single counter item in the stats table.
+const statsItemID = "totals"
+
+// StatsResponse holds the running totals of stored files. Bytes counts the
+// stored size, i.e. after compression.
+type StatsResponse struct {
+	Files int64 `json:"files" dynamodbav:"Files"`
+	Bytes int64 `json:"bytes" dynamodbav:"Bytes"`
+}
+
+// storageStats maintains the totals in a DynamoDB table keyed by ID. The
+// counters are updated atomically with ADD, so all instances share them.
+type storageStats struct {
+	db        *dynamodb.DynamoDB
+	tableName string
+
+	// ceiling rejects uploads once Bytes reaches it; 0 disables the check.
+	// The totals are re-read at most every maxStaleness.
+	ceiling      int64
+	maxStaleness time.Duration
+
+	mu       sync.Mutex
+	cached   StatsResponse
+	cachedAt time.Time
+}
+
+func storedBytes(metadata *FileMetadata) int64 {
+	if metadata.StoredSize > 0 {
+		return metadata.StoredSize
+	}
+	return metadata.Size
+}
+
+func (st *storageStats) add(ctx context.Context, files, bytes int64) error {
+	_, err := st.db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(st.tableName),
+		Key:              map[string]*dynamodb.AttributeValue{"ID": {S: aws.String(statsItemID)}},
+		UpdateExpression: aws.String("ADD Files :files, #bytes :bytes"),
+		// BYTES is a DynamoDB reserved word.
+		ExpressionAttributeNames: map[string]*string{"#bytes": aws.String("Bytes")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":files": numberAttribute(files),
+			":bytes": numberAttribute(bytes),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update stats: %w", err)
+	}
+	return nil
+}
+
+func (st *storageStats) read(ctx context.Context) (StatsResponse, error) {
+	result, err := st.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(st.tableName),
+		Key:       map[string]*dynamodb.AttributeValue{"ID": {S: aws.String(statsItemID)}},
+	})
+	if err != nil {
+		return StatsResponse{}, fmt.Errorf("failed to read stats: %w", err)
+	}
+	var stats StatsResponse
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &stats); err != nil {
+		return StatsResponse{}, fmt.Errorf("failed to unmarshal stats: %w", err)
+	}
+	return stats, nil
+}
+
+// checkCeiling fails with 507 when the stored bytes have reached the
+// ceiling, based on totals at most maxStaleness old.
+func (st *storageStats) checkCeiling(ctx context.Context) error {
+	if st.ceiling <= 0 {
+		return nil
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if time.Since(st.cachedAt) >= st.maxStaleness {
+		stats, err := st.read(ctx)
+		if err != nil {
+			return err
+		}
+		st.cached, st.cachedAt = stats, time.Now()
+	}
+	if st.cached.Bytes >= st.ceiling {
+		return newAPIError(http.StatusInsufficientStorage, "insufficient_storage",
+			fmt.Sprintf("storage is full: %d of %d bytes used", st.cached.Bytes, st.ceiling))
+	}
+	return nil
+}
+
+// checkStorageCeiling is checkCeiling for the upload handlers. If the totals
+// can't be read, uploads are let through rather than failing on a counter.
+func (s *Service) checkStorageCeiling(ctx context.Context) error {
+	if s.stats == nil {
+		return nil
+	}
+	err := s.stats.checkCeiling(ctx)
+	var apiErr *apiError
+	if err != nil && !errors.As(err, &apiErr) {
+		s.logger.Warn("storage ceiling not checked", "error", err)
+		return nil
+	}
+	return err
+}
+
+// recordStored and recordDeleted keep the totals in step. The bytes of an
+// object shared by files with the same content count once: only when it is
+// written, and when the last file referring to it is deleted. A failure
+// leaves the counters off but doesn't fail the request, whose change has
+// already happened.
+func (s *Service) recordStored(ctx context.Context, metadata *FileMetadata, objectWritten bool) {
+	if s.stats == nil {
+		return
+	}
+	var bytes int64
+	if objectWritten {
+		bytes = storedBytes(metadata)
+	}
+	if err := s.stats.add(ctx, 1, bytes); err != nil {
+		s.logger.Error("failed to count stored file", "id", metadata.ID, "error", err)
+	}
+}
+
+func (s *Service) recordDeleted(ctx context.Context, metadata *FileMetadata, objectDeleted bool) {
+	if s.stats == nil {
+		return
+	}
+	var bytes int64
+	if objectDeleted {
+		bytes = storedBytes(metadata)
+	}
+	if err := s.stats.add(ctx, -1, -bytes); err != nil {
+		s.logger.Error("failed to count deleted file", "id", metadata.ID, "error", err)
+	}
+}
+
+// GetStats returns the totals of stored files.
+func (s *Service) GetStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.stats.read(r.Context())
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	s.writeResponse(w, r, http.StatusOK, stats)
+}
@@ -0,0 +1,72 @@
+package app
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// maxUploadConcurrency bounds the parts uploaded in parallel per object;
+	// each one buffers a full part in memory.
+	maxUploadConcurrency = 32
+	// maxUploadPartSize is the largest part S3 accepts.
+	maxUploadPartSize = 5 << 30
+)
+
+// objectStore is a bucket objects can be read from. Writes always go to the
+// primary store; a secondary store, typically a replica in another region,
+// only serves reads the primary can't.
+type objectStore struct {
+	client *s3.S3
+	bucket string
+	region string
+}
+
+func (s *Service) primaryStore() objectStore {
+	return objectStore{
+		client: s.fileStorage,
+		bucket: s.fileStorageBucket,
+		region: aws.StringValue(s.fileStorage.Config.Region),
+	}
+}
+
+// headObject returns the object's metadata from the primary store, falling
+// back to the secondary store if the primary fails or doesn't have it.
+func (s *Service) headObject(ctx context.Context, key string) (*s3.HeadObjectOutput, objectStore, error) {
+	primary := s.primaryStore()
+	head, err := primary.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(primary.bucket),
+		Key:          aws.String(key),
+		ChecksumMode: aws.String(s3.ChecksumModeEnabled),
+	})
+	if err == nil || s.secondaryStore == nil {
+		return head, primary, err
+	}
+
+	secondary := *s.secondaryStore
+	s.logger.Warn("primary storage read failed, using secondary", "key", key, "region", secondary.region, "error", err)
+	head, err = secondary.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(secondary.bucket),
+		Key:          aws.String(key),
+		ChecksumMode: aws.String(s3.ChecksumModeEnabled),
+	})
+	return head, secondary, err
+}
+
+// readStore picks the store to presign a read of key against. Presigning
+// never fails for a missing object, so with a secondary store configured the
+// primary is checked with HeadObject first.
+func (s *Service) readStore(ctx context.Context, key string) objectStore {
+	if s.secondaryStore == nil {
+		return s.primaryStore()
+	}
+	_, store, err := s.headObject(ctx, key)
+	if err != nil {
+		// Neither store has a readable copy; presign against the primary so
+		// the client gets the primary's error.
+		return s.primaryStore()
+	}
+	return store
+}
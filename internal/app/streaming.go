@@ -0,0 +1,147 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"time"
+)
+
+// streamUpload reports whether an upload of size bytes (-1 if unknown) is
+// streamed to S3 rather than buffered.
+func (s *Service) streamUpload(size int64) bool {
+	return s.streamThreshold > 0 && (size < 0 || size > s.streamThreshold)
+}
+
+// hashingReader hashes and counts the bytes read through it, and remembers
+// the error that ended the stream, if any. With etag set it also computes
+// the object's ETag.
+type hashingReader struct {
+	r    io.Reader
+	hash hash.Hash
+	etag *multipartETag
+	n    int64
+	err  error
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+	if h.etag != nil {
+		h.etag.Write(p[:n])
+	}
+	h.n += int64(n)
+	if err != nil && err != io.EOF {
+		h.err = err
+	}
+	return n, err
+}
+
+// storeStreamedFile uploads a streamed file under a fresh ID while hashing
+// it, and only then decides whether it duplicates a stored file. A
+// duplicate's object is deleted again and the existing metadata returned.
+//
+// Unlike storeFile for buffered uploads, nothing can be checked against the
+// hash before the bytes are in S3: blocklisted content and duplicates cost an
+// upload and a delete, and identical uploads arriving together are not
+// coalesced. The object is always keyed by ID and stored uncompressed, and
+// the fields derived from the decoded image are left empty.
+func (s *Service) storeStreamedFile(ctx context.Context, u *upload) (*FileMetadata, bool, error) {
+	defer u.body.Close()
+
+	id := s.idGenerator.NewID()
+	key, err := s.buildObjectKey(id, u.ext)
+	if err != nil {
+		return nil, false, err
+	}
+	now := s.now()
+	metadata := &FileMetadata{
+		ID:           id,
+		Extension:    u.ext,
+		Key:          key,
+		OwnerID:      u.ownerID,
+		Region:       s.primaryStore().region,
+		ContentType:  u.contentType,
+		OriginalName: u.originalName,
+		Kind:         fileKind,
+		CreatedAt:    now.Format(time.RFC3339),
+		UpdatedAt:    now.Format(time.RFC3339),
+	}
+	if s.epochTimestamps {
+		metadata.CreatedAtEpoch = now.Unix()
+		metadata.UpdatedAtEpoch = now.Unix()
+	}
+	metadata.Tags = u.tags
+	metadata.UploaderIP, metadata.UploaderUserAgent = u.clientIP, u.userAgent
+	metadata.ObjectTags = s.objectTags(metadata)
+
+	body := &hashingReader{r: u.body, hash: sha256.New(), etag: newMultipartETag(s.uploadPartSize, -1)}
+	if err := s.uploadToS3(ctx, metadata, body, ""); err != nil {
+		if body.err != nil {
+			return nil, false, formError(body.err)
+		}
+		return nil, false, err
+	}
+	metadata.ObjectETag = body.etag.sum()
+	u.hash = hex.EncodeToString(body.hash.Sum(nil))
+	u.size = body.n
+	metadata.Hash, metadata.Size = u.hash, u.size
+
+	stored := false
+	defer func() {
+		if !stored {
+			s.discardObject(ctx, key)
+		}
+	}()
+	if err := s.checkBlocked(ctx, u.hash); err != nil {
+		return nil, false, err
+	}
+	if err := s.runPreUploadHooks(ctx, u); err != nil {
+		return nil, false, err
+	}
+	metadata.OriginalName, metadata.Tags = u.originalName, u.tags
+	if s.dedupWindow != nil {
+		if existing, ok := s.dedupWindow.get(u.ownerID, u.hash); ok {
+			s.uploadEvent(ctx, eventDedupWindow, u)
+			return &existing, true, nil
+		}
+	}
+	if s.dedup {
+		existingFile, err := s.getFileIDByHash(ctx, u.hash, u.ownerID)
+		if err != nil {
+			return nil, false, err
+		}
+		if existingFile != nil {
+			s.uploadEvent(ctx, eventDedupExact, u)
+			return existingFile, true, nil
+		}
+	}
+
+	replaced, err := s.applyFilenamePolicy(ctx, metadata)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := s.saveUploadedMetadata(ctx, *metadata); err != nil {
+		return nil, false, err
+	}
+	stored = true
+	s.recordStored(ctx, metadata, true)
+	s.replaceFiles(ctx, replaced)
+	s.uploadEvent(ctx, eventUploadStored, u)
+	s.fileStored(ctx, metadata)
+	if s.dedupWindow != nil {
+		s.dedupWindow.put(u.ownerID, *metadata)
+	}
+	return metadata, false, nil
+}
+
+// discardObject deletes the object of an upload that was not kept, even if
+// the request has been cancelled meanwhile.
+func (s *Service) discardObject(ctx context.Context, key string) {
+	if err := s.deleteObject(context.WithoutCancel(ctx), key); err != nil {
+		s.logger.Error("failed to delete discarded upload", "key", key, "error", err,
+			"request_id", RequestIDFromContext(ctx))
+	}
+}
@@ -0,0 +1,87 @@
+package app
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// S3 object tag limits.
+const (
+	maxObjectTags        = 10
+	maxObjectTagKeyLen   = 128
+	maxObjectTagValueLen = 256
+)
+
+// objectTagPattern is the character set S3 allows in tag keys and values.
+var objectTagPattern = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]*$`)
+
+// TagRule sets Tags on the S3 object of every upload Match returns true for,
+// so bucket lifecycle rules can key off them. A nil Match matches all uploads.
+type TagRule struct {
+	Match func(metadata *FileMetadata) bool
+	Tags  map[string]string
+}
+
+// validateTagRules checks that the rules can never produce a tag set S3
+// would reject. Since several rules may match one upload, the limit on the
+// number of tags applies to all their keys together.
+func validateTagRules(rules []TagRule) error {
+	keys := make(map[string]bool)
+	for _, rule := range rules {
+		for key, value := range rule.Tags {
+			if key == "" || utf8.RuneCountInString(key) > maxObjectTagKeyLen {
+				return fmt.Errorf("object tag key %q must be 1-%d characters", key, maxObjectTagKeyLen)
+			}
+			if utf8.RuneCountInString(value) > maxObjectTagValueLen {
+				return fmt.Errorf("object tag %q value must be at most %d characters", key, maxObjectTagValueLen)
+			}
+			if !objectTagPattern.MatchString(key) || !objectTagPattern.MatchString(value) {
+				return fmt.Errorf("object tag %q=%q contains characters S3 doesn't allow", key, value)
+			}
+			if strings.HasPrefix(key, "aws:") {
+				return fmt.Errorf("object tag key %q uses the reserved aws: prefix", key)
+			}
+			keys[key] = true
+		}
+	}
+	if len(keys) > maxObjectTags {
+		return fmt.Errorf("tag rules use %d distinct tag keys, S3 allows %d per object", len(keys), maxObjectTags)
+	}
+	return nil
+}
+
+// objectTags returns the tags of all rules matching metadata. Later rules
+// override earlier ones for the same key.
+func (s *Service) objectTags(metadata *FileMetadata) map[string]string {
+	var tags map[string]string
+	for _, rule := range s.tagRules {
+		if rule.Match != nil && !rule.Match(metadata) {
+			continue
+		}
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		for key, value := range rule.Tags {
+			tags[key] = value
+		}
+	}
+	return tags
+}
+
+// encodeObjectTags formats tags as the URL query string PutObject expects.
+func encodeObjectTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := url.Values{}
+	for _, key := range keys {
+		values.Set(key, tags[key])
+	}
+	return values.Encode()
+}
@@ -0,0 +1,17 @@
+package app
+
+import "testing"
+
+func TestObjectTagRulesRejectSharedObjects(t *testing.T) {
+	fileStorage, db := newTestClients(t, nil)
+	rule := TagRule{Tags: map[string]string{"tier": "temporary"}}
+	if _, err := NewService(fileStorage, testBucket, db, testTable,
+		WithObjectTagRules(rule), WithKeyStrategy(KeyStrategyContentHash)); err == nil {
+		t.Error("NewService accepted object tag rules with content-hash keys")
+	}
+	s, err := NewService(fileStorage, testBucket, db, testTable, WithObjectTagRules(rule))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+}
@@ -0,0 +1,141 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultMaxTags        = 10
+	defaultMaxTagKeyLen   = 128
+	defaultMaxTagValueLen = 256
+)
+
+// tagLimits bounds the client-supplied tags of a file. A nil allowedKeys
+// permits any key.
+type tagLimits struct {
+	maxTags     int
+	maxKeyLen   int
+	maxValueLen int
+	allowedKeys map[string]bool
+}
+
+// validateTags rejects tag sets outside the configured limits or schema with
+// 400 invalid_tags.
+func (s *Service) validateTags(tags map[string]string) error {
+	limits := s.tagLimits
+	if len(tags) > limits.maxTags {
+		return newAPIError(http.StatusBadRequest, "invalid_tags", fmt.Sprintf("at most %d tags are allowed", limits.maxTags))
+	}
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if key == "" || utf8.RuneCountInString(key) > limits.maxKeyLen {
+			return newAPIError(http.StatusBadRequest, "invalid_tags", fmt.Sprintf("tag keys must be 1-%d characters", limits.maxKeyLen))
+		}
+		if utf8.RuneCountInString(tags[key]) > limits.maxValueLen {
+			return newAPIError(http.StatusBadRequest, "invalid_tags", fmt.Sprintf("tag %q: values must be at most %d characters", key, limits.maxValueLen))
+		}
+		if limits.allowedKeys != nil && !limits.allowedKeys[key] {
+			return newAPIError(http.StatusBadRequest, "invalid_tags", fmt.Sprintf("tag key %q is not allowed", key))
+		}
+	}
+	return s.tagSchema.check(tags)
+}
+
+// parseTags reads the tags sent with an upload, a JSON object of strings in
+// the "tags" form field or, for raw uploads, the X-Tags header.
+func (s *Service) parseTags(value string) (map[string]string, error) {
+	var tags map[string]string
+	if strings.TrimSpace(value) != "" {
+		if err := json.Unmarshal([]byte(value), &tags); err != nil {
+			return nil, newAPIError(http.StatusBadRequest, "invalid_tags", "tags must be a JSON object of strings")
+		}
+	}
+	if err := s.validateTags(tags); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+type UpdateTagsRequest struct {
+	Tags map[string]string `json:"tags"`
+}
+
+// UpdateFileTags replaces the tags of a file. An empty object removes them.
+func (s *Service) UpdateFileTags(w http.ResponseWriter, r *http.Request) {
+	var request UpdateTagsRequest
+	if err := s.decodeJSONBody(w, r, &request); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if err := s.validateTags(request.Tags); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	metadata, err := s.loadFile(r, mux.Vars(r)["id"])
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	now := s.now()
+	input := &dynamodb.UpdateItemInput{
+		TableName:                aws.String(s.dbFileTableName),
+		Key:                      map[string]*dynamodb.AttributeValue{"ID": {S: aws.String(metadata.ID)}},
+		ConditionExpression:      aws.String("attribute_exists(ID)"),
+		ExpressionAttributeNames: map[string]*string{"#tags": aws.String("Tags"), "#updated": aws.String("UpdatedAt")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":updated": {S: aws.String(now.Format(time.RFC3339))},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueAllNew),
+	}
+	if len(request.Tags) == 0 {
+		input.UpdateExpression = aws.String("SET #updated = :updated REMOVE #tags")
+	} else {
+		tags, err := dynamodbattribute.Marshal(request.Tags)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		input.UpdateExpression = aws.String("SET #tags = :tags, #updated = :updated")
+		input.ExpressionAttributeValues[":tags"] = tags
+	}
+	if s.epochTimestamps {
+		*input.UpdateExpression = strings.Replace(*input.UpdateExpression, "SET ", "SET UpdatedAtEpoch = :updatedEpoch, ", 1)
+		input.ExpressionAttributeValues[":updatedEpoch"] = numberAttribute(now.Unix())
+	}
+
+	result, err := s.db.UpdateItemWithContext(r.Context(), input)
+	if err != nil {
+		if isConditionFailed(err) {
+			s.writeJSONError(w, r, http.StatusNotFound, "not_found", "file not found")
+			return
+		}
+		s.writeError(w, r, fmt.Errorf("failed to update tags: %w", err))
+		return
+	}
+	var updated FileMetadata
+	if err := dynamodbattribute.UnmarshalMap(result.Attributes, &updated); err != nil {
+		s.writeError(w, r, fmt.Errorf("failed to unmarshal metadata: %w", err))
+		return
+	}
+	if s.metadataCache != nil {
+		s.metadataCache.put(updated)
+	}
+	s.audit(r, "tag", &updated)
+	s.writeResponse(w, r, http.StatusOK, s.visibleMetadata(r, &updated))
+}
@@ -0,0 +1,94 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TagType constrains the format of a tag value. Values are always stored
+// as strings.
+type TagType string
+
+const (
+	TagTypeString  TagType = ""
+	TagTypeInteger TagType = "integer"
+	TagTypeNumber  TagType = "number"
+	TagTypeBoolean TagType = "boolean"
+)
+
+// TagSpec describes one key of a tag schema.
+type TagSpec struct {
+	// Type is the format values must have; the default accepts any string.
+	Type TagType
+	// Values, if set, lists the only values allowed.
+	Values []string
+	// Required rejects tag sets without the key.
+	Required bool
+}
+
+// TagSchema maps the allowed tag keys to their specs. Keys not in the schema
+// are rejected.
+type TagSchema map[string]TagSpec
+
+func (schema TagSchema) validate() error {
+	for key, spec := range schema {
+		switch spec.Type {
+		case TagTypeString, TagTypeInteger, TagTypeNumber, TagTypeBoolean:
+		default:
+			return fmt.Errorf("tag schema: key %q has unknown type %q", key, spec.Type)
+		}
+		for _, value := range spec.Values {
+			if !spec.Type.matches(value) {
+				return fmt.Errorf("tag schema: key %q allows %q, which is not of type %s", key, value, spec.Type)
+			}
+		}
+	}
+	return nil
+}
+
+func (t TagType) matches(value string) bool {
+	var err error
+	switch t {
+	case TagTypeInteger:
+		_, err = strconv.ParseInt(value, 10, 64)
+	case TagTypeNumber:
+		_, err = strconv.ParseFloat(value, 64)
+	case TagTypeBoolean:
+		_, err = strconv.ParseBool(value)
+	}
+	return err == nil
+}
+
+// check rejects tags that don't follow the schema with 400
+// invalid_tags, naming every offending key.
+func (schema TagSchema) check(tags map[string]string) error {
+	if schema == nil {
+		return nil
+	}
+	var problems []string
+	for key, value := range tags {
+		spec, ok := schema[key]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%s (unknown key)", key))
+		case !spec.Type.matches(value):
+			problems = append(problems, fmt.Sprintf("%s (must be of type %s)", key, spec.Type))
+		case len(spec.Values) > 0 && !slices.Contains(spec.Values, value):
+			problems = append(problems, fmt.Sprintf("%s (must be one of %s)", key, strings.Join(spec.Values, ", ")))
+		}
+	}
+	for key, spec := range schema {
+		if _, ok := tags[key]; spec.Required && !ok {
+			problems = append(problems, fmt.Sprintf("%s (required)", key))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return newAPIError(http.StatusBadRequest, "invalid_tags", "tags violate the schema: "+strings.Join(problems, "; "))
+}
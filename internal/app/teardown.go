@@ -0,0 +1,149 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// TeardownOptions controls Teardown.
+type TeardownOptions struct {
+	// Force allows tearing down infrastructure behind a non-local endpoint,
+	// including real AWS.
+	Force bool
+}
+
+// TeardownReport is what Teardown removed. Resources that didn't exist are
+// reported as not deleted, so a repeated teardown reports nothing.
+type TeardownReport struct {
+	Bucket         string `json:"bucket"`
+	ObjectsDeleted int    `json:"objects_deleted"`
+	BucketDeleted  bool   `json:"bucket_deleted"`
+	Table          string `json:"table"`
+	TableDeleted   bool   `json:"table_deleted"`
+}
+
+// Teardown is the reverse of EnsureInfrastructure, for development and
+// integration tests: it deletes every object in the bucket, including old
+// versions and delete markers, then the bucket and the table, and waits until
+// they are gone. It is safe to call when they don't exist. Unless
+// opts.Force is set it refuses to run unless both clients talk to a local
+// endpoint, such as LocalStack. The secondary bucket is left alone.
+func (s *Service) Teardown(ctx context.Context, opts TeardownOptions) (*TeardownReport, error) {
+	if !opts.Force {
+		for _, endpoint := range []string{s.fileStorage.Endpoint, s.db.Endpoint} {
+			if !localEndpoint(endpoint) {
+				return nil, fmt.Errorf("refusing to tear down infrastructure at non-local endpoint %s", endpoint)
+			}
+		}
+	}
+	s.ready.Store(false)
+
+	report := &TeardownReport{Bucket: s.fileStorageBucket, Table: s.dbFileTableName}
+	if err := s.teardownBucket(ctx, report); err != nil {
+		return report, err
+	}
+	if err := s.teardownTable(ctx, report); err != nil {
+		return report, err
+	}
+	s.logger.Info("infrastructure torn down", "bucket", report.Bucket, "objects_deleted", report.ObjectsDeleted,
+		"bucket_deleted", report.BucketDeleted, "table", report.Table, "table_deleted", report.TableDeleted)
+	return report, nil
+}
+
+// localEndpoint reports whether endpoint is on this machine or a
+// single-label host such as a docker-compose service name.
+func localEndpoint(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return false
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback()
+	}
+	return host != "" && !strings.Contains(host, ".")
+}
+
+func (s *Service) teardownBucket(ctx context.Context, report *TeardownReport) error {
+	bucket := aws.String(s.fileStorageBucket)
+	var deleteErr error
+	// Listing versions also covers unversioned buckets, whose objects have
+	// the version "null".
+	err := s.fileStorage.ListObjectVersionsPagesWithContext(ctx, &s3.ListObjectVersionsInput{Bucket: bucket},
+		func(page *s3.ListObjectVersionsOutput, last bool) bool {
+			var objects []*s3.ObjectIdentifier
+			for _, version := range page.Versions {
+				objects = append(objects, &s3.ObjectIdentifier{Key: version.Key, VersionId: version.VersionId})
+			}
+			for _, marker := range page.DeleteMarkers {
+				objects = append(objects, &s3.ObjectIdentifier{Key: marker.Key, VersionId: marker.VersionId})
+			}
+			if len(objects) == 0 {
+				return true
+			}
+			// A page holds at most 1000 entries, the limit of DeleteObjects.
+			out, err := s.fileStorage.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+				Bucket: bucket,
+				Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+			})
+			if err == nil && len(out.Errors) > 0 {
+				err = fmt.Errorf("%s: %s", aws.StringValue(out.Errors[0].Key), aws.StringValue(out.Errors[0].Message))
+			}
+			if err != nil {
+				deleteErr = fmt.Errorf("failed to delete objects in bucket %s: %w", s.fileStorageBucket, err)
+				return false
+			}
+			report.ObjectsDeleted += len(page.Versions)
+			return true
+		})
+	if isNoSuchBucket(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to list objects in bucket %s: %w", s.fileStorageBucket, err)
+	}
+	if deleteErr != nil {
+		return deleteErr
+	}
+
+	_, err = s.fileStorage.DeleteBucketWithContext(ctx, &s3.DeleteBucketInput{Bucket: bucket})
+	if isNoSuchBucket(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete bucket %s: %w", s.fileStorageBucket, err)
+	}
+	report.BucketDeleted = true
+	return s.fileStorage.WaitUntilBucketNotExistsWithContext(ctx, &s3.HeadBucketInput{Bucket: bucket})
+}
+
+func (s *Service) teardownTable(ctx context.Context, report *TeardownReport) error {
+	table := aws.String(s.dbFileTableName)
+	_, err := s.db.DeleteTableWithContext(ctx, &dynamodb.DeleteTableInput{TableName: table})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeResourceNotFoundException {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete table %s: %w", s.dbFileTableName, err)
+	}
+	report.TableDeleted = true
+	return s.db.WaitUntilTableNotExistsWithContext(ctx, &dynamodb.DescribeTableInput{TableName: table})
+}
+
+func isNoSuchBucket(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchBucket
+}
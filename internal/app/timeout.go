@@ -0,0 +1,201 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/gorilla/mux"
+)
+
+// streamingRoutes are route templates whose responses may legitimately run
+// for an unbounded time. They can't be given a timeout, and a default
+// timeout requires them to be excluded explicitly.
+var streamingRoutes = map[string]bool{
+	"/file/{id}/download": true,
+	"/files/export":       true,
+}
+
+// RouteTimeouts bounds how long requests may run, per route. Routes are mux
+// path templates such as "/file/{id}". The timeout becomes the request
+// context deadline, so AWS calls made with the request context are cancelled
+// and reported as 504.
+type RouteTimeouts struct {
+	// Default applies to every route without an entry in Routes, except the
+	// ones in Exclude. Zero means no default.
+	Default time.Duration
+	Routes  map[string]time.Duration
+	// Exclude lists routes that get no timeout. With a Default, it must
+	// include every streaming route.
+	Exclude []string
+}
+
+type routeTimeouts struct {
+	fallback time.Duration
+	routes   map[string]time.Duration
+	excluded map[string]bool
+}
+
+func newRouteTimeouts(config RouteTimeouts) *routeTimeouts {
+	t := &routeTimeouts{
+		fallback: config.Default,
+		routes:   config.Routes,
+		excluded: make(map[string]bool, len(config.Exclude)),
+	}
+	for _, route := range config.Exclude {
+		t.excluded[route] = true
+	}
+	return t
+}
+
+// validate checks the configuration against the registered routes.
+func (t *routeTimeouts) validate(router *mux.Router) error {
+	known := make(map[string]bool)
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		if template, err := route.GetPathTemplate(); err == nil {
+			known[template] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if t.fallback < 0 {
+		return fmt.Errorf("default route timeout must not be negative")
+	}
+	for route, timeout := range t.routes {
+		if !known[route] {
+			return fmt.Errorf("route timeout for unknown route %q", route)
+		}
+		if timeout <= 0 {
+			return fmt.Errorf("route timeout for %q must be positive", route)
+		}
+		if streamingRoutes[route] {
+			return fmt.Errorf("streaming route %q cannot have a timeout", route)
+		}
+		if t.excluded[route] {
+			return fmt.Errorf("route %q is both excluded and given a timeout", route)
+		}
+	}
+	for route := range t.excluded {
+		if !known[route] {
+			return fmt.Errorf("unknown excluded route %q", route)
+		}
+	}
+	if t.fallback > 0 {
+		for route := range streamingRoutes {
+			if !t.excluded[route] {
+				return fmt.Errorf("streaming route %q must be excluded from the default timeout", route)
+			}
+		}
+	}
+	return nil
+}
+
+func (t *routeTimeouts) timeout(route string) time.Duration {
+	if timeout, ok := t.routes[route]; ok {
+		return timeout
+	}
+	if t.excluded[route] {
+		return 0
+	}
+	return t.fallback
+}
+
+// middleware must run after routing, so the matched route is known.
+func (t *routeTimeouts) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		template, _ := route.GetPathTemplate()
+		timeout := t.timeout(template)
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// isTimeoutError reports whether an AWS call was cancelled by an expired
+// request context.
+func isTimeoutError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == request.CanceledErrorCode &&
+		errors.Is(awsErr.OrigErr(), context.DeadlineExceeded)
+}
+
+// RequestDeadline bounds the total duration of a request, from reading the
+// body to the last AWS call, independently of the route.
+type RequestDeadline struct {
+	// Default applies to every non-streaming route. Zero means none.
+	Default time.Duration
+	// Max is the longest deadline a client may ask for with the
+	// X-Request-Timeout header. Zero ignores the header.
+	Max time.Duration
+}
+
+func (d *RequestDeadline) validate() error {
+	if d == nil {
+		return nil
+	}
+	if d.Default < 0 || d.Max < 0 {
+		return errors.New("request deadlines must not be negative")
+	}
+	if d.Max > 0 && d.Default > d.Max {
+		return fmt.Errorf("default request deadline %s exceeds the maximum of %s", d.Default, d.Max)
+	}
+	return nil
+}
+
+// parseRequestTimeout reads X-Request-Timeout, either seconds ("2.5") or a
+// Go duration ("1500ms").
+func parseRequestTimeout(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	return time.ParseDuration(value)
+}
+
+// requestDeadline sets the context deadline of a request from the client's
+// X-Request-Timeout, within the maximum, or from the default. Route
+// timeouts still apply; the earlier deadline wins.
+func (s *Service) requestDeadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := s.deadline.Default
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, _ := route.GetPathTemplate(); streamingRoutes[template] {
+				timeout = 0
+			}
+		}
+		if value := r.Header.Get("X-Request-Timeout"); value != "" && s.deadline.Max > 0 {
+			requested, err := parseRequestTimeout(value)
+			if err != nil || requested <= 0 || requested > s.deadline.Max {
+				s.writeJSONError(w, r, http.StatusBadRequest, "invalid_request_timeout",
+					fmt.Sprintf("X-Request-Timeout must be a positive duration of at most %s", s.deadline.Max))
+				return
+			}
+			timeout = requested
+		}
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
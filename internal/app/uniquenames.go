@@ -0,0 +1,121 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// ownerNameIndex is the index on (OwnerID, OriginalName) used to find an
+// owner's files by name.
+const ownerNameIndex = "OwnerNameIndex"
+
+// FilenamePolicy decides what happens when an owner uploads a file under a
+// name one of their files already has.
+type FilenamePolicy string
+
+const (
+	// FilenamesAllowDuplicates lets several files share a name (default).
+	FilenamesAllowDuplicates FilenamePolicy = ""
+	// FilenamesVersion keeps the existing files and gives the new one the
+	// next version number.
+	FilenamesVersion FilenamePolicy = "version"
+	// FilenamesReject rejects the upload with 409 filename_taken.
+	FilenamesReject FilenamePolicy = "reject"
+	// FilenamesOverwrite stores the new file and then deletes the existing
+	// ones.
+	FilenamesOverwrite FilenamePolicy = "overwrite"
+)
+
+// filesByName returns the owner's files named name that aren't soft-deleted.
+// The index is eventually consistent, so a file stored a moment ago may be
+// missing.
+func (s *Service) filesByName(ctx context.Context, ownerID, name string) ([]FileMetadata, error) {
+	var files []FileMetadata
+	var unmarshalErr error
+	err := s.db.QueryPagesWithContext(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(s.dbFileTableName),
+		IndexName:              aws.String(ownerNameIndex),
+		KeyConditionExpression: aws.String("#owner = :owner AND #name = :name"),
+		FilterExpression:       aws.String("attribute_not_exists(#deleted)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#owner":   aws.String("OwnerID"),
+			"#name":    aws.String("OriginalName"),
+			"#deleted": aws.String("DeletedAt"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":owner": {S: aws.String(ownerID)},
+			":name":  {S: aws.String(name)},
+		},
+	}, func(page *dynamodb.QueryOutput, _ bool) bool {
+		var batch []FileMetadata
+		if unmarshalErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &batch); unmarshalErr != nil {
+			return false
+		}
+		files = append(files, batch...)
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query DynamoDB: %w", err)
+	}
+	return files, unmarshalErr
+}
+
+// applyFilenamePolicy checks a new file's name against the owner's existing
+// files before it is stored. It sets the new file's version and returns the
+// files to delete once it is stored.
+func (s *Service) applyFilenamePolicy(ctx context.Context, metadata *FileMetadata) ([]FileMetadata, error) {
+	if s.filenamePolicy == FilenamesAllowDuplicates || metadata.OwnerID == "" || metadata.OriginalName == "" {
+		return nil, nil
+	}
+	existing, err := s.filesByName(ctx, metadata.OwnerID, metadata.OriginalName)
+	if err != nil || len(existing) == 0 {
+		return nil, err
+	}
+	switch s.filenamePolicy {
+	case FilenamesReject:
+		return nil, newAPIError(http.StatusConflict, "filename_taken",
+			fmt.Sprintf("a file named %q already exists", metadata.OriginalName))
+	case FilenamesVersion:
+		latest := 1
+		for _, file := range existing {
+			latest = max(latest, file.Version)
+		}
+		metadata.Version = latest + 1
+		return nil, nil
+	default:
+		return existing, nil
+	}
+}
+
+// replaceFiles deletes the files an upload overwrote. The upload has
+// succeeded by then, so failures are logged.
+func (s *Service) replaceFiles(ctx context.Context, files []FileMetadata) {
+	for i := range files {
+		file := &files[i]
+		var err error
+		if s.softDelete {
+			err = s.markDeleted(ctx, file)
+		} else {
+			err = s.removeFile(ctx, file)
+		}
+		if err != nil {
+			s.logger.Warn("failed to delete overwritten file", "id", file.ID, "error", err)
+			continue
+		}
+		if s.metadataCache != nil {
+			s.metadataCache.remove(file.ID)
+		}
+		if s.dedupWindow != nil {
+			s.dedupWindow.remove(file.ID)
+		}
+		if s.recentPerceptualHashes != nil {
+			s.recentPerceptualHashes.remove(file.ID)
+		}
+		s.logger.Info("overwrote file", "id", file.ID, "name", file.OriginalName, "owner_id", file.OwnerID)
+	}
+}
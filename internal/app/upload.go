@@ -0,0 +1,206 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"image"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// upload is a validated file on its way to storage.
+type upload struct {
+	ownerID      string
+	originalName string
+	hash         string
+	ext          string
+	contentType  string
+	tags         map[string]string
+	size         int64
+	clientIP     string
+	userAgent    string
+	data         []byte
+	// body is set instead of data for streamed uploads, whose hash is only
+	// known once body has been read to the end. size is -1 if unknown.
+	body io.ReadCloser
+	// img is the decoded image, once a processing step has needed it.
+	img image.Image
+	// deferred leaves the processing after storage to the background
+	// workers.
+	deferred bool
+}
+
+func newUpload(ownerID, originalName, ext, contentType string, data []byte) *upload {
+	return &upload{
+		ownerID:      ownerID,
+		originalName: originalName,
+		hash:         calculateHash(data),
+		ext:          ext,
+		contentType:  contentType,
+		size:         int64(len(data)),
+		data:         data,
+	}
+}
+
+func newStreamedUpload(ownerID, originalName, ext, contentType string, body io.ReadCloser, size int64) *upload {
+	return &upload{
+		ownerID:      ownerID,
+		originalName: originalName,
+		ext:          ext,
+		contentType:  contentType,
+		size:         size,
+		body:         body,
+	}
+}
+
+func (u *upload) streamed() bool {
+	return u.body != nil
+}
+
+// rawUploadTypes are the content types accepted as a raw request body.
+var rawUploadTypes = map[string]bool{
+	"image/jpeg": true,
+}
+
+// readUpload reads and validates the uploaded file of a CreateFile request.
+// Browser forms send multipart/form-data with a "file" part; programmatic
+// clients may instead send the raw bytes with an image Content-Type and the
+// filename in the X-Filename header or the filename query parameter. Tags
+// come from the "tags" form field or the X-Tags header.
+func (s *Service) readUpload(r *http.Request) (*upload, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var u *upload
+	var err error
+	if rawUploadTypes[mediaType] || (s.acceptAnyImage && strings.HasPrefix(mediaType, "image/")) {
+		u, err = s.readRawUpload(r)
+	} else {
+		u, err = s.readMultipartUpload(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.recordUploader(r, u)
+	return u, nil
+}
+
+func (s *Service) readMultipartUpload(r *http.Request) (*upload, error) {
+	// FormFile would parse the form with its own 32 MB threshold.
+	if err := parseMultipartForm(r, s.multipartMaxMemory); err != nil {
+		return nil, err
+	}
+	file, fileHeader, err := r.FormFile("file")
+	if errors.Is(err, http.ErrMissingFile) && r.MultipartForm.Value["file"] != nil {
+		// The form parser takes parts without a filename for plain fields.
+		return nil, newAPIError(http.StatusBadRequest, "missing_filename", "the file part must have a filename")
+	}
+	if err != nil {
+		return nil, formError(err)
+	}
+	streamed := false
+	defer func() {
+		// A streamed upload owns the file and closes it once stored.
+		if !streamed {
+			file.Close()
+		}
+	}()
+
+	filename, err := s.cleanFilename(fileHeader.Filename)
+	if err != nil {
+		return nil, err
+	}
+	ext, contentType, err := s.validateFile(file, filename)
+	if err != nil {
+		return nil, err
+	}
+	if contentType, err = s.overrideContentType(contentType, r.FormValue("content_type")); err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if s.dimensionBounds.enabled() {
+		if err := s.checkDimensions(file); err != nil {
+			return nil, err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	tags, err := s.parseTags(r.FormValue("tags"))
+	if err != nil {
+		return nil, err
+	}
+	if s.streamUpload(fileHeader.Size) {
+		streamed = true
+		u := newStreamedUpload(s.owner(r), filename, ext, contentType, file, fileHeader.Size)
+		u.tags = tags
+		return u, nil
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	u := newUpload(s.owner(r), filename, ext, contentType, data)
+	u.tags = tags
+	return u, nil
+}
+
+func (s *Service) readRawUpload(r *http.Request) (*upload, error) {
+	filename := r.Header.Get("X-Filename")
+	if filename == "" {
+		filename = r.URL.Query().Get("filename")
+	}
+	filename, err := s.cleanFilename(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	// The start of the body is validated before the rest is read, so
+	// invalid uploads are rejected without reading, let alone buffering,
+	// all of it. The peeked bytes stay in the reader for storage.
+	body := bufio.NewReaderSize(r.Body, s.uploadPeekSize())
+	head, err := body.Peek(s.uploadPeekSize())
+	if err != nil && err != io.EOF {
+		return nil, formError(err)
+	}
+	ext, contentType, err := s.validateFile(bytes.NewReader(head), filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkDimensions(bytes.NewReader(head)); err != nil {
+		return nil, err
+	}
+	tags, err := s.parseTags(r.Header.Get("X-Tags"))
+	if err != nil {
+		return nil, err
+	}
+	if s.streamUpload(r.ContentLength) {
+		u := newStreamedUpload(s.owner(r), filename, ext, contentType, io.NopCloser(body), r.ContentLength)
+		u.tags = tags
+		return u, nil
+	}
+
+	// The upload size limit applies while reading, whether buffered here or
+	// streamed to S3.
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, formError(err)
+	}
+	u := newUpload(s.owner(r), filename, ext, contentType, data)
+	u.tags = tags
+	return u, nil
+}
+
+// uploadPeekSize is how much of a raw upload body is read ahead for
+// validation: enough to sniff the content type, or to read the image header
+// when the format or dimensions are checked by decoding it.
+func (s *Service) uploadPeekSize() int {
+	if s.acceptAnyImage || s.dimensionBounds.enabled() {
+		return imageHeaderPeekSize
+	}
+	return sniffLen
+}
@@ -0,0 +1,105 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// multipartUpload builds a POST /file request with data in a "file" part
+// named filename.
+func multipartUpload(t *testing.T, filename string, data []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename=%q`, filename))
+	header.Set("Content-Type", "image/jpeg")
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, "/file", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+// errorCode returns the code of an error response.
+func errorCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var response errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("not an error response: %s", w.Body)
+	}
+	return response.Error.Code
+}
+
+func TestUploadRequiresFilename(t *testing.T) {
+	s := newTestService(t, nil)
+	for _, filename := range []string{"", "photo", "photo."} {
+		t.Run(fmt.Sprintf("%q", filename), func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.Handler().ServeHTTP(w, multipartUpload(t, filename, testJPEG(t)))
+			if w.Code != http.StatusBadRequest || errorCode(t, w) != "missing_filename" {
+				t.Errorf("got %d %s, want 400 missing_filename", w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestBatchUploadRequiresFilenames(t *testing.T) {
+	s := newTestService(t, nil)
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, filename := range []string{"a.jpg", ""} {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename=%q`, filename))
+		part, _ := mw.CreatePart(header)
+		part.Write(testJPEG(t))
+	}
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, "/files/batch", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest || errorCode(t, w) != "missing_filename" {
+		t.Errorf("got %d %s, want 400 missing_filename", w.Code, w.Body)
+	}
+}
+
+func TestUploadDedupWindowWithoutDedup(t *testing.T) {
+	var puts atomic.Int32
+	s := newTestService(t, storingFake(&puts), WithDedup(false), WithUploadDedupWindow(time.Minute))
+	data := testJPEG(t)
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, multipartUpload(t, "photo.jpg", data))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("first upload: got %d %s, want 201", w.Code, w.Body)
+	}
+	var first FileResponse
+	json.Unmarshal(w.Body.Bytes(), &first)
+
+	w = httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, multipartUpload(t, "photo.jpg", data))
+	if w.Code != http.StatusOK {
+		t.Fatalf("repeated upload: got %d %s, want 200 for a duplicate", w.Code, w.Body)
+	}
+	var repeat FileResponse
+	json.Unmarshal(w.Body.Bytes(), &repeat)
+	if repeat.Metadata == nil || first.Metadata == nil || repeat.Metadata.ID != first.Metadata.ID {
+		t.Errorf("repeated upload answered with %+v, want the first file %+v", repeat.Metadata, first.Metadata)
+	}
+	if n := puts.Load(); n != 1 {
+		t.Errorf("%d objects stored, want 1", n)
+	}
+}
@@ -0,0 +1,76 @@
+package app
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// maxStoredUserAgentLength bounds the User-Agent kept with a file.
+const maxStoredUserAgentLength = 256
+
+// uploaderInfo records who sent uploads, when enabled.
+type uploaderInfo struct {
+	trustedProxies []netip.Prefix
+}
+
+// clientIP returns the address of the client behind r. X-Forwarded-For is
+// only believed as far as it was appended by trusted proxies: the address
+// is the rightmost one not belonging to a trusted proxy.
+func (u *uploaderInfo) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !u.trusted(addr) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop
+		if !u.trusted(hop) {
+			break
+		}
+	}
+	return addr.Unmap().String()
+}
+
+func (u *uploaderInfo) trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range u.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordUploader stores the client IP and User-Agent of r with u.
+func (s *Service) recordUploader(r *http.Request, u *upload) {
+	if s.uploaderInfo == nil {
+		return
+	}
+	u.clientIP = s.uploaderInfo.clientIP(r)
+	u.userAgent = truncateUTF8(r.UserAgent(), maxStoredUserAgentLength)
+}
+
+// visibleMetadata returns metadata as the caller of r may see it: without
+// the uploader's IP and User-Agent unless the caller is an admin or owns
+// the file. metadata itself is not modified.
+func (s *Service) visibleMetadata(r *http.Request, metadata *FileMetadata) *FileMetadata {
+	if metadata.UploaderIP == "" && metadata.UploaderUserAgent == "" {
+		return metadata
+	}
+	if (metadata.OwnerID != "" && metadata.OwnerID == s.owner(r)) || s.isAdmin(r) {
+		return metadata
+	}
+	redacted := *metadata
+	redacted.UploaderIP, redacted.UploaderUserAgent = "", ""
+	return &redacted
+}
@@ -0,0 +1,30 @@
+package app
+
+import (
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+const (
+	defaultServiceName    = "aws-examples"
+	defaultServiceVersion = "dev"
+	userAgentHandlerName  = "app.RequestIDUserAgent"
+)
+
+// instrumentClient makes every AWS request sent through handlers identify
+// the service and the API request it serves in its User-Agent, e.g.
+// "aws-examples/1.2.0 request-id/4f1c...". The User-Agent shows up in
+// CloudTrail and S3 server access logs, which can then be matched to the
+// service's logs. Requests without a request ID in their context only get
+// the service name.
+func (s *Service) instrumentClient(handlers *request.Handlers) {
+	handlers.Build.RemoveByName(userAgentHandlerName)
+	handlers.Build.PushBackNamed(request.NamedHandler{
+		Name: userAgentHandlerName,
+		Fn: func(r *request.Request) {
+			request.AddToUserAgent(r, s.serviceName+"/"+s.serviceVersion)
+			if id := RequestIDFromContext(r.Context()); id != "" {
+				request.AddToUserAgent(r, "request-id/"+id)
+			}
+		},
+	})
+}
@@ -0,0 +1,106 @@
+package app
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// sniffLen is how much content type sniffing looks at.
+	sniffLen = 512
+	// imageHeaderPeekSize bounds how much of a raw upload is read ahead to
+	// decode the image header; metadata segments such as EXIF or ICC
+	// profiles come before the dimensions.
+	imageHeaderPeekSize = 256 << 10
+)
+
+type ExtensionSource int
+
+const (
+	// ExtensionFromFilename keeps the extension of the uploaded filename.
+	ExtensionFromFilename ExtensionSource = iota
+	// ExtensionFromContentType assigns the canonical extension of the sniffed
+	// content type and ignores the uploaded filename.
+	ExtensionFromContentType
+)
+
+// canonicalExtensions maps accepted content types to the extension stored
+// for them in ExtensionFromContentType mode.
+var canonicalExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+}
+
+var allowedExtensions = []string{".jpg", ".jpeg"}
+
+// formatExtensions maps image.DecodeConfig format names to the extension
+// stored in accept-any-image mode. Other formats are stored as ".<format>".
+var formatExtensions = map[string]string{
+	"jpeg": ".jpg",
+}
+
+// isAllowedExtension compares case-insensitively, so "PHOTO.JPG" is accepted
+// whether or not extensions are lowercased for storage.
+func isAllowedExtension(ext string) bool {
+	for _, allowed := range allowedExtensions {
+		if strings.EqualFold(ext, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateFile checks the upload's filename and sniffed content type and
+// returns the extension to store it under along with the content type.
+func (s *Service) validateFile(file io.Reader, filename string) (ext, contentType string, err error) {
+	if s.acceptAnyImage {
+		return validateAnyImage(file)
+	}
+	if s.extensionSource == ExtensionFromFilename {
+		ext = filepath.Ext(filename)
+		if ext == "." {
+			ext = ""
+		}
+		if ext == "" && s.requireFilename {
+			return "", "", newAPIError(http.StatusBadRequest, "missing_filename", "upload must have a filename with an extension")
+		}
+		if s.lowercaseExtensions {
+			ext = strings.ToLower(ext)
+		}
+		if ext != "" && !isAllowedExtension(ext) {
+			return "", "", newAPIError(http.StatusUnsupportedMediaType, "unsupported_media_type", "only JPEG files are allowed")
+		}
+	}
+
+	buffer := make([]byte, sniffLen)
+	n, err := file.Read(buffer)
+	if err != nil {
+		return "", "", newAPIError(http.StatusUnsupportedMediaType, "unsupported_media_type", fmt.Sprintf("failed to read file: %v", err))
+	}
+	mimeType := http.DetectContentType(buffer[:n])
+	if mimeType != "image/jpeg" {
+		return "", "", newAPIError(http.StatusUnsupportedMediaType, "unsupported_media_type", "file is not a valid JPEG image")
+	}
+	if ext == "" {
+		ext = canonicalExtensions[mimeType]
+	}
+	return ext, mimeType, nil
+}
+
+// validateAnyImage accepts anything a registered image decoder recognizes,
+// and derives the extension and content type from the detected format
+// instead of the filename.
+func validateAnyImage(file io.Reader) (ext, contentType string, err error) {
+	_, format, err := image.DecodeConfig(file)
+	if err != nil {
+		return "", "", newAPIError(http.StatusUnsupportedMediaType, "unsupported_media_type", "file is not a supported image")
+	}
+	ext, ok := formatExtensions[format]
+	if !ok {
+		ext = "." + format
+	}
+	return ext, "image/" + format, nil
+}
@@ -0,0 +1,90 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestValidateFileExtensionCase(t *testing.T) {
+	tests := []struct {
+		filename  string
+		lowercase bool
+		want      string
+	}{
+		{"PHOTO.JPG", true, ".jpg"},
+		{"photo.JpEg", true, ".jpeg"},
+		{"photo.jpg", true, ".jpg"},
+		{"PHOTO.JPG", false, ".JPG"},
+		{"photo", true, ".jpg"},
+	}
+	for _, tt := range tests {
+		s := newTestService(t, nil, WithLowercaseExtensions(tt.lowercase), WithRequireFilename(false))
+		ext, contentType, err := s.validateFile(bytes.NewReader(testJPEG(t)), tt.filename)
+		if err != nil {
+			t.Errorf("validateFile(%q): %v", tt.filename, err)
+			continue
+		}
+		if ext != tt.want || contentType != "image/jpeg" {
+			t.Errorf("validateFile(%q) with lowercasing %t = %q, %q; want %q, image/jpeg",
+				tt.filename, tt.lowercase, ext, contentType, tt.want)
+		}
+	}
+}
+
+func TestValidateFileRejectsOtherExtensions(t *testing.T) {
+	s := newTestService(t, nil)
+	_, _, err := s.validateFile(bytes.NewReader(testJPEG(t)), "PHOTO.PNG")
+	if code := apiErrorCode(err); code != "unsupported_media_type" {
+		t.Errorf("error code = %q, want unsupported_media_type", code)
+	}
+}
+
+func TestUploadLowercasesExtension(t *testing.T) {
+	var puts atomic.Int32
+	var objectPaths []string
+	var items []map[string]map[string]any
+	storing := storingFake(&puts)
+	fake := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && !isDynamoDB(r) {
+			objectPaths = append(objectPaths, r.URL.Path)
+		}
+		if strings.HasSuffix(r.Header.Get("X-Amz-Target"), ".PutItem") {
+			body, _ := io.ReadAll(r.Body)
+			var input struct{ Item map[string]map[string]any }
+			json.Unmarshal(body, &input)
+			items = append(items, input.Item)
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		storing.ServeHTTP(w, r)
+	})
+	s := newTestService(t, fake)
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, multipartUpload(t, "PHOTO.JPG", testJPEG(t)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	var response FileResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || response.Metadata == nil {
+		t.Fatalf("response %s: %v", w.Body, err)
+	}
+	if response.Metadata.Extension != ".jpg" {
+		t.Errorf("extension = %q, want .jpg", response.Metadata.Extension)
+	}
+	wantPath := "/" + testBucket + "/" + response.Metadata.ID + ".jpg"
+	if len(objectPaths) != 1 || objectPaths[0] != wantPath {
+		t.Errorf("objects stored at %v, want %s", objectPaths, wantPath)
+	}
+	if len(items) != 1 || items[0]["Extension"]["S"] != ".jpg" {
+		t.Fatalf("metadata items %v, want Extension .jpg", items)
+	}
+	if name := items[0]["OriginalName"]["S"]; name != "PHOTO.JPG" {
+		t.Errorf("original name = %v, want PHOTO.JPG kept as uploaded", name)
+	}
+}
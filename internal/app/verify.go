@@ -0,0 +1,56 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// verifyObject checks that the object of metadata exists, for GetFile with
+// ?verify=true, so that metadata whose object is gone yields 404
+// object_missing instead of a URL that fails at S3. With flagging enabled
+// the row is also marked for reconciliation.
+func (s *Service) verifyObject(ctx context.Context, metadata *FileMetadata) error {
+	key := objectKey(metadata)
+	_, _, err := s.headObject(ctx, key)
+	if err == nil {
+		return nil
+	}
+	if !isNotFoundError(err) {
+		return err
+	}
+	s.logger.Warn("file object missing", "id", metadata.ID, "key", key, "request_id", RequestIDFromContext(ctx))
+	if s.flagMissingObjects {
+		if err := s.flagMissingObject(ctx, metadata.ID); err != nil {
+			s.logger.Error("failed to flag missing object", "id", metadata.ID, "error", err)
+		}
+	}
+	return newAPIError(http.StatusNotFound, "object_missing", "file object not found in storage")
+}
+
+// flagMissingObject records on the row that its object was found missing.
+func (s *Service) flagMissingObject(ctx context.Context, id string) error {
+	_, err := s.db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(s.dbFileTableName),
+		Key:                 map[string]*dynamodb.AttributeValue{"ID": {S: aws.String(id)}},
+		UpdateExpression:    aws.String("SET #missing = :now"),
+		ConditionExpression: aws.String("attribute_exists(ID)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#missing": aws.String("ObjectMissingAt"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": {S: aws.String(s.now().Format(time.RFC3339))},
+		},
+	})
+	if err != nil && !isConditionFailed(err) {
+		return fmt.Errorf("failed to flag file: %w", err)
+	}
+	if s.metadataCache != nil {
+		s.metadataCache.remove(id)
+	}
+	return nil
+}